@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// adminShutdownTimeout is how long the admin API waits for requests on shutdown
+const adminShutdownTimeout = 5 * time.Second
+
+// startAdmin starts the admin HTTP API if an admin listen address is configured
+func (s *DNSServer) startAdmin() {
+	listen := s.currentConfig().Admin.Listen
+	if listen == "" {
+		return
+	}
+
+	s.admin = &http.Server{
+		Addr:    listen,
+		Handler: s.adminHandler(),
+	}
+
+	go func() {
+		log.Printf("Starting admin API on %s", listen)
+		if err := s.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API error: %v", err)
+		}
+	}()
+}
+
+// stopAdmin stops the admin HTTP API
+func (s *DNSServer) stopAdmin() error {
+	if s.admin == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	return s.admin.Shutdown(ctx)
+}
+
+// adminHandler returns the HTTP handler serving the admin API
+func (s *DNSServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/records", s.handleRecordsAdd)
+	mux.HandleFunc("/records/export", s.handleRecordsExport)
+	mux.HandleFunc("/resolve", s.handleResolve)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	return mux
+}
+
+// handleReadyz reports whether the server is ready to answer from its records
+// It fails before records are loaded and while a failed reload has degraded the server
+func (s *DNSServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	select {
+	case <-s.recordsReady:
+	default:
+		http.Error(w, "records not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.recordsDegraded.Load() {
+		http.Error(w, "degraded: records reload failed", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ready\n"))
+}
+
+// handleStats serves the current metrics as JSON
+func (s *DNSServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.metrics.Snapshot()); err != nil {
+		log.Printf("Error encoding stats: %v", err)
+	}
+}
+
+// handleMetrics serves the current metrics in the Prometheus text format
+func (s *DNSServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.WritePrometheus(w)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordsReloadFailureDegrades(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("reload_failure_policy = \"degrade\"\ndegraded_servfail = true"))
+	server := newTestServer(t, config)
+	server.markRecordsLoaded()
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		server.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	writeRecords := func(content string) {
+		writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile), content)
+		server.ReloadRecords()
+	}
+
+	writeRecords(testRecords("local.test", "192.0.2.1"))
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("readyz got %d after a good load, want 200", code)
+	}
+
+	// A failed reload keeps the old records but marks the server degraded
+	writeRecords("[[records]\n")
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz got %d after a failed reload, want 503", code)
+	}
+	if m := ask(server, "local.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL for a local name while degraded", m)
+	}
+
+	// A good reload clears the degraded state
+	writeRecords(testRecords("local.test", "192.0.2.2"))
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("readyz got %d after a good reload, want 200", code)
+	}
+	if m := ask(server, "local.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the reloaded record", m)
+	}
+}
+
+func TestRecordsReloadFailureKeepServing(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	server := newTestServer(t, config)
+	server.markRecordsLoaded()
+
+	dir, name := filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile)
+	writeTestFile(t, dir, name, testRecords("local.test", "192.0.2.1"))
+	server.ReloadRecords()
+	writeTestFile(t, dir, name, "[[records]\n")
+	server.ReloadRecords()
+
+	rec := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("readyz got %d, want 200 under the keep-serving policy", rec.Code)
+	}
+	if m := ask(server, "local.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the last good record", m)
+	}
+}
+
+// postRecord posts a JSON record to the add endpoint and returns the response
+func postRecord(server *DNSServer, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	server.adminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRecordsAddAccepted(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, strings.Replace(recordsAdminConfig, "[server]\n", "[server]\nmin_record_ttl = 60\nmax_record_ttl = 86400\n", 1))
+	writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile), testRecords("old.test", "192.0.2.1"))
+	server := newTestServer(t, config)
+	server.ReloadRecords()
+
+	rec := postRecord(server, `{"domain": "new.test", "type": "A", "value": "192.0.2.2", "ttl": 300}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %d %q, want 201", rec.Code, rec.Body.String())
+	}
+
+	for name, want := range map[string]string{"old.test": "192.0.2.1", "new.test": "192.0.2.2"} {
+		if got := answerValue(server, name); got != want {
+			t.Errorf("got %q for %s, want %s", got, name, want)
+		}
+	}
+
+	// The record is kept in the records file, so it survives a reload
+	server.ReloadRecords()
+	if got := answerValue(server, "new.test"); got != "192.0.2.2" {
+		t.Errorf("got %q for new.test after a reload, want 192.0.2.2", got)
+	}
+}
+
+func TestRecordsAddRejectsTTLOutsideRange(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, strings.Replace(recordsAdminConfig, "[server]\n", "[server]\nmin_record_ttl = 60\nmax_record_ttl = 86400\n", 1))
+	path := writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile), testRecords("old.test", "192.0.2.1"))
+	server := newTestServer(t, config)
+	server.ReloadRecords()
+
+	for _, ttl := range []string{"-1", "30", "86401"} {
+		rec := postRecord(server, `{"domain": "new.test", "type": "A", "value": "192.0.2.2", "ttl": `+ttl+`}`)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "outside the allowed range 60 to 86400") {
+			t.Errorf("ttl %s: got %d %q, want 400 for the TTL range", ttl, rec.Code, rec.Body.String())
+		}
+	}
+
+	if content, err := os.ReadFile(path); err != nil || string(content) != testRecords("old.test", "192.0.2.1") {
+		t.Errorf("records file changed to %q (%v)", content, err)
+	}
+	if got := answerValue(server, "new.test"); got != "" {
+		t.Errorf("rejected record answered with %s", got)
+	}
+}
+
+func TestRecordsAddRequiresToken(t *testing.T) {
+	setTestRecords(t)
+	server := newTestServer(t, loadTestConfig(t, recordsAdminConfig))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{"domain": "new.test", "type": "A", "value": "192.0.2.2", "ttl": 300}`))
+	server.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d without a token, want 401", rec.Code)
+	}
+}
+
+func TestRecordsAddCNAMEConflict(t *testing.T) {
+	for _, policy := range []string{CNAMEConflictError, CNAMEConflictWarn} {
+		t.Run(policy, func(t *testing.T) {
+			setTestRecords(t)
+			config := loadTestConfig(t, strings.Replace(recordsAdminConfig, "[server]\n", "[server]\ncname_conflict_policy = \""+policy+"\"\n", 1))
+			writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile),
+				"[[records]]\ndomain = \"alias.test\"\ntype = \"CNAME\"\nvalue = \"target.test.\"\nttl = 60\n")
+			server := newTestServer(t, config)
+			server.ReloadRecords()
+			logs := captureLog(t)
+
+			rec := postRecord(server, `{"domain": "alias.test", "type": "A", "value": "192.0.2.2", "ttl": 300}`)
+			if policy == CNAMEConflictError {
+				if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "alias.test has a CNAME record alongside A records") {
+					t.Errorf("got %d %q, want 400 for the CNAME conflict", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != http.StatusCreated {
+				t.Errorf("got %d %q, want 201 under the warn policy", rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(logs.String(), "alias.test has a CNAME record alongside A records") {
+				t.Errorf("conflict was not logged, got %q", logs.String())
+			}
+		})
+	}
+}
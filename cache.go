@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultCacheEntries is the cache size used when max_entries is not set
+const defaultCacheEntries = 10000
+
+// staleAnswerTTL is the TTL of stale answers served after upstream errors, as RFC 8767 suggests
+const staleAnswerTTL = 30
+
+// ResponseCache caches upstream responses until their TTL expires
+type ResponseCache struct {
+	entries    map[string]*cacheEntry
+	maxEntries int
+
+	// Entries removed to make room for new ones
+	evictions atomic.Uint64
+
+	// How long expired entries are kept to be served stale
+	maxStale atomic.Int64
+
+	// Source of the current time for expiry
+	clock Clock
+
+	// Guards entries
+	mu sync.Mutex
+}
+
+// cacheEntry is a cached response and the time it was stored
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// NewResponseCache creates a cache holding at most maxEntries responses,
+// expiring them by the given clock
+func NewResponseCache(maxEntries int, clock Clock) *ResponseCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+
+	return &ResponseCache{
+		entries:    make(map[string]*cacheEntry),
+		maxEntries: maxEntries,
+		clock:      clock,
+	}
+}
+
+// Get returns a copy of a cached response with TTLs reduced by the time spent in the cache
+func (c *ResponseCache) Get(key string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := c.clock.Now()
+	if !now.Before(entry.expires) {
+		// Keep expired entries that may still be served stale
+		if !now.Before(entry.expires.Add(time.Duration(c.maxStale.Load()))) {
+			delete(c.entries, key)
+		}
+		return nil, false
+	}
+
+	msg := entry.msg.Copy()
+	decrementTTLs(msg, uint32(now.Sub(entry.stored).Seconds()))
+
+	return msg, true
+}
+
+// GetStale returns a copy of a cached response that expired no longer than
+// maxStale ago, or is still fresh, with its TTLs set to staleAnswerTTL
+func (c *ResponseCache) GetStale(key string, maxStale time.Duration) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || c.clock.Now().Sub(entry.expires) > maxStale {
+		return nil, false
+	}
+
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = staleAnswerTTL
+			}
+		}
+	}
+
+	return msg, true
+}
+
+// SetMaxStale sets how long expired entries are kept to be served stale
+func (c *ResponseCache) SetMaxStale(maxStale time.Duration) {
+	c.maxStale.Store(int64(maxStale))
+}
+
+// Set stores a response for as long as its lowest TTL, but at least minTTL seconds
+// Responses that should not be cached are ignored
+func (c *ResponseCache) Set(key string, msg *dns.Msg, minTTL uint32) {
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+	ttl = max(ttl, minTTL)
+
+	c.SetWithTTL(key, msg, time.Duration(ttl)*time.Second)
+}
+
+// SetOverride stores a cacheable response for ttl instead of its own TTLs
+// A zero ttl keeps the response out of the cache
+func (c *ResponseCache) SetOverride(key string, msg *dns.Msg, ttl time.Duration) {
+	if _, ok := cacheTTL(msg); !ok || ttl <= 0 {
+		return
+	}
+
+	c.SetWithTTL(key, msg, ttl)
+}
+
+// SetWithTTL stores a response for the given duration regardless of its contents
+func (c *ResponseCache) SetWithTTL(key string, msg *dns.Msg, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(key, msg, ttl)
+}
+
+// SetFailure stores a failure response for the given duration, unless the key
+// holds an answer that may still be served stale, which the failure must not replace
+func (c *ResponseCache) SetFailure(key string, msg *dns.Msg, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && entry.msg.Rcode != dns.RcodeServerFailure &&
+		c.clock.Now().Sub(entry.expires) <= time.Duration(c.maxStale.Load()) {
+		return
+	}
+	c.setLocked(key, msg, ttl)
+}
+
+// setLocked stores a response for the given duration
+// Must be called with mu held
+func (c *ResponseCache) setLocked(key string, msg *dns.Msg, ttl time.Duration) {
+	now := c.clock.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+
+	c.entries[key] = &cacheEntry{
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// Invalidate removes the cached responses whose query name matches
+// Returns the number of removed entries
+func (c *ResponseCache) Invalidate(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, entry := range c.entries {
+		if len(entry.msg.Question) > 0 && match(entry.msg.Question[0].Name) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Len returns the number of cached responses
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// evict removes expired entries, or an arbitrary entry if none have expired
+func (c *ResponseCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	if len(c.entries) < c.maxEntries {
+		return
+	}
+
+	for key := range c.entries {
+		delete(c.entries, key)
+		c.evictions.Add(1)
+		return
+	}
+}
+
+// Evictions returns the number of entries removed to make room for new ones
+func (c *ResponseCache) Evictions() uint64 {
+	return c.evictions.Load()
+}
+
+// cacheMaxStale returns how long expired answers are kept to be served stale
+func cacheMaxStale(config *Config) time.Duration {
+	if !config.Cache.ServeStaleOnError {
+		return 0
+	}
+	return time.Duration(config.Cache.MaxStale) * time.Second
+}
+
+// cacheTTL returns how long a response may be cached
+// Positive answers use their lowest TTL and negative answers the SOA minimum
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	var ttl uint32
+	found := false
+
+	if len(msg.Answer) > 0 {
+		for _, rr := range msg.Answer {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	} else {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				found = true
+				break
+			}
+		}
+	}
+
+	return ttl, found && ttl > 0
+}
+
+// decrementTTLs reduces the TTL of every record in a message by elapsed seconds
+func decrementTTLs(msg *dns.Msg, elapsed uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+}
+
+// cacheKey builds the cache key for a request
+// With respectECS, queries carrying an EDNS Client Subnet option are keyed
+// by their normalized subnet so subnet-specific answers are not shared.
+// Unvalidated answers to CD queries are kept apart from validated ones
+func cacheKey(r *dns.Msg, respectECS bool) string {
+	q := r.Question[0]
+	key := fmt.Sprintf("%s|%d|%d", normalizeName(q.Name), q.Qtype, q.Qclass)
+
+	if r.CheckingDisabled {
+		key += "|cd"
+	}
+
+	if respectECS {
+		if subnet := requestSubnet(r); subnet != "" {
+			key += "|" + subnet
+		}
+	}
+
+	return key
+}
+
+// requestSubnet returns the normalized EDNS Client Subnet of a request, if any
+func requestSubnet(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+
+		// Mask the address so clients in the same subnet share an entry
+		mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+		network := net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+		return network.String()
+	}
+
+	return ""
+}
+
+// validateCacheOverrides checks that every cache override has a pattern and a valid TTL
+func validateCacheOverrides(overrides []CacheOverride) error {
+	for _, override := range overrides {
+		if override.Pattern == "" {
+			return fmt.Errorf("cache_override requires a pattern")
+		}
+
+		if override.CacheTTL < 0 {
+			return fmt.Errorf("cache_override %s: cache_ttl must not be negative", override.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// findCacheOverride returns the cache time of the most specific override matching a domain
+func findCacheOverride(overrides []CacheOverride, domain string) (time.Duration, bool) {
+	var best *CacheOverride
+	for i := range overrides {
+		override := &overrides[i]
+		if !MatchDomain(override.Pattern, domain) {
+			continue
+		}
+
+		if best == nil || matchSpecificity(override.Pattern) > matchSpecificity(best.Pattern) {
+			best = override
+		}
+	}
+
+	if best == nil {
+		return 0, false
+	}
+	return time.Duration(best.CacheTTL) * time.Second, true
+}
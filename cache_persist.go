@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCachePersistInterval is the number of seconds between cache snapshots
+	defaultCachePersistInterval = 60
+
+	// maxCacheSnapshotSize bounds how much of a snapshot file is read
+	maxCacheSnapshotSize = 256 << 20
+)
+
+// cacheSnapshotEntry is a cached response as stored on disk
+type cacheSnapshotEntry struct {
+	Key     string    `json:"key"`
+	Msg     []byte    `json:"msg"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+}
+
+// Save writes the unexpired cache entries to a file
+// The snapshot is written to a temporary file and renamed into place
+func (c *ResponseCache) Save(path string) (int, error) {
+	now := c.clock.Now()
+	entries := []cacheSnapshotEntry{}
+
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			continue
+		}
+
+		packed, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cacheSnapshotEntry{
+			Key:     key,
+			Msg:     packed,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+		})
+	}
+	c.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create cache snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(entries); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to replace cache snapshot: %w", err)
+	}
+
+	return len(entries), nil
+}
+
+// Load restores unexpired entries from a cache snapshot
+// A missing snapshot is not an error
+func (c *ResponseCache) Load(path string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cache snapshot: %w", err)
+	}
+	defer file.Close()
+
+	var entries []cacheSnapshotEntry
+	if err := json.NewDecoder(io.LimitReader(file, maxCacheSnapshotSize)).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+
+	now := c.clock.Now()
+	loaded := 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		if len(c.entries) >= c.maxEntries {
+			break
+		}
+		if !now.Before(entry.Expires) || entry.Stored.After(now) {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(entry.Msg); err != nil {
+			continue
+		}
+
+		c.entries[entry.Key] = &cacheEntry{
+			msg:     msg,
+			stored:  entry.Stored,
+			expires: entry.Expires,
+		}
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// startCachePersistence restores the cache from its snapshot and saves it periodically
+func (s *DNSServer) startCachePersistence() {
+	config := s.currentConfig().Cache
+	cache := s.currentCache()
+	if cache == nil || config.PersistPath == "" {
+		return
+	}
+
+	loaded, err := cache.Load(config.PersistPath)
+	if err != nil {
+		log.Printf("Error restoring cache: %v", err)
+	} else {
+		log.Printf("Restored %d cache entries from %s", loaded, config.PersistPath)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.PersistInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.saveCache()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// saveCache writes a snapshot of the cache if persistence is configured
+func (s *DNSServer) saveCache() {
+	path := s.currentConfig().Cache.PersistPath
+	cache := s.currentCache()
+	if cache == nil || path == "" {
+		return
+	}
+
+	if _, err := cache.Save(path); err != nil {
+		log.Printf("Error saving cache: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheStatsTopMissed is the number of most-missed names in each cache stats line
+const cacheStatsTopMissed = 5
+
+// maxMissedNames bounds the distinct names counted between stats lines, so
+// queries for random names cannot grow the counts without limit
+const maxMissedNames = 10000
+
+// missedNames counts cache misses by query name between stats lines
+type missedNames struct {
+	counts map[string]uint64
+	// Distinct names counted at most, misses for further names only add to overflow
+	limit    int
+	overflow uint64
+
+	// Guards counts and overflow
+	mu sync.Mutex
+}
+
+// newMissedNames creates an empty miss counter tracking at most limit names
+func newMissedNames(limit int) *missedNames {
+	return &missedNames{counts: make(map[string]uint64), limit: limit}
+}
+
+// add counts a cache miss for a name
+func (m *missedNames) add(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.counts[name]; !ok && len(m.counts) >= m.limit {
+		m.overflow++
+		return
+	}
+	m.counts[name]++
+}
+
+// take returns the counted misses and the misses of names beyond the limit,
+// and starts counting afresh
+func (m *missedNames) take() (map[string]uint64, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts, overflow := m.counts, m.overflow
+	m.counts = make(map[string]uint64)
+	m.overflow = 0
+	return counts, overflow
+}
+
+// topMissed formats the n names with the most misses, most missed first
+func topMissed(counts map[string]uint64, n int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	if len(names) > n {
+		names = names[:n]
+	}
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s:%d", name, counts[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// cacheStatsCounters are the cumulative counters a stats line is measured against
+type cacheStatsCounters struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// startCacheStats logs a cache summary every stats_interval minutes
+func (s *DNSServer) startCacheStats() {
+	interval := s.currentConfig().Cache.StatsInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+		defer ticker.Stop()
+
+		var last cacheStatsCounters
+		for {
+			select {
+			case <-ticker.C:
+				last = s.logCacheStats(last)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// logCacheStats logs the cache activity since the previous line and returns
+// the counters the next line is measured against
+func (s *DNSServer) logCacheStats(last cacheStatsCounters) cacheStatsCounters {
+	snapshot := s.metrics.Snapshot()
+	current := cacheStatsCounters{
+		hits:   snapshot.CacheHits,
+		misses: snapshot.CacheMisses,
+	}
+
+	size := 0
+	if cache := s.currentCache(); cache != nil {
+		size = cache.Len()
+		current.evictions = cache.Evictions()
+	}
+
+	// A reload replaces the cache and starts its eviction count over
+	if current.evictions < last.evictions {
+		last.evictions = 0
+	}
+
+	interval := StatsSnapshot{
+		CacheHits:   current.hits - last.hits,
+		CacheMisses: current.misses - last.misses,
+	}
+
+	missed, untracked := s.missed.take()
+	log.Printf("Cache stats: hit_ratio=%.3f hits=%d misses=%d size=%d evictions=%d top_missed=%s untracked_misses=%d",
+		interval.CacheHitRatio(), interval.CacheHits, interval.CacheMisses, size,
+		current.evictions-last.evictions, topMissed(missed, cacheStatsTopMissed), untracked)
+
+	return current
+}
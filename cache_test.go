@@ -0,0 +1,446 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ecsQuery builds a query carrying an EDNS Client Subnet option for addr/24
+func ecsQuery(name, addr string) *dns.Msg {
+	r := query(name, dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP(addr).To4(),
+	})
+	return r
+}
+
+func TestCacheKeyedByClientSubnet(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\nrespect_ecs = true\n")
+	var queries atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		// Answer with the first address of the client's subnet
+		subnet := r.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+		w.WriteMsg(answerFor(r, subnet.Address.Mask(net.CIDRMask(24, 32)).String(), 60))
+	})
+	server := newTestServer(t, config)
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"198.51.100.7", "198.51.100.0"},
+		{"203.0.113.7", "203.0.113.0"},
+		{"198.51.100.99", "198.51.100.0"},
+	}
+	for _, tt := range tests {
+		w := newTestWriter("10.0.0.1", false)
+		server.handleRequest(w, ecsQuery("geo.test", tt.client))
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tt.want {
+			t.Errorf("subnet of %s got %v, want %s", tt.client, w.msg, tt.want)
+		}
+	}
+
+	if got := queries.Load(); got != 2 {
+		t.Errorf("upstream got %d queries, want one per subnet", got)
+	}
+}
+
+func TestServFailCachedWithinWindow(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\nservfail_ttl = 1\n")
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		servFail(w, r)
+	})
+	server := newTestServer(t, config)
+
+	for i := 0; i < 2; i++ {
+		if m := ask(server, "broken.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("query %d: got %v, want SERVFAIL", i+1, m)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times within the window, want 1", got)
+	}
+
+	// Once the window passes the upstream is tried again
+	time.Sleep(1100 * time.Millisecond)
+	ask(server, "broken.test", dns.TypeA)
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hit %d times after the window, want 2", got)
+	}
+}
+
+func TestPersistedCacheReloaded(t *testing.T) {
+	setTestRecords(t)
+	persistConfig := testConfig + "\n[cache]\nenabled = true\npersist_path = \"" + filepath.Join(t.TempDir(), "cache.json") + "\"\n"
+
+	config := loadTestConfig(t, persistConfig)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	first := newTestServer(t, config)
+	if m := ask(first, "persist.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Fatalf("got %v, want an answer to cache", m)
+	}
+	if err := first.Stop(time.Second); err != nil {
+		t.Fatalf("failed to stop server: %v", err)
+	}
+
+	// After the restart the upstream fails, so only the cache can answer
+	config = loadTestConfig(t, persistConfig)
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		servFail(w, r)
+	})
+	second := newTestServer(t, config)
+	second.startCachePersistence()
+	t.Cleanup(func() { second.Stop(time.Second) })
+
+	m := ask(second, "persist.test", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("got %v, want the persisted answer", m)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl == 0 || ttl > 60 {
+		t.Errorf("got ttl %d, want the remaining part of 60", ttl)
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream hit %d times, want the persisted entry served", got)
+	}
+}
+
+func TestRecordsReloadEvictsOnlyChangedEntries(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\n")
+	dir := t.TempDir()
+	config.Server.RecordsFile = writeTestFile(t, dir, "records.toml",
+		testRecords("edited.test", "192.0.2.1")+testRecords("stable.test", "192.0.2.2"))
+	if _, err := LoadRecords(config.Server); err != nil {
+		t.Fatalf("LoadRecords: %v", err)
+	}
+	server := newTestServer(t, config)
+
+	keys := make(map[string]string)
+	for _, name := range []string{"edited.test", "stable.test", "upstream.test"} {
+		r := query(name, dns.TypeA)
+		keys[name] = cacheKey(r, false)
+		server.currentCache().Set(keys[name], answerFor(r, "198.51.100.1", 300), 0)
+	}
+
+	writeTestFile(t, dir, "records.toml", testRecords("edited.test", "192.0.2.9")+testRecords("stable.test", "192.0.2.2"))
+	server.ReloadRecords()
+
+	for name, cached := range map[string]bool{"edited.test": false, "stable.test": true, "upstream.test": true} {
+		if _, ok := server.currentCache().Get(keys[name]); ok != cached {
+			t.Errorf("%s: cached = %t after the reload, want %t", name, ok, cached)
+		}
+	}
+}
+
+func TestMinCacheTTLRetainsShortTTLAnswers(t *testing.T) {
+	for _, tt := range []struct {
+		floorClientTTL bool
+		wantTTL        uint32
+	}{
+		{false, 0},
+		{true, 10},
+	} {
+		setTestRecords(t)
+		clock := NewFakeClock(time.Unix(1700000000, 0))
+		config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\nmin_cache_ttl = 30\nfloor_client_ttl = "+strconv.FormatBool(tt.floorClientTTL)+"\n")
+		var hits atomic.Int32
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			hits.Add(1)
+			w.WriteMsg(answerFor(r, "192.0.2.1", 1))
+		})
+		server := newTestServer(t, config, WithClock(clock))
+
+		ask(server, "hot.test", dns.TypeA)
+		clock.Advance(20 * time.Second)
+		m := ask(server, "hot.test", dns.TypeA)
+		if got := hits.Load(); got != 1 {
+			t.Errorf("floor_client_ttl = %t: upstream hit %d times within min_cache_ttl, want 1", tt.floorClientTTL, got)
+		}
+		if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Ttl != tt.wantTTL {
+			t.Errorf("floor_client_ttl = %t: got %v, want ttl %d", tt.floorClientTTL, m, tt.wantTTL)
+		}
+
+		clock.Advance(11 * time.Second)
+		ask(server, "hot.test", dns.TypeA)
+		if got := hits.Load(); got != 2 {
+			t.Errorf("floor_client_ttl = %t: upstream hit %d times after min_cache_ttl, want 2", tt.floorClientTTL, got)
+		}
+	}
+}
+
+func TestNameVariantsShareCacheEntryAndRecord(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "Host.Example.test.", Type: "A", Value: "192.0.2.1", TTL: 60})
+	config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\n")
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	variants := []string{"remote.test.", "REMOTE.test.", "Remote.Test"}
+	for _, name := range variants {
+		m := ask(server, name, dns.TypeA)
+		if m == nil || len(m.Answer) != 1 {
+			t.Fatalf("%s: got %v, want an answer", name, m)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times for %d variants of one name, want 1", got, len(variants))
+	}
+	if cacheKey(query("REMOTE.test.", dns.TypeA), false) != cacheKey(query("remote.test", dns.TypeA), false) {
+		t.Error("name variants have different cache keys")
+	}
+
+	for _, name := range []string{"host.example.test", "HOST.EXAMPLE.TEST.", "Host.Example.Test"} {
+		if record := server.findRecord(name, "A", nil); record == nil || record.Value != "192.0.2.1" {
+			t.Errorf("%s: got %v, want the record", name, record)
+		}
+	}
+}
+
+func TestCacheBypassClients(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig(`cache_bypass_clients = ["10.9.0.0/16"]`)+"\n[cache]\nenabled = true\n")
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	askFrom := func(client string) *dns.Msg {
+		w := newTestWriter(client, false)
+		server.handleRequest(w, query("probed.test", dns.TypeA))
+		return w.msg
+	}
+
+	// A normal client fills the cache and is then answered from it
+	askFrom("10.0.0.1")
+	askFrom("10.0.0.1")
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("upstream hit %d times for a normal client, want 1", got)
+	}
+
+	// Bypass clients always go upstream, even with the answer cached
+	for i := 0; i < 2; i++ {
+		if m := askFrom("10.9.1.1"); m == nil || len(m.Answer) != 1 {
+			t.Fatalf("bypass query %d: got %v, want an answer", i+1, m)
+		}
+	}
+	if got := hits.Load(); got != 3 {
+		t.Errorf("upstream hit %d times, want 3 with two bypass queries", got)
+	}
+
+	// Nor do their answers fill the cache
+	server.currentCache().Invalidate(func(string) bool { return true })
+	askFrom("10.9.1.1")
+	askFrom("10.0.0.1")
+	if got := hits.Load(); got != 5 {
+		t.Errorf("upstream hit %d times, want 5 as bypass answers are not cached", got)
+	}
+}
+
+func TestServeStaleOnErrorBoundedByMaxStale(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+`
+[cache]
+enabled = true
+serve_stale_on_error = true
+max_stale = 300
+`)
+	// Nothing listens on port 1, so the upstream fails at once
+	upstream := config.Upstreams["primary"]
+	upstream.Port = 1
+	config.Upstreams["primary"] = upstream
+	server := newTestServer(t, config, WithClock(clock))
+
+	r := query("stale.test", dns.TypeA)
+	server.currentCache().Set(cacheKey(r, false), answerFor(r, "192.0.2.1", 60), 0)
+
+	// Expired a minute ago: recent enough to serve
+	clock.Advance(2 * time.Minute)
+	if m := ask(server, "stale.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("got %v, want the recent stale answer", m)
+	}
+
+	// Expired longer than max_stale ago: too old to serve
+	clock.Advance(5 * time.Minute)
+	if m := ask(server, "stale.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL past max_stale", m)
+	}
+}
+
+func TestCacheOverrideEvictsBeforeRecordTTL(t *testing.T) {
+	setTestRecords(t)
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	config := loadTestConfig(t, testConfig+`
+[cache]
+enabled = true
+
+[[cache_override]]
+pattern = "_**.cdn.test"
+cache_ttl = 5
+
+[[cache_override]]
+pattern = "img.cdn.test"
+cache_ttl = 20
+`)
+	hits := map[string]int{}
+	var mu sync.Mutex
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		hits[r.Question[0].Name]++
+		mu.Unlock()
+		w.WriteMsg(answerFor(r, "192.0.2.1", 300))
+	})
+	server := newTestServer(t, config, WithClock(clock))
+
+	names := []string{"a.cdn.test.", "img.cdn.test.", "other.test."}
+	askAll := func() {
+		for _, name := range names {
+			if m := ask(server, name, dns.TypeA); m == nil || len(m.Answer) != 1 {
+				t.Fatalf("%s: got %v, want an answer", name, m)
+			}
+		}
+	}
+	expect := func(when string, want ...int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		for i, name := range names {
+			if hits[name] != want[i] {
+				t.Errorf("%s: %s queried upstream %d times, want %d", when, name, hits[name], want[i])
+			}
+		}
+	}
+
+	askAll()
+	clock.Advance(4 * time.Second)
+	askAll()
+	expect("within 5s", 1, 1, 1)
+
+	// The pattern's override expires long before the 300s record TTL
+	clock.Advance(time.Second)
+	askAll()
+	expect("after 5s", 2, 1, 1)
+
+	// The more specific override for img.cdn.test wins over the pattern
+	clock.Advance(15 * time.Second)
+	askAll()
+	expect("after 20s", 3, 2, 1)
+}
+
+func TestSetFailureKeepsStaleAnswer(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	cache := NewResponseCache(10, clock)
+	cache.SetMaxStale(5 * time.Minute)
+
+	r := query("stale.test", dns.TypeA)
+	cache.Set("key", answerFor(r, "192.0.2.1", 60), 0)
+
+	failure := new(dns.Msg)
+	failure.SetRcode(r, dns.RcodeServerFailure)
+
+	// Expired but still servable stale: the SERVFAIL must not replace it
+	clock.Advance(2 * time.Minute)
+	cache.SetFailure("key", failure, 10*time.Second)
+	stale, ok := cache.GetStale("key", 5*time.Minute)
+	if !ok || stale.Rcode != dns.RcodeSuccess || len(stale.Answer) != 1 {
+		t.Fatalf("stale answer was replaced by the failure: %v", stale)
+	}
+
+	// Past the stale window the failure is cached
+	clock.Advance(10 * time.Minute)
+	cache.SetFailure("key", failure, 10*time.Second)
+	cached, ok := cache.Get("key")
+	if !ok || cached.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("failure was not cached once the answer was too stale: %v", cached)
+	}
+}
+
+func TestServFailCachingKeepsServingStale(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	config := loadTestConfig(t, testConfig+`
+[cache]
+enabled = true
+servfail_ttl = 30
+serve_stale_on_error = true
+max_stale = 600
+`)
+	// Nothing listens on port 1, so the upstream fails at once
+	upstream := config.Upstreams["primary"]
+	upstream.Port = 1
+	config.Upstreams["primary"] = upstream
+
+	server := newTestServer(t, config, WithClock(clock))
+
+	r := query("stale.test", dns.TypeA)
+	server.currentCache().Set(cacheKey(r, false), answerFor(r, "192.0.2.1", 60), 0)
+	clock.Advance(2 * time.Minute)
+
+	for i := 0; i < 2; i++ {
+		response, err := server.forwardRequest(query("stale.test", dns.TypeA), &requestContext{transport: TransportUDP})
+		if err != nil || response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+			t.Fatalf("query %d: got %v, %v; want the stale answer", i+1, response, err)
+		}
+	}
+}
+
+func TestCacheStatsLogLine(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[cache]\nenabled = true\nstats_interval = 1\n")
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	server := newTestServer(t, config)
+	server.missed = newMissedNames(2)
+
+	// Three misses for two tracked names, one for a name beyond the limit, one hit
+	for _, name := range []string{"a.test", "b.test", "c.test"} {
+		ask(server, name, dns.TypeA)
+	}
+	server.currentCache().Invalidate(func(string) bool { return true })
+	ask(server, "a.test", dns.TypeA)
+	ask(server, "a.test", dns.TypeA)
+
+	logs := captureLog(t)
+	server.logCacheStats(cacheStatsCounters{})
+
+	line := logs.String()
+	for _, field := range []string{"Cache stats:", "hit_ratio=0.200", "hits=1", "misses=4", "size=1", "evictions=0",
+		"top_missed=a.test:2,b.test:1", "untracked_misses=1"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("stats line %q is missing %s", line, field)
+		}
+	}
+
+	// Counting starts afresh after each line
+	logs = captureLog(t)
+	server.logCacheStats(cacheStatsCounters{hits: 1, misses: 4})
+	if line := logs.String(); !strings.Contains(line, "top_missed= untracked_misses=0") {
+		t.Errorf("got %q, want no misses after the previous line", line)
+	}
+}
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
 )
 
 // Config holds the DNS server configuration
 type Config struct {
 	Server    ServerConfig              `toml:"server"`
 	Upstreams map[string]UpstreamConfig `toml:"upstreams"`
+	// Upstream selection by domain pattern, and by query type such as "MX"
+	Routes     map[string]string `toml:"routes"`
+	TypeRoutes map[string]string `toml:"type_routes"`
+	// Upstream retried by domain pattern when the routed upstream answers NXDOMAIN
+	NXDomainRetryRoutes map[string]string `toml:"nxdomain_retry_routes"`
+	// Zones this server acts as a secondary for
+	Secondaries []SecondaryConfig `toml:"secondary"`
+	RateLimit   RateLimitConfig   `toml:"rate_limit"`
+	Admin       AdminConfig       `toml:"admin"`
+	Maintenance MaintenanceConfig `toml:"maintenance"`
+	Cache       CacheConfig       `toml:"cache"`
+	Probe       ProbeConfig       `toml:"probe"`
+	// Scheduled windows serving maintenance answers automatically
+	MaintenanceWindows []MaintenanceWindow `toml:"maintenance_window"`
+	// Zones this server is authoritative for
+	Zones []ZoneConfig `toml:"zones"`
+	// Query names rewritten before matching and forwarding
+	QNameRewrites []QNameRewrite `toml:"qname_rewrite"`
+	// DNS-over-HTTPS listener
+	DoH DoHConfig `toml:"doh"`
+	// Per-transport handling keyed by "udp", "tcp" or "doh"
+	TransportPolicies map[string]TransportPolicy `toml:"transport_policy"`
+	// Domain patterns answered with a fixed rcode
+	Policies []PolicyRule `toml:"policy"`
+	// Answers synthesized when upstreams return NXDOMAIN or NODATA
+	Synthesize []SynthesizeRule `toml:"synthesize"`
+	// PTR answers synthesized for addresses without a local reverse record
+	ReverseSynthesis []ReverseSynthesisRule `toml:"reverse_synthesis"`
+	// Pinning and tracing of queries tagged by debug clients
+	Debug DebugConfig `toml:"debug"`
+	// Domain patterns cached for a fixed time regardless of their TTLs
+	CacheOverrides []CacheOverride `toml:"cache_override"`
 
 	// Added mutex for thread safety
 	mu sync.RWMutex
@@ -27,31 +65,552 @@ type ServerConfig struct {
 	Listen     string `toml:"listen"`
 	Port       int    `toml:"port"`
 	LogQueries bool   `toml:"log_queries"`
+	// Log level: "info" or "trace"
+	LogLevel string `toml:"log_level"`
+	// Fraction of queries logged when log_queries is on, 0 logs all
+	LogSampleRate float64 `toml:"log_sample_rate"`
+	// Include the answer records of logged queries
+	LogAnswers bool `toml:"log_answers"`
+	// Log the upstream chosen for each forwarded query and why
+	LogRouting bool `toml:"log_routing"`
+	// Queries slower than this are always logged, 0 disables
+	SlowQueryMs int `toml:"slow_query_ms"`
 	// Path to the records file
 	RecordsFile string `toml:"records_file"`
+	// Override records files loaded after records_file, later files replacing
+	// the records of earlier ones with the same domain and type
+	RecordsFiles []string `toml:"records_files"`
+	// Fail instead of creating an empty records file when it is missing
+	RecordsRequired bool `toml:"records_required"`
+	// SQLite database answered from instead of the records files, read at startup only
+	RecordsDB string `toml:"records_db"`
+	// Maximum number of seconds randomly subtracted from answer TTLs
+	TTLJitter int `toml:"ttl_jitter"`
+	// Pass upstream SERVFAIL responses to clients instead of failing over
+	PassthroughServFail bool `toml:"passthrough_servfail"`
+	// Reject upstream responses with a mismatched question or out-of-bailiwick answers and try the next upstream
+	ValidateResponses bool `toml:"validate_responses"`
+	// Sort the records of each upstream RRset by their data so identical queries get identical answers
+	StableAnswerOrder bool `toml:"stable_answer_order"`
+	// Seconds after startup during which forwarded queries wait for upstreams
+	StartupGrace int `toml:"startup_grace"`
+	// Behavior during startup grace: "wait" or "servfail"
+	StartupGraceMode string `toml:"startup_grace_mode"`
+	// Load the records file in the background once the server has started
+	AsyncRecordsLoad bool `toml:"async_records_load"`
+	// Handling of queries arriving before records load: "wait", "servfail" or "forward"
+	RecordsGate string `toml:"records_gate"`
+	// Seconds the records gate holds or fails queries at most
+	RecordsGateTimeout int `toml:"records_gate_timeout"`
+	// Handling of a failed records reload: "keep-serving" or "degrade" readiness until a good reload
+	ReloadFailurePolicy string `toml:"reload_failure_policy"`
+	// While degraded, answer SERVFAIL for names with local records
+	DegradedServFail bool `toml:"degraded_servfail"`
+	// Maximum number of RRs emitted for a single local RRset, 0 for no limit
+	MaxRRsetSize int `toml:"max_rrset_size"`
+	// Maximum number of answer RRs passed on from an upstream response, 0 for no limit
+	// Larger answers are cut at an RRset boundary, marked truncated and not cached
+	MaxUpstreamAnswers int `toml:"max_upstream_answers"`
+	// Domain patterns that may be resolved, empty allows all
+	ResolvableDomains []string `toml:"resolvable_domains"`
+	// Handling of records sharing a domain and type: "warn", "error" or "merge"
+	DuplicatePolicy string `toml:"duplicate_policy"`
+	// Handling of names with a CNAME and records of other types: "warn" or "error"
+	CNAMEConflictPolicy string `toml:"cname_conflict_policy"`
+	// Upstream retried when an upstream answers NXDOMAIN, unless an nxdomain_retry_routes pattern matches
+	OnNXDomainRetryUpstream string `toml:"on_nxdomain_retry_upstream"`
+	// Largest DNS message accepted over TCP, in bytes
+	MaxMessageSize int `toml:"max_message_size"`
+	// Seconds to wait for a TCP client to send a query
+	TCPReadTimeout int `toml:"tcp_read_timeout"`
+	// Queries answered on one TCP connection before it is closed
+	// Reloaded TCP limits apply to connections opened afterwards
+	TCPMaxQueriesPerConn int `toml:"tcp_max_queries_per_conn"`
+	// Seconds an idle TCP connection is kept open between queries
+	TCPIdleTimeout int `toml:"tcp_idle_timeout"`
+	// Seconds to wait for in-flight queries on shutdown before closing listeners anyway
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+	// Answer NODATA for AAAA queries on names with only a local A record,
+	// as owned zones do, instead of forwarding them upstream
+	LocalNoDataForMissingAAAA bool `toml:"local_nodata_for_missing_aaaa"`
+	// Order of query processing stages, empty uses the default order
+	Pipeline []string `toml:"pipeline"`
+	// For IPv4-only hosts: listen on IPv4 only and answer forwarded AAAA queries with NODATA
+	DisableIPv6 bool `toml:"disable_ipv6"`
+	// Handling of the client's CD (checking disabled) bit: "forward" or "clear"
+	CDBit string `toml:"cd_bit"`
+	// Handling of DO queries answered from unsigned local data: "serve" or "indicate"
+	DOUnsigned string `toml:"do_unsigned"`
+	// Handling of query names breaking DNS label rules: "formerr" or "forward"
+	InvalidQName string `toml:"invalid_qname"`
+	// Handling of queries without RD set: "recurse", "refuse" or "referral"
+	IterativeQueries string `toml:"iterative_queries"`
+	// Handling of ANY queries over UDP: "allow", "minimal", "tc" or "refuse"
+	AnyOverUDP string `toml:"any_over_udp"`
+	// Longest chain of local CNAMEs followed, longer chains and loops get SERVFAIL
+	MaxCNAMEDepth int `toml:"max_cname_depth"`
+	// Range record TTLs must lie in, records outside it are rejected, and rows
+	// of a records_db are not served
+	MinRecordTTL int `toml:"min_record_ttl"`
+	MaxRecordTTL int `toml:"max_record_ttl"`
+	// Clients whose queries skip the cache and always go upstream, e.g.
+	// monitoring probes (CIDR or IP)
+	CacheBypassClients []string `toml:"cache_bypass_clients"`
+
+	// Parsed cache bypass networks
+	cacheBypassNets []*net.IPNet
 }
 
 // UpstreamConfig contains configuration for an upstream DNS server
 type UpstreamConfig struct {
 	Address  string `toml:"address"`
 	Port     int    `toml:"port"`
-	Protocol string `toml:"protocol"` // "udp" or "tcp"
+	Protocol string `toml:"protocol"` // "udp", "tcp" or "tcp-tls", empty for udp
+	// Retry over TCP when a UDP response cannot be unpacked
+	RetryMalformedTCP bool `toml:"retry_malformed_tcp"`
+	// Pass truncated UDP responses on to clients instead of retrying over TCP
+	KeepTruncated bool `toml:"keep_truncated"`
+	// Protocols tried in order when the primary protocol fails or is truncated,
+	// as "protocol" or "protocol:port", e.g. ["tcp", "tcp-tls:853"]
+	FallbackProtocols []string `toml:"fallback_protocols"`
+	// Strip the OPT record from queries for upstreams that reject EDNS
+	DisableEDNS bool `toml:"disable_edns"`
+	// Override the EDNS UDP buffer size advertised to this upstream
+	EDNSUDPSize uint16 `toml:"edns_udp_size"`
+	// Client certificate presented to tcp-tls upstreams requiring mutual TLS
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	// CA certificate used to verify the upstream instead of the system roots
+	CACert string `toml:"ca_cert"`
+	// Queries per second sent to this upstream at most, 0 for no limit
+	RateLimit float64 `toml:"rate_limit"`
+	// Milliseconds a query waits for the rate limit before failing over, 0 sheds it at once
+	RateLimitWait int `toml:"rate_limit_wait"`
+	// Groups this upstream belongs to, routes can target a tag as "tag:<name>"
+	Tags []string `toml:"tags"`
+	// Log queries sent to this upstream with their response and latency,
+	// regardless of the global log_queries setting
+	LogQueries bool `toml:"log_queries"`
+}
+
+// validUpstreamProtocol reports whether an upstream protocol is supported
+// An empty protocol queries the upstream over UDP
+func validUpstreamProtocol(protocol string) bool {
+	switch protocol {
+	case "", "udp", "tcp", "tcp-tls":
+		return true
+	}
+	return false
+}
+
+// ParseFallbackProtocol parses a "protocol" or "protocol:port" fallback entry
+func ParseFallbackProtocol(value string, defaultPort int) (string, int, error) {
+	protocol, portValue, hasPort := strings.Cut(value, ":")
+
+	switch protocol {
+	case "udp", "tcp", "tcp-tls":
+	default:
+		return "", 0, fmt.Errorf("invalid fallback protocol %q", value)
+	}
+
+	if !hasPort {
+		return protocol, defaultPort, nil
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid fallback port in %q", value)
+	}
+
+	return protocol, port, nil
+}
+
+// CacheConfig contains settings for caching upstream responses
+type CacheConfig struct {
+	Enabled    bool `toml:"enabled"`
+	MaxEntries int  `toml:"max_entries"`
+	// Key cached answers by the query's EDNS Client Subnet
+	RespectECS bool `toml:"respect_ecs"`
+	// Seconds to cache a SERVFAIL when every upstream fails, 0 disables it
+	// Only takes effect with the cache enabled, and never replaces an answer that may be served stale
+	ServFailTTL int `toml:"servfail_ttl"`
+	// File the cache is saved to periodically and restored from on startup
+	PersistPath string `toml:"persist_path"`
+	// Seconds between cache snapshots
+	PersistInterval int `toml:"persist_interval"`
+	// Seconds answers stay cached at minimum, even with shorter TTLs
+	MinCacheTTL int `toml:"min_cache_ttl"`
+	// Raise TTLs sent to clients to min_cache_ttl instead of counting the real TTL down
+	FloorClientTTL bool `toml:"floor_client_ttl"`
+	// Names resolved for A and AAAA at startup so their first queries are cached
+	Warmup []string `toml:"warmup"`
+	// Minutes between cache statistics log lines, 0 disables them
+	StatsInterval int `toml:"stats_interval"`
+	// Serve the cached answer when forwarding a query fails, if it expired at most max_stale seconds ago
+	ServeStaleOnError bool `toml:"serve_stale_on_error"`
+	MaxStale          int  `toml:"max_stale"`
+}
+
+// CacheOverride sets how long answers for matching names are cached
+type CacheOverride struct {
+	Pattern string `toml:"pattern"`
+	// Seconds matching answers stay cached, 0 keeps them out of the cache
+	CacheTTL int `toml:"cache_ttl"`
+}
+
+// QNameRewrite maps a query name to the name used for matching and forwarding
+type QNameRewrite struct {
+	Match   string `toml:"match"`
+	Replace string `toml:"replace"`
+	// Only apply the rule to queries over this transport, empty applies it to all
+	Transport string `toml:"transport"`
+}
+
+// PolicyRule answers queries for a domain pattern with a fixed rcode
+type PolicyRule struct {
+	Pattern string `toml:"pattern"`
+	Rcode   string `toml:"rcode"`
+}
+
+// SynthesizeRule is a default answer for names matching a pattern that
+// upstreams report as nonexistent or without data
+type SynthesizeRule struct {
+	Pattern string `toml:"pattern"`
+	Type    string `toml:"type"`
+	Value   string `toml:"value"`
+	TTL     int    `toml:"ttl"`
+}
+
+// ReverseSynthesisRule answers PTR queries for addresses in a network that
+// match no local record with a name built from a template, e.g.
+// "host-{ip}.example.com", or NXDOMAIN when the template is empty
+type ReverseSynthesisRule struct {
+	Network  string `toml:"network"`
+	Template string `toml:"template"`
+	TTL      int    `toml:"ttl"`
+
+	// Parsed network
+	network *net.IPNet
+}
+
+// DebugConfig identifies debug queries by an EDNS0 local option
+type DebugConfig struct {
+	// EDNS0 local option code (65001-65534) and value marking debug queries, 0 disables
+	OptionCode  uint16 `toml:"edns_option_code"`
+	OptionValue string `toml:"edns_option_value"`
+	// Upstream debug queries are pinned to
+	Upstream string `toml:"upstream"`
+}
+
+// DoHConfig contains settings for serving DNS over HTTPS
+type DoHConfig struct {
+	// Address to listen on, empty disables DoH
+	Listen string `toml:"listen"`
+	Path   string `toml:"path"`
+	// Without a certificate DoH is served over plain HTTP, e.g. behind a proxy
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// Seconds HTTP caches may keep error responses such as SERVFAIL, 0 forbids caching them
+	ErrorMaxAge int `toml:"error_max_age"`
+	// Pad responses to padded queries to a multiple of this many bytes, 0 disables
+	PaddingBlockSize int `toml:"padding_block_size"`
+}
+
+// TransportPolicy changes how queries arriving over a transport are answered
+type TransportPolicy struct {
+	// Remove EDNS Client Subnet options before forwarding
+	StripECS bool `toml:"strip_ecs"`
+	// Forward to this upstream instead of the routed one
+	Upstream string `toml:"upstream"`
+}
+
+// ProbeConfig contains built-in names answered for monitoring and debugging
+type ProbeConfig struct {
+	// Name answered with the server's address, empty disables it
+	Name string `toml:"name"`
+	// Address returned for Name instead of the address the query arrived on
+	Address string `toml:"address"`
+	// Name answered with the configured listen address, following reloads
+	ListenName string `toml:"listen_name"`
+	// Name answered with the client's IP address as TXT, empty disables it
+	ClientIPName string `toml:"client_ip_name"`
+	// Name answered with live counters as TXT records
+	StatsName string `toml:"stats_name"`
+	TTL       int    `toml:"ttl"`
+}
+
+// defaultStatsName is the diagnostic stats name, in a private zone
+const defaultStatsName = "stats.dns-er.internal"
+
+// ZoneConfig contains settings for a zone this server is authoritative for
+type ZoneConfig struct {
+	Name string    `toml:"name"`
+	SOA  SOAConfig `toml:"soa"`
+}
+
+// SOAConfig contains the SOA fields of an owned zone
+// Unset fields are filled with defaults
+type SOAConfig struct {
+	MName   string `toml:"mname"`
+	RName   string `toml:"rname"`
+	Serial  uint32 `toml:"serial"`
+	Refresh uint32 `toml:"refresh"`
+	Retry   uint32 `toml:"retry"`
+	Expire  uint32 `toml:"expire"`
+	Minimum uint32 `toml:"minimum"`
+	TTL     uint32 `toml:"ttl"`
+	// Increment the serial when records in the zone change: "counter" or "date"
+	AutoSerial string `toml:"auto_serial"`
+}
+
+// AdminConfig contains settings for the admin HTTP API
+type AdminConfig struct {
+	// Address for the admin API, empty disables it
+	Listen string `toml:"listen"`
+	// Bearer token required by endpoints that change server state
+	Token string `toml:"token"`
+}
+
+// MaintenanceConfig contains records that override normal answers in maintenance mode
+type MaintenanceConfig struct {
+	// Whether maintenance mode is on at startup
+	Enabled bool          `toml:"enabled"`
+	Records []RecordEntry `toml:"records"`
+}
+
+// MaintenanceWindow serves its records while the current time lies in a fixed
+// start/end range or a recurring daily from/to window
+type MaintenanceWindow struct {
+	// Fixed window as RFC3339 times
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+	// Recurring window as "HH:MM" times, crossing midnight when from is after to
+	From string `toml:"from"`
+	To   string `toml:"to"`
+	// Weekdays the recurring window starts on, e.g. ["sat", "sun"], empty for every day
+	Days []string `toml:"days"`
+	// IANA time zone of the recurring window, UTC when empty
+	TimeZone string        `toml:"timezone"`
+	Records  []RecordEntry `toml:"records"`
+
+	// Parsed schedule
+	start    time.Time
+	end      time.Time
+	from     int
+	to       int
+	weekdays map[time.Weekday]bool
+	location *time.Location
+}
+
+// RateLimitConfig contains per-client query rate limiting settings
+type RateLimitConfig struct {
+	// Queries per second allowed for each client, 0 disables rate limiting
+	QueriesPerSecond float64 `toml:"queries_per_second"`
+	Burst            int     `toml:"burst"`
+	// Response for over-limit clients: "refuse", "drop", "truncate" or "servfail"
+	// "truncate" refuses queries that did not arrive over UDP
+	Response string `toml:"response"`
+	// Queries each client may have in flight at once, 0 for no limit
+	MaxInFlight int `toml:"max_in_flight"`
+}
+
+// SecondaryConfig contains configuration for a zone transferred from a primary
+type SecondaryConfig struct {
+	Zone string `toml:"zone"`
+	// Primary servers allowed to send NOTIFY, as "ip" or "ip:port"
+	Primaries []string `toml:"primaries"`
 }
 
 // RecordsConfig contains all DNS record entries
 type RecordsConfig struct {
+	// Domain appended to bare CNAME, NS, PTR and MX targets
+	Origin string `toml:"origin,omitempty"`
+	// Other records files to merge, relative to this file, globs allowed
+	Include []string      `toml:"include,omitempty"`
 	Records []RecordEntry `toml:"records"`
 
+	// Absolute paths of all files the records were loaded from
+	files []string
+
 	// Added mutex for thread safety
 	mu sync.RWMutex
 }
 
+// RecordFiles returns the absolute paths of the loaded records files
+func RecordFiles() []string {
+	Records.mu.RLock()
+	defer Records.mu.RUnlock()
+	return append([]string(nil), Records.files...)
+}
+
 // RecordEntry represents a single DNS record entry
 type RecordEntry struct {
-	Domain string `toml:"domain"`
-	Type   string `toml:"type"`
-	Value  string `toml:"value"`
-	TTL    int    `toml:"ttl"`
+	Domain string `toml:"domain" json:"domain"`
+	Type   string `toml:"type" json:"type"`
+	Value  string `toml:"value" json:"value"`
+	TTL    int    `toml:"ttl" json:"ttl"`
+	// Additional values served in the same RRset
+	Values []string `toml:"values,omitempty" json:"values,omitempty"`
+	// Always emit the configured TTL, exempt from jitter and the
+	// min_record_ttl and max_record_ttl range
+	FixedTTL bool `toml:"fixed_ttl,omitempty" json:"fixed_ttl,omitempty"`
+	// Client networks allowed or denied to resolve this record (CIDR or IP)
+	AllowClients []string `toml:"allow_clients,omitempty" json:"allow_clients,omitempty"`
+	DenyClients  []string `toml:"deny_clients,omitempty" json:"deny_clients,omitempty"`
+	// RFC3339 times the record becomes active and expires
+	NotBefore string `toml:"not_before,omitempty" json:"not_before,omitempty"`
+	NotAfter  string `toml:"not_after,omitempty" json:"not_after,omitempty"`
+	// Answer any name at or below the domain that no other record matches
+	CatchAll bool `toml:"catch_all,omitempty" json:"catch_all,omitempty"`
+	// Answer NODATA for the type instead of a value, so the query is never forwarded
+	NoData bool `toml:"nodata,omitempty" json:"nodata,omitempty"`
+	// Operator note logged whenever the record is served, and sent to debug clients
+	Note string `toml:"note,omitempty" json:"note,omitempty"`
+	// Answers for clients querying over a specific transport, keyed by transport
+	Transport map[string]TransportOverride `toml:"transport,omitempty" json:"transport,omitempty"`
+
+	// Parsed client networks
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	// Parsed validity window, zero when unbounded
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// TransportOverride replaces the value or TTL of a record for one transport
+type TransportOverride struct {
+	Value string `toml:"value,omitempty" json:"value,omitempty"`
+	TTL   int    `toml:"ttl,omitempty" json:"ttl,omitempty"`
+}
+
+// ForTransport returns the record as served over a transport, with that
+// transport's override applied
+func (r *RecordEntry) ForTransport(transport string) *RecordEntry {
+	override, ok := r.Transport[transport]
+	if !ok {
+		return r
+	}
+
+	record := *r
+	if override.Value != "" {
+		record.Value = override.Value
+		record.Values = nil
+	}
+	if override.TTL != 0 {
+		record.TTL = override.TTL
+	}
+	return &record
+}
+
+// AllValues returns the record's value followed by its additional values
+func (r *RecordEntry) AllValues() []string {
+	return append([]string{r.Value}, r.Values...)
+}
+
+// Matches reports whether the record's domain pattern matches a domain
+// Catch-all records match the domain itself and every name below it
+func (r *RecordEntry) Matches(domain string) bool {
+	if !r.CatchAll {
+		return MatchDomain(r.Domain, domain)
+	}
+
+	zone := normalizeName(r.Domain)
+	domain = normalizeName(domain)
+	return domain == zone || strings.HasSuffix(domain, "."+zone)
+}
+
+// parseValidity parses the record's not_before and not_after times
+func (r *RecordEntry) parseValidity() error {
+	var err error
+	if r.NotBefore != "" {
+		if r.notBefore, err = time.Parse(time.RFC3339, r.NotBefore); err != nil {
+			return fmt.Errorf("invalid not_before for %s %s: %w", r.Domain, r.Type, err)
+		}
+	}
+	if r.NotAfter != "" {
+		if r.notAfter, err = time.Parse(time.RFC3339, r.NotAfter); err != nil {
+			return fmt.Errorf("invalid not_after for %s %s: %w", r.Domain, r.Type, err)
+		}
+	}
+	return nil
+}
+
+// ActiveAt reports whether the record is within its validity window at the given time
+func (r *RecordEntry) ActiveAt(now time.Time) bool {
+	if !r.notBefore.IsZero() && now.Before(r.notBefore) {
+		return false
+	}
+	if !r.notAfter.IsZero() && !now.Before(r.notAfter) {
+		return false
+	}
+	return true
+}
+
+// parseClientNets parses the record's allow and deny client lists
+func (r *RecordEntry) parseClientNets() error {
+	var err error
+	if r.allowNets, err = parseNetworks(r.AllowClients); err != nil {
+		return fmt.Errorf("invalid allow_clients for %s %s: %w", r.Domain, r.Type, err)
+	}
+	if r.denyNets, err = parseNetworks(r.DenyClients); err != nil {
+		return fmt.Errorf("invalid deny_clients for %s %s: %w", r.Domain, r.Type, err)
+	}
+	return nil
+}
+
+// AllowsClient reports whether the client may resolve this record
+func (r *RecordEntry) AllowsClient(clientIP net.IP) bool {
+	if clientIP != nil && containsIP(r.denyNets, clientIP) {
+		return false
+	}
+
+	if len(r.allowNets) > 0 {
+		return clientIP != nil && containsIP(r.allowNets, clientIP)
+	}
+
+	return true
+}
+
+// parseNetworks parses a list of CIDRs or bare IP addresses
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+
+			// Treat a bare address as a single host network
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP reports whether any of the networks contains the IP
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // Global records configuration
@@ -81,47 +640,472 @@ func LoadConfig(filePath string) (*Config, error) {
 		config.Server.RecordsFile = "configs/records.toml"
 	}
 
+	if config.Server.LogLevel == "" {
+		config.Server.LogLevel = LogLevelInfo
+	}
+
+	if config.Server.MaxMessageSize == 0 {
+		config.Server.MaxMessageSize = dns.MaxMsgSize
+	}
+
+	if config.Server.TCPReadTimeout == 0 {
+		config.Server.TCPReadTimeout = defaultTCPReadTimeout
+	}
+
+	if config.Server.TCPMaxQueriesPerConn == 0 {
+		config.Server.TCPMaxQueriesPerConn = defaultTCPMaxQueriesPerConn
+	}
+
+	if config.Server.TCPIdleTimeout == 0 {
+		config.Server.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+
+	if config.Server.ShutdownTimeout == 0 {
+		config.Server.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if config.Server.CDBit == "" {
+		config.Server.CDBit = CDBitForward
+	}
+
+	if config.Server.DOUnsigned == "" {
+		config.Server.DOUnsigned = DOUnsignedServe
+	}
+
+	if config.Server.DuplicatePolicy == "" {
+		config.Server.DuplicatePolicy = DuplicateWarn
+	}
+
+	if config.Server.CNAMEConflictPolicy == "" {
+		config.Server.CNAMEConflictPolicy = CNAMEConflictWarn
+	}
+
+	if config.Server.StartupGraceMode == "" {
+		config.Server.StartupGraceMode = StartupGraceWait
+	}
+
+	if config.Server.IterativeQueries == "" {
+		config.Server.IterativeQueries = IterativeRecurse
+	}
+
+	if config.Server.AnyOverUDP == "" {
+		config.Server.AnyOverUDP = AnyOverUDPAllow
+	}
+
+	if config.Server.InvalidQName == "" {
+		config.Server.InvalidQName = InvalidQNameFormErr
+	}
+
+	if config.Server.MaxCNAMEDepth == 0 {
+		config.Server.MaxCNAMEDepth = defaultMaxCNAMEDepth
+	}
+
+	if config.Server.MaxRecordTTL == 0 {
+		config.Server.MaxRecordTTL = maxRFC2181TTL
+	}
+
+	if config.Server.RecordsGate == "" {
+		config.Server.RecordsGate = RecordsGateWait
+	}
+
+	if config.Server.ReloadFailurePolicy == "" {
+		config.Server.ReloadFailurePolicy = ReloadFailureKeepServing
+	}
+
+	if config.Server.RecordsGateTimeout == 0 {
+		config.Server.RecordsGateTimeout = defaultRecordsGateTimeout
+	}
+
+	if config.Probe.StatsName == "" {
+		config.Probe.StatsName = defaultStatsName
+	}
+
+	if config.DoH.Path == "" {
+		config.DoH.Path = defaultDoHPath
+	}
+
+	if config.Cache.MaxEntries == 0 {
+		config.Cache.MaxEntries = defaultCacheEntries
+	}
+
+	if config.Cache.PersistInterval == 0 {
+		config.Cache.PersistInterval = defaultCachePersistInterval
+	}
+
+	// Set rate limit defaults if rate limiting is enabled
+	if config.RateLimit.QueriesPerSecond > 0 && config.RateLimit.Burst == 0 {
+		config.RateLimit.Burst = int(math.Ceil(config.RateLimit.QueriesPerSecond))
+	}
+
+	if config.RateLimit.Response == "" {
+		config.RateLimit.Response = RateLimitRefuse
+	}
+
 	// Validate config
 	if len(config.Upstreams) == 0 {
 		return nil, fmt.Errorf("no upstream DNS servers configured")
 	}
 
-	// Try to load records
-	if err := LoadRecords(config.Server.RecordsFile); err != nil {
-		log.Printf("Warning: Failed to load records file: %v", err)
-		// Not returning error to allow server to start without records
+	for pattern, name := range config.Routes {
+		if !validRouteTarget(config.Upstreams, name) {
+			return nil, fmt.Errorf("route %s refers to unknown upstream %s", pattern, name)
+		}
+	}
+
+	for pattern, name := range config.NXDomainRetryRoutes {
+		if _, ok := config.Upstreams[name]; !ok {
+			return nil, fmt.Errorf("nxdomain retry route %s refers to unknown upstream %s", pattern, name)
+		}
+	}
+
+	if name := config.Server.OnNXDomainRetryUpstream; name != "" {
+		if _, ok := config.Upstreams[name]; !ok {
+			return nil, fmt.Errorf("on_nxdomain_retry_upstream refers to unknown upstream %s", name)
+		}
 	}
 
-	// Start watching for config file changes
-	go WatchConfigFile(filePath)
+	for recordType, name := range config.TypeRoutes {
+		if _, ok := dns.StringToType[recordType]; !ok {
+			return nil, fmt.Errorf("type route refers to unknown record type %s", recordType)
+		}
+		if !validRouteTarget(config.Upstreams, name) {
+			return nil, fmt.Errorf("type route %s refers to unknown upstream %s", recordType, name)
+		}
+	}
 
-	// Start watching for records file changes
-	go WatchRecordsFile(config.Server.RecordsFile)
+	if err := validateRewriteRules(config.QNameRewrites); err != nil {
+		return nil, err
+	}
+
+	for transport, policy := range config.TransportPolicies {
+		if !validTransport(transport) {
+			return nil, fmt.Errorf("transport policy refers to unknown transport %s", transport)
+		}
+		if _, ok := config.Upstreams[policy.Upstream]; policy.Upstream != "" && !ok {
+			return nil, fmt.Errorf("transport policy %s refers to unknown upstream %s", transport, policy.Upstream)
+		}
+	}
+
+	if config.Cache.MaxStale < 0 {
+		return nil, fmt.Errorf("cache max_stale must not be negative")
+	}
+
+	if config.Cache.StatsInterval < 0 {
+		return nil, fmt.Errorf("invalid cache stats_interval: %d", config.Cache.StatsInterval)
+	}
+
+	if config.Cache.PersistInterval < 0 {
+		return nil, fmt.Errorf("cache persist_interval must be positive")
+	}
+
+	if config.DoH.ErrorMaxAge < 0 {
+		return nil, fmt.Errorf("doh error_max_age must not be negative")
+	}
+
+	if config.DoH.PaddingBlockSize < 0 || config.DoH.PaddingBlockSize > maxPaddingBlockSize {
+		return nil, fmt.Errorf("doh padding_block_size must be between 0 and %d", maxPaddingBlockSize)
+	}
+
+	if config.Cache.MinCacheTTL < 0 {
+		return nil, fmt.Errorf("cache min_cache_ttl must not be negative")
+	}
+
+	if config.Server.TTLJitter < 0 {
+		return nil, fmt.Errorf("ttl_jitter must not be negative")
+	}
+
+	if config.Server.MaxUpstreamAnswers < 0 {
+		return nil, fmt.Errorf("max_upstream_answers must not be negative")
+	}
+
+	bypassNets, err := parseNetworks(config.Server.CacheBypassClients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache_bypass_clients: %w", err)
+	}
+	config.Server.cacheBypassNets = bypassNets
+
+	if err := validatePipeline(config.Server.Pipeline); err != nil {
+		return nil, err
+	}
+
+	if err := validatePolicies(config.Policies); err != nil {
+		return nil, err
+	}
+
+	if err := validateCacheOverrides(config.CacheOverrides); err != nil {
+		return nil, err
+	}
+
+	if err := validateSynthesizeRules(config.Synthesize); err != nil {
+		return nil, err
+	}
+
+	if err := validateReverseSynthesis(config.ReverseSynthesis); err != nil {
+		return nil, err
+	}
+
+	for i := range config.MaintenanceWindows {
+		if err := config.MaintenanceWindows[i].parseSchedule(); err != nil {
+			return nil, fmt.Errorf("invalid maintenance_window: %w", err)
+		}
+	}
+
+	for _, zone := range config.Zones {
+		switch zone.SOA.AutoSerial {
+		case "", AutoSerialCounter, AutoSerialDate:
+		default:
+			return nil, fmt.Errorf("zone %s has invalid auto_serial %q", zone.Name, zone.SOA.AutoSerial)
+		}
+	}
+
+	if code := config.Debug.OptionCode; code != 0 && (code < dns.EDNS0LOCALSTART || code > dns.EDNS0LOCALEND) {
+		return nil, fmt.Errorf("debug edns_option_code must be between %d and %d", dns.EDNS0LOCALSTART, dns.EDNS0LOCALEND)
+	}
+
+	if _, ok := config.Upstreams[config.Debug.Upstream]; config.Debug.Upstream != "" && !ok {
+		return nil, fmt.Errorf("debug upstream %s is not configured", config.Debug.Upstream)
+	}
+
+	if (config.DoH.CertFile == "") != (config.DoH.KeyFile == "") {
+		return nil, fmt.Errorf("doh requires both cert_file and key_file")
+	}
+
+	for name, upstream := range config.Upstreams {
+		if !validUpstreamProtocol(upstream.Protocol) {
+			return nil, fmt.Errorf("upstream %s: invalid protocol %q, must be udp, tcp or tcp-tls", name, upstream.Protocol)
+		}
+
+		for _, fallback := range upstream.FallbackProtocols {
+			if _, _, err := ParseFallbackProtocol(fallback, upstream.Port); err != nil {
+				return nil, fmt.Errorf("upstream %s: %w", name, err)
+			}
+		}
+
+		if (upstream.ClientCert == "") != (upstream.ClientKey == "") {
+			return nil, fmt.Errorf("upstream %s: client_cert and client_key must be set together", name)
+		}
+
+		if _, err := upstreamTLSConfig(upstream); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+
+		if upstream.RateLimit < 0 || upstream.RateLimitWait < 0 {
+			return nil, fmt.Errorf("upstream %s: rate_limit and rate_limit_wait must not be negative", name)
+		}
+
+		if upstream.EDNSUDPSize != 0 && upstream.EDNSUDPSize < dns.MinMsgSize {
+			return nil, fmt.Errorf("upstream %s: edns_udp_size must be at least %d", name, dns.MinMsgSize)
+		}
+	}
+
+	// NOTIFY sources are matched against primaries by address, so hostnames would never match
+	for _, secondary := range config.Secondaries {
+		for _, primary := range secondary.Primaries {
+			host, _, err := net.SplitHostPort(primaryAddress(primary))
+			if err != nil || net.ParseIP(host) == nil {
+				return nil, fmt.Errorf("secondary %s: primary %q must be an IP address, optionally with a port", secondary.Zone, primary)
+			}
+		}
+	}
+
+	switch config.Server.LogLevel {
+	case LogLevelInfo, LogLevelTrace:
+	default:
+		return nil, fmt.Errorf("invalid log level: %s", config.Server.LogLevel)
+	}
+
+	switch config.Server.StartupGraceMode {
+	case StartupGraceWait, StartupGraceServFail:
+	default:
+		return nil, fmt.Errorf("invalid startup grace mode: %s", config.Server.StartupGraceMode)
+	}
+
+	switch config.Server.RecordsGate {
+	case RecordsGateWait, RecordsGateServFail, RecordsGateForward:
+	default:
+		return nil, fmt.Errorf("invalid records gate: %s", config.Server.RecordsGate)
+	}
+
+	switch config.Server.ReloadFailurePolicy {
+	case ReloadFailureKeepServing, ReloadFailureDegrade:
+	default:
+		return nil, fmt.Errorf("invalid reload failure policy: %s", config.Server.ReloadFailurePolicy)
+	}
+
+	switch config.Server.IterativeQueries {
+	case IterativeRecurse, IterativeRefuse, IterativeReferral:
+	default:
+		return nil, fmt.Errorf("invalid iterative_queries handling: %s", config.Server.IterativeQueries)
+	}
+
+	switch config.Server.AnyOverUDP {
+	case AnyOverUDPAllow, AnyOverUDPMinimal, AnyOverUDPTC, AnyOverUDPRefuse:
+	default:
+		return nil, fmt.Errorf("invalid any_over_udp handling: %s", config.Server.AnyOverUDP)
+	}
+
+	switch config.Server.InvalidQName {
+	case InvalidQNameFormErr, InvalidQNameForward:
+	default:
+		return nil, fmt.Errorf("invalid invalid_qname handling: %s", config.Server.InvalidQName)
+	}
+
+	if config.Server.TCPMaxQueriesPerConn < 0 || config.Server.TCPIdleTimeout < 0 {
+		return nil, fmt.Errorf("tcp_max_queries_per_conn and tcp_idle_timeout must not be negative")
+	}
+
+	if config.Server.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown_timeout must not be negative")
+	}
+
+	if config.Server.MaxCNAMEDepth < 0 {
+		return nil, fmt.Errorf("max_cname_depth must not be negative")
+	}
+
+	if config.Server.MinRecordTTL < 0 || config.Server.MaxRecordTTL > maxRFC2181TTL || config.Server.MinRecordTTL > config.Server.MaxRecordTTL {
+		return nil, fmt.Errorf("record ttl range must be within 0 to %d", maxRFC2181TTL)
+	}
+
+	if config.Server.AsyncRecordsLoad && config.Server.RecordsRequired {
+		return nil, fmt.Errorf("records_required cannot be combined with async_records_load")
+	}
+
+	if ip := net.ParseIP(config.Server.Listen); config.Server.DisableIPv6 && ip != nil && ip.To4() == nil {
+		return nil, fmt.Errorf("listen address %s is IPv6 but disable_ipv6 is set", config.Server.Listen)
+	}
+
+	if config.Server.MaxMessageSize < dns.MinMsgSize || config.Server.MaxMessageSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("max_message_size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	switch config.Server.CDBit {
+	case CDBitForward, CDBitClear:
+	default:
+		return nil, fmt.Errorf("invalid cd_bit handling: %s", config.Server.CDBit)
+	}
+
+	switch config.Server.DOUnsigned {
+	case DOUnsignedServe, DOUnsignedIndicate:
+	default:
+		return nil, fmt.Errorf("invalid do_unsigned handling: %s", config.Server.DOUnsigned)
+	}
+
+	switch config.Server.DuplicatePolicy {
+	case DuplicateWarn, DuplicateError, DuplicateMerge:
+	default:
+		return nil, fmt.Errorf("invalid duplicate policy: %s", config.Server.DuplicatePolicy)
+	}
+
+	switch config.Server.CNAMEConflictPolicy {
+	case CNAMEConflictWarn, CNAMEConflictError:
+	default:
+		return nil, fmt.Errorf("invalid cname conflict policy: %s", config.Server.CNAMEConflictPolicy)
+	}
+
+	switch config.RateLimit.Response {
+	case RateLimitRefuse, RateLimitDrop, RateLimitTruncate, RateLimitServFail:
+	default:
+		return nil, fmt.Errorf("invalid rate limit response: %s", config.RateLimit.Response)
+	}
+
+	if config.RateLimit.MaxInFlight < 0 {
+		return nil, fmt.Errorf("rate limit max_in_flight must not be negative")
+	}
 
 	return config, nil
 }
 
-// LoadRecords loads DNS records from a TOML file
-func LoadRecords(filePath string) error {
+// LoadStartupRecords loads the records before the server starts, unless the
+// server loads them once started or answers from a records database
+// Only a required records file that fails to load is an error
+func LoadStartupRecords(config ServerConfig) error {
+	if config.AsyncRecordsLoad || config.RecordsDB != "" {
+		return nil
+	}
+
+	if _, err := LoadRecords(config); err != nil {
+		if config.RecordsRequired {
+			return fmt.Errorf("failed to load required records file: %w", err)
+		}
+		log.Printf("Warning: Failed to load records file: %v", err)
+		// Not returning error to allow server to start without records
+	}
+
+	return nil
+}
+
+// LoadRecords loads DNS records from the configured records file and
+// returns the records that were added, changed or removed
+// A missing file is created empty unless the records file is required
+func LoadRecords(config ServerConfig) ([]RecordEntry, error) {
+	filePath := config.RecordsFile
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		if config.RecordsRequired {
+			return nil, fmt.Errorf("records file %s does not exist", filePath)
+		}
+
 		// Create an empty records file if it doesn't exist
 		if err := SaveRecords(filePath, &RecordsConfig{}); err != nil {
-			return fmt.Errorf("failed to create records file: %w", err)
+			return nil, fmt.Errorf("failed to create records file: %w", err)
 		}
 	}
 
-	newRecords := &RecordsConfig{}
-	if _, err := toml.DecodeFile(filePath, newRecords); err != nil {
-		return fmt.Errorf("failed to load records: %w", err)
+	// Load the file and everything it includes
+	loader := newRecordsLoader()
+	records, err := loader.load(filePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load records: %w", err)
+	}
+
+	records, err = applyDuplicatePolicy(records, config.DuplicatePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load records: %w", err)
+	}
+
+	// Layer the override files in order
+	for _, overridePath := range config.RecordsFiles {
+		if _, err := os.Stat(overridePath); os.IsNotExist(err) {
+			log.Printf("Warning: records override file %s does not exist, skipping it", overridePath)
+			continue
+		}
+
+		overrides, err := loader.load(overridePath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load records: %w", err)
+		}
+		overrides, err = applyDuplicatePolicy(overrides, config.DuplicatePolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load records: %w", err)
+		}
+		records = overrideRecords(records, overrides)
+	}
+
+	if err := checkCNAMEConflicts(records, config.CNAMEConflictPolicy); err != nil {
+		return nil, fmt.Errorf("failed to load records: %w", err)
+	}
+
+	minTTL, maxTTL := recordTTLRange(config)
+	for i := range records {
+		if err := ValidateRecordTTL(&records[i], minTTL, maxTTL); err != nil {
+			return nil, fmt.Errorf("failed to load records: %w", err)
+		}
+	}
+
+	// Warn about suspicious targets and sizes without rejecting the file
+	warnings := append(ValidateRecordTargets(records), ValidateRecordSizes(records)...)
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
 	}
 
 	// Update records with lock to ensure thread safety
 	Records.mu.Lock()
-	Records.Records = newRecords.Records
+	changed := changedRecords(Records.Records, records)
+	Records.Records = records
+	Records.files = loader.files
 	Records.mu.Unlock()
 
-	log.Printf("Loaded %d records from %s", len(newRecords.Records), filePath)
-	return nil
+	log.Printf("Loaded %d records from %d files starting at %s", len(records), len(loader.files), filePath)
+	return changed, nil
 }
 
 // SaveConfig saves the current configuration to a TOML file
@@ -140,6 +1124,55 @@ func SaveConfig(config *Config, filePath string) error {
 	return nil
 }
 
+// secretConfigKeys lists the config keys whose values are redacted when printed
+var secretConfigKeys = [][]string{
+	{"admin", "token"},
+}
+
+// redactedValue replaces secrets in printed configuration
+const redactedValue = "[redacted]"
+
+// WriteEffectiveConfig writes the configuration, with defaults applied and
+// secrets redacted, as TOML
+func WriteEffectiveConfig(w io.Writer, config *Config) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	// Round-trip through a generic map so secrets can be replaced by key
+	values := map[string]interface{}{}
+	if _, err := toml.Decode(buf.String(), &values); err != nil {
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	for _, path := range secretConfigKeys {
+		redactKey(values, path)
+	}
+
+	if err := toml.NewEncoder(w).Encode(values); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	return nil
+}
+
+// redactKey replaces a non-empty value at the given key path
+func redactKey(values map[string]interface{}, path []string) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		values = next
+	}
+
+	key := path[len(path)-1]
+	if value, ok := values[key].(string); ok && value != "" {
+		values[key] = redactedValue
+	}
+}
+
 // SaveRecords saves the current records to a TOML file
 func SaveRecords(filePath string, records *RecordsConfig) error {
 	f, err := os.Create(filePath)
@@ -157,7 +1190,9 @@ func SaveRecords(filePath string, records *RecordsConfig) error {
 }
 
 // WatchConfigFile watches for changes to the config file and reloads it
-func WatchConfigFile(filePath string) {
+// Each successfully loaded configuration is passed to onReload and load errors
+// to onError, until stop is closed
+func WatchConfigFile(filePath string, onReload func(*Config), onError func(error), stop <-chan struct{}) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Printf("Error setting up config file watcher: %v", err)
@@ -175,8 +1210,14 @@ func WatchConfigFile(filePath string) {
 	filename := filepath.Base(filePath)
 	log.Printf("Watching for changes to config file: %s", filePath)
 
+	// Set while the config file is gone and the last good configuration is served
+	missing := false
+
 	for {
 		select {
+		case <-stop:
+			return
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
@@ -187,18 +1228,36 @@ func WatchConfigFile(filePath string) {
 				continue
 			}
 
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// Editors save by replacing the file, only warn if it stays gone
+				time.Sleep(100 * time.Millisecond)
+				if _, err := os.Stat(filePath); err != nil && !missing {
+					missing = true
+					log.Printf("WARNING: config file %s was removed, serving the last good configuration until it is restored", filePath)
+				}
+				continue
+			}
+
 			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
 				// Wait a short time to ensure the file is fully written
 				time.Sleep(100 * time.Millisecond)
 
 				log.Printf("Config file changed: %s", filePath)
 
-				_, err := LoadConfig(filePath)
+				config, err := LoadConfig(filePath)
 				if err != nil {
-					log.Printf("Error reloading config: %v", err)
+					log.Printf("WARNING: error reloading config, serving the last good configuration: %v", err)
+					onError(err)
 					continue
 				}
 
+				if missing {
+					missing = false
+					log.Printf("Config file %s was restored", filePath)
+				}
+
+				onReload(config)
+
 				log.Printf("Config reloaded successfully")
 			}
 
@@ -211,8 +1270,12 @@ func WatchConfigFile(filePath string) {
 	}
 }
 
-// WatchRecordsFile watches for changes to the records file and reloads it
-func WatchRecordsFile(filePath string) {
+// WatchRecordsFile watches for changes to the records file, and any files it
+// includes, and reloads them, passing the changed records to onChange and
+// reload errors to onError, until stop is closed
+func WatchRecordsFile(config ServerConfig, onChange func([]RecordEntry), onError func(error), stop <-chan struct{}) {
+	filePath := config.RecordsFile
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Printf("Error setting up records file watcher: %v", err)
@@ -220,25 +1283,26 @@ func WatchRecordsFile(filePath string) {
 	}
 	defer watcher.Close()
 
-	// Add the directory containing the records file to the watcher
-	dir := filepath.Dir(filePath)
-	if err := watcher.Add(dir); err != nil {
-		log.Printf("Error watching records directory: %v", err)
-		return
-	}
-
-	filename := filepath.Base(filePath)
+	// Add the directories containing the records files to the watcher,
+	// override files are watched even while they don't exist
+	roots := append([]string{filePath}, config.RecordsFiles...)
+	watched := map[string]bool{}
+	files := watchRecordDirs(watcher, watched, roots)
 	log.Printf("Watching for changes to records file: %s", filePath)
 
 	for {
 		select {
+		case <-stop:
+			return
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
 
-			// Only process the records file we're interested in
-			if filepath.Base(event.Name) != filename {
+			// Only process the records files we're interested in
+			absPath, err := filepath.Abs(event.Name)
+			if err != nil || !files[absPath] {
 				continue
 			}
 
@@ -246,12 +1310,18 @@ func WatchRecordsFile(filePath string) {
 				// Wait a short time to ensure the file is fully written
 				time.Sleep(100 * time.Millisecond)
 
-				log.Printf("Records file changed: %s", filePath)
+				log.Printf("Records file changed: %s", event.Name)
 
-				if err := LoadRecords(filePath); err != nil {
+				changed, err := LoadRecords(config)
+				if err != nil {
 					log.Printf("Error reloading records: %v", err)
+					onError(err)
 					continue
 				}
+				onChange(changed)
+
+				// Includes may have changed, so watch any new files
+				files = watchRecordDirs(watcher, watched, roots)
 
 				log.Printf("Records reloaded successfully")
 			}
@@ -265,29 +1335,60 @@ func WatchRecordsFile(filePath string) {
 	}
 }
 
+// watchRecordDirs adds the directories of all loaded records files and the
+// configured root files to the watcher and returns the set of files to react to
+func watchRecordDirs(watcher *fsnotify.Watcher, watched map[string]bool, roots []string) map[string]bool {
+	files := map[string]bool{}
+
+	paths := RecordFiles()
+	for _, root := range roots {
+		if absPath, err := filepath.Abs(root); err == nil {
+			paths = append(paths, absPath)
+		}
+	}
+
+	for _, path := range paths {
+		files[path] = true
+
+		dir := filepath.Dir(path)
+		if watched[dir] {
+			continue
+		}
+
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Error watching records directory %s: %v", dir, err)
+			continue
+		}
+		watched[dir] = true
+	}
+
+	return files
+}
+
 // MatchDomain checks if a domain matches a pattern, supporting wildcards
 // The _** pattern represents unlimited levels of subdomains
 func MatchDomain(pattern, domain string) bool {
-	// Remove trailing dots
-	pattern = strings.TrimSuffix(pattern, ".")
-	domain = strings.TrimSuffix(domain, ".")
-
-	// Case insensitive comparison
-	pattern = strings.ToLower(pattern)
-	domain = strings.ToLower(domain)
+	// Case insensitive comparison without trailing dots
+	pattern = normalizeName(pattern)
+	domain = normalizeName(domain)
 
 	// Exact match check
 	if pattern == domain {
 		return true
 	}
 
-	// Handle unlimited subdomain wildcard (_**)
+	// Handle unlimited subdomain wildcard (_**). As with RFC 4592 wildcards,
+	// it matches names below its owner but never the owner (apex) itself,
+	// which is only matched by an explicit record
 	if strings.Contains(pattern, "_**") {
 		parts := strings.SplitN(pattern, "_**", 2)
-		base := parts[1]
+		owner := strings.TrimPrefix(parts[1], ".")
+		if owner == "" {
+			return domain != ""
+		}
 
-		// Check if domain ends with the base part
-		return strings.HasSuffix(domain, base)
+		// Check if domain is below the owner, on a label boundary
+		return strings.HasSuffix(domain, "."+owner)
 	}
 
 	// Handle individual wildcards (*)
@@ -305,19 +1406,160 @@ func MatchDomain(pattern, domain string) bool {
 	return false
 }
 
-// FindMatchingRecord looks for a matching record for the given domain and type
-func FindMatchingRecord(domain string, recordType string) *RecordEntry {
+// FindMatchingRecord looks for the most specific record for the given domain and type
+// Records the client is not allowed to resolve, or outside their validity
+// window at now, are treated as non-existent
+func FindMatchingRecord(domain string, recordType string, clientIP net.IP, now time.Time) *RecordEntry {
+	Records.mu.RLock()
+	defer Records.mu.RUnlock()
+
+	domain = normalizeName(domain)
+
+	// Trace every candidate record when trace logging is on
+	if traceEnabled.Load() {
+		traceMatchCandidates(domain, recordType, clientIP, now)
+	}
+
+	// Prefer the most specific matching record, the first one on a tie
+	var best *RecordEntry
+	for i := range Records.Records {
+		record := &Records.Records[i]
+		if !record.Matches(domain) || record.Type != recordType ||
+			!record.ActiveAt(now) || !record.AllowsClient(clientIP) {
+			continue
+		}
+
+		if best == nil || recordSpecificity(record) > recordSpecificity(best) {
+			best = record
+		}
+	}
+
+	// Catch-all records only apply when nothing more specific matched
+	if best != nil && !best.CatchAll {
+		found := *best
+		return &found
+	}
+
+	// Fall back to records transferred from primary servers
+	if secondary := Secondaries.FindRecord(domain, recordType); secondary != nil {
+		return secondary
+	}
+
+	if best != nil {
+		found := *best
+		return &found
+	}
+
+	return nil
+}
+
+// IsHiddenFromClient reports whether the domain has local records active at
+// now but the client is not allowed to resolve any of them
+func IsHiddenFromClient(domain string, clientIP net.IP, now time.Time) bool {
 	Records.mu.RLock()
 	defer Records.mu.RUnlock()
 
-	// Remove trailing dot from domain if present
-	domain = strings.TrimSuffix(domain, ".")
+	domain = normalizeName(domain)
 
+	hidden := false
 	for _, record := range Records.Records {
-		if MatchDomain(record.Domain, domain) && record.Type == recordType {
-			return &record
+		if !record.Matches(domain) || !record.ActiveAt(now) {
+			continue
+		}
+
+		if record.AllowsClient(clientIP) {
+			return false
+		}
+		hidden = true
+	}
+
+	return hidden
+}
+
+// HasRecordsForDomain reports whether any local record of any type active at now matches the domain
+func HasRecordsForDomain(domain string, now time.Time) bool {
+	Records.mu.RLock()
+	defer Records.mu.RUnlock()
+
+	domain = normalizeName(domain)
+
+	for _, record := range Records.Records {
+		if record.Matches(domain) && record.ActiveAt(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindTombstone returns a tombstone active at now covering the domain, if any
+func FindTombstone(domain string, now time.Time) *RecordEntry {
+	Records.mu.RLock()
+	defer Records.mu.RUnlock()
+
+	domain = normalizeName(domain)
+
+	for i := range Records.Records {
+		record := &Records.Records[i]
+		if record.Type == TombstoneType && record.Matches(domain) && record.ActiveAt(now) {
+			found := *record
+			return &found
 		}
 	}
 
 	return nil
 }
+
+// recordSpecificity scores how specific a record is, with catch-all
+// records ranking below every domain pattern
+func recordSpecificity(record *RecordEntry) int {
+	if record.CatchAll {
+		return 0
+	}
+	return matchSpecificity(record.Domain)
+}
+
+// matchSpecificity scores how specific a record's domain pattern is
+// Exact names score above single-label wildcards, which score above _**
+// wildcards; within a tier, patterns with more labels score higher
+func matchSpecificity(pattern string) int {
+	pattern = strings.TrimSuffix(pattern, ".")
+	labels := strings.Count(pattern, ".") + 1
+
+	switch {
+	case strings.Contains(pattern, "_**"):
+		return labels
+	case strings.Contains(pattern, "*"):
+		return 100 + labels
+	default:
+		return 200 + labels
+	}
+}
+
+// traceMatchCandidates logs all records matching a query and the one chosen
+// Must be called with Records.mu held
+func traceMatchCandidates(domain string, recordType string, clientIP net.IP, now time.Time) {
+	candidates := []string{}
+	chosen := "none"
+	chosenScore := -1
+
+	for _, record := range Records.Records {
+		if !record.Matches(domain) || record.Type != recordType {
+			continue
+		}
+
+		score := recordSpecificity(&record)
+		candidate := fmt.Sprintf("%s(score=%d)", record.Domain, score)
+		if !record.ActiveAt(now) {
+			candidate += "(inactive)"
+		} else if !record.AllowsClient(clientIP) {
+			candidate += "(denied)"
+		} else if score > chosenScore {
+			chosen = candidate
+			chosenScore = score
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	tracef("Match candidates for %s %s: [%s], chosen: %s", domain, recordType, strings.Join(candidates, " "), chosen)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigLeavesRecordsFileAlone(t *testing.T) {
+	config := loadTestConfig(t, testConfig)
+
+	var buf bytes.Buffer
+	if err := WriteEffectiveConfig(&buf, config); err != nil {
+		t.Fatalf("WriteEffectiveConfig: %v", err)
+	}
+	if !strings.Contains(buf.String(), "records_file") {
+		t.Errorf("effective config is missing records_file:\n%s", buf.String())
+	}
+
+	if _, err := os.Stat(config.Server.RecordsFile); !os.IsNotExist(err) {
+		t.Errorf("records file %s was created while loading the config", config.Server.RecordsFile)
+	}
+}
+
+func TestWriteEffectiveConfigAppliesDefaultsAndRedactsSecrets(t *testing.T) {
+	config := loadTestConfig(t, testConfig+"\n[admin]\ntoken = \"hunter2\"\n")
+
+	var buf bytes.Buffer
+	if err := WriteEffectiveConfig(&buf, config); err != nil {
+		t.Fatalf("WriteEffectiveConfig: %v", err)
+	}
+	printed := buf.String()
+
+	if !strings.Contains(printed, `response = "refuse"`) {
+		t.Errorf("effective config is missing the default rate limit response:\n%s", printed)
+	}
+	if strings.Contains(printed, "hunter2") || !strings.Contains(printed, `token = "`+redactedValue+`"`) {
+		t.Errorf("admin token was not redacted:\n%s", printed)
+	}
+}
+
+func TestLoadStartupRecordsCreatesMissingFile(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+
+	if err := LoadStartupRecords(config.Server); err != nil {
+		t.Fatalf("LoadStartupRecords: %v", err)
+	}
+	if _, err := os.Stat(config.Server.RecordsFile); err != nil {
+		t.Errorf("records file was not created: %v", err)
+	}
+}
+
+func TestLoadStartupRecordsRequired(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	config.Server.RecordsRequired = true
+	config.Server.RecordsFile = filepath.Join(t.TempDir(), "missing.toml")
+
+	if err := LoadStartupRecords(config.Server); err == nil {
+		t.Error("expected an error for a missing required records file")
+	}
+	if _, err := os.Stat(config.Server.RecordsFile); !os.IsNotExist(err) {
+		t.Error("a missing required records file was created")
+	}
+}
+
+func TestLoadStartupRecordsRequiredEmptyFile(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "old.test", Type: "A", Value: "192.0.2.1"})
+	config := loadTestConfig(t, testConfig)
+	config.Server.RecordsRequired = true
+	config.Server.RecordsFile = writeTestFile(t, t.TempDir(), "empty.toml", "")
+
+	if err := LoadStartupRecords(config.Server); err != nil {
+		t.Fatalf("an existing empty records file was rejected: %v", err)
+	}
+	Records.mu.RLock()
+	records := Records.Records
+	Records.mu.RUnlock()
+	if len(records) != 0 {
+		t.Errorf("got %d records from an empty file, want none", len(records))
+	}
+}
+
+func TestTraceListsMatchCandidates(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "www.example.test", Type: "A", Value: "192.0.2.3"},
+		RecordEntry{Domain: "*.example.test", Type: "A", Value: "192.0.2.2"},
+		RecordEntry{Domain: "_**.example.test", Type: "A", Value: "192.0.2.1"},
+	)
+	SetLogLevel(LogLevelTrace)
+	t.Cleanup(func() { SetLogLevel(LogLevelInfo) })
+	logs := captureLog(t)
+
+	record := FindMatchingRecord("www.example.test", "A", nil, time.Now())
+	if record == nil || record.Value != "192.0.2.3" {
+		t.Fatalf("got %v, want the exact record", record)
+	}
+
+	want := "Match candidates for www.example.test A: [www.example.test(score=203) *.example.test(score=103) _**.example.test(score=3)], chosen: www.example.test(score=203)"
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("trace does not list the candidates and winner:\n%s", logs.String())
+	}
+}
+
+func TestMatchDomainWildcardExcludesApex(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"a.example.com", true},
+		{"b.a.example.com", true},
+		{"example.com", false},
+		{"badexample.com", false},
+		{"com", false},
+	}
+	for _, tt := range tests {
+		if got := MatchDomain("_**.example.com", tt.domain); got != tt.want {
+			t.Errorf("MatchDomain(_**.example.com, %s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	// The apex is answered only by an explicit apex record
+	setTestRecords(t, RecordEntry{Domain: "_**.example.com", Type: "A", Value: "192.0.2.1"})
+	if record := FindMatchingRecord("example.com", "A", nil, time.Now()); record != nil {
+		t.Errorf("wildcard answered the apex with %s", record.Value)
+	}
+	setTestRecords(t,
+		RecordEntry{Domain: "_**.example.com", Type: "A", Value: "192.0.2.1"},
+		RecordEntry{Domain: "example.com", Type: "A", Value: "192.0.2.2"},
+	)
+	if record := FindMatchingRecord("example.com", "A", nil, time.Now()); record == nil || record.Value != "192.0.2.2" {
+		t.Errorf("got %v for the apex, want the explicit apex record", record)
+	}
+}
+
+func TestInvalidUpstreamProtocolRejected(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "config.toml", strings.Replace(testConfig, `protocol = "udp"`, `protocol = "quic"`, 1))
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), `upstream primary: invalid protocol "quic"`) {
+		t.Errorf("got %v, want the invalid protocol rejected", err)
+	}
+}
+
+func TestConfigWatcherSurvivesDeletion(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "config.toml", serverTestConfig("max_rrset_size = 3"))
+	logs := captureLog(t)
+
+	reloaded := make(chan *Config, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchConfigFile(path, func(config *Config) { reloaded <- config }, func(error) {}, stop)
+	if !waitFor(t, 2*time.Second, func() bool { return strings.Contains(logs.String(), "Watching for changes to config file") }) {
+		t.Fatal("watcher did not start")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove config: %v", err)
+	}
+	if !waitFor(t, 2*time.Second, func() bool {
+		return strings.Contains(logs.String(), "was removed, serving the last good configuration")
+	}) {
+		t.Fatalf("no warning about the removed config, got %q", logs.String())
+	}
+
+	writeTestFile(t, dir, "config.toml", serverTestConfig("max_rrset_size = 7"))
+	select {
+	case config := <-reloaded:
+		if config.Server.MaxRRsetSize != 7 {
+			t.Errorf("reloaded max_rrset_size = %d, want 7", config.Server.MaxRRsetSize)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("recreated config was not reloaded")
+	}
+	if !waitFor(t, time.Second, func() bool { return strings.Contains(logs.String(), "was restored") }) {
+		t.Errorf("restoring the config was not logged, got %q", logs.String())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// untagDebugQuery reports whether a query carries the configured debug EDNS
+// option, and returns a copy of it without the option so upstreams never see it
+func (s *DNSServer) untagDebugQuery(r *dns.Msg) (*dns.Msg, bool) {
+	config := s.currentConfig().Debug
+	if config.OptionCode == 0 {
+		return r, false
+	}
+
+	opt := r.IsEdns0()
+	if opt == nil {
+		return r, false
+	}
+
+	found := false
+	options := []dns.EDNS0{}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == config.OptionCode && string(local.Data) == config.OptionValue {
+			found = true
+			continue
+		}
+		options = append(options, option)
+	}
+
+	if !found {
+		return r, false
+	}
+
+	untagged := r.Copy()
+	untagged.IsEdns0().Option = options
+	return untagged, true
+}
+
+// attachDebugNote adds a served record's note to a debug client's response
+// as an EDNS0 local option with the debug option code
+func (s *DNSServer) attachDebugNote(m, r *dns.Msg, record *RecordEntry) {
+	if record.Note == "" {
+		return
+	}
+
+	log.Printf("Debug query %s: served record %s %s, note: %s", normalizeName(r.Question[0].Name), record.Domain, record.Type, record.Note)
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		udpSize := uint16(dns.MinMsgSize)
+		if reqOpt := r.IsEdns0(); reqOpt != nil {
+			udpSize = reqOpt.UDPSize()
+		}
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: s.currentConfig().Debug.OptionCode,
+		Data: []byte(record.Note),
+	})
+}
+
+// recordNote formats a record's note for the query log, empty without a note
+func recordNote(record *RecordEntry) string {
+	if record.Note == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (record %s %s, note: %s)", record.Domain, record.Type, record.Note)
+}
+
+// logDebugExchange logs the outcome of a debug query's upstream exchange
+func logDebugExchange(upstreamName, domain string, response *dns.Msg, err error) {
+	if err != nil {
+		log.Printf("Debug query %s: upstream %s failed: %v", domain, upstreamName, err)
+		return
+	}
+
+	log.Printf("Debug query %s: upstream %s answered %s with [%s]",
+		domain, upstreamName, dns.RcodeToString[response.Rcode], formatAnswers(response.Answer))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// debugTestOption is the EDNS0 local option debug tests tag queries with
+const debugTestOption = 65001
+
+// debugQuery builds a query tagged with the debug option value
+func debugQuery(name string, value string) *dns.Msg {
+	r := query(name, dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: debugTestOption, Data: []byte(value)})
+	return r
+}
+
+func TestDebugQueryPinnedAndTraced(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+`
+[debug]
+edns_option_code = 65001
+edns_option_value = "dns-er-debug"
+upstream = "secondary"
+
+[upstreams.secondary]
+address = "127.0.0.1"
+port = 53
+`)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	var tagLeaked atomic.Bool
+	startNamedTestUpstream(t, config, "secondary", func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil && len(opt.Option) > 0 {
+			tagLeaked.Store(true)
+		}
+		w.WriteMsg(answerFor(r, "192.0.2.2", 60))
+	})
+	server := newTestServer(t, config)
+	logs := captureLog(t)
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		debug bool
+	}{
+		{"untagged.test", "", "192.0.2.1", false},
+		{"wrongtag.test", "other", "192.0.2.1", false},
+		{"tagged.test", "dns-er-debug", "192.0.2.2", true},
+	}
+	for _, tt := range tests {
+		r := query(tt.name, dns.TypeA)
+		if tt.value != "" {
+			r = debugQuery(tt.name, tt.value)
+		}
+		w := newTestWriter("10.0.0.1", false)
+		server.handleRequest(w, r)
+
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, w.msg, tt.want)
+		}
+		traced := strings.Contains(logs.String(), "Debug query "+tt.name+": upstream secondary answered NOERROR")
+		if traced != tt.debug {
+			t.Errorf("%s: traced = %t, want %t in %q", tt.name, traced, tt.debug, logs.String())
+		}
+	}
+
+	if tagLeaked.Load() {
+		t.Error("the debug option was forwarded to the pinned upstream")
+	}
+}
+
+func TestDebugQueryCarriesRecordNote(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "noted.test", Type: "A", Value: "192.0.2.1", TTL: 60, Note: "pinned for the migration"})
+	server := newTestServer(t, loadTestConfig(t, testConfig+`
+[debug]
+edns_option_code = 65001
+edns_option_value = "dns-er-debug"
+`))
+
+	w := newTestWriter("10.0.0.1", false)
+	server.handleRequest(w, debugQuery("noted.test", "dns-er-debug"))
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("got %v, want the local answer", w.msg)
+	}
+
+	opt := w.msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("debug response has no OPT record")
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == debugTestOption && string(local.Data) == "pinned for the migration" {
+			return
+		}
+	}
+	t.Errorf("debug response does not carry the record note: %v", opt.Option)
+}
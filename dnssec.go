@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Handling of DO (DNSSEC OK) queries answered from unsigned local data
+// With "serve" the answer is sent as is; with "indicate" it carries an
+// Extended DNS Error telling the client no signatures are available
+const (
+	DOUnsignedServe    = "serve"
+	DOUnsignedIndicate = "indicate"
+)
+
+// unsignedExtraText explains the Extended DNS Error attached to unsigned local answers
+const unsignedExtraText = "answered from unsigned local data"
+
+// unsignedWriter marks responses built from local data, which are never signed
+type unsignedWriter struct {
+	dns.ResponseWriter
+	request  *dns.Msg
+	indicate bool
+}
+
+// localAnswerWriter wraps the writer of a stage answering from local data
+// Answers to DO queries never claim to be authenticated, and are marked
+// unsigned when do_unsigned is "indicate"
+func (s *DNSServer) localAnswerWriter(w dns.ResponseWriter, r *dns.Msg) dns.ResponseWriter {
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() {
+		return w
+	}
+
+	return &unsignedWriter{
+		ResponseWriter: w,
+		request:        r,
+		indicate:       s.currentConfig().Server.DOUnsigned == DOUnsignedIndicate,
+	}
+}
+
+// WriteMsg clears the AD bit and adds the unsigned indication before writing
+func (w *unsignedWriter) WriteMsg(m *dns.Msg) error {
+	m.AuthenticatedData = false
+
+	if w.indicate {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(w.request.IsEdns0().UDPSize(), true)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: unsignedExtraText,
+		})
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
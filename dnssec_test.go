@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// doQuery builds a query with the DO bit set
+func doQuery(name string, qtype uint16) *dns.Msg {
+	r := query(name, qtype)
+	r.SetEdns0(dns.DefaultMsgSize, true)
+	return r
+}
+
+// unsignedIndication returns the Extended DNS Error marking an unsigned local answer, nil if absent
+func unsignedIndication(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok && ede.ExtraText == unsignedExtraText {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestDOQueryForUnsignedLocalRecord(t *testing.T) {
+	for _, policy := range []string{DOUnsignedServe, DOUnsignedIndicate} {
+		t.Run(policy, func(t *testing.T) {
+			setTestRecords(t, RecordEntry{Domain: "local.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+			server := newTestServer(t, loadTestConfig(t, serverTestConfig(`do_unsigned = "`+policy+`"`)))
+
+			r := doQuery("local.test", dns.TypeA)
+			r.AuthenticatedData = true
+			w := newTestWriter("10.0.0.1", false)
+			server.handleRequest(w, r)
+			if w.msg == nil || len(w.msg.Answer) != 1 {
+				t.Fatalf("got %v, want the local answer", w.msg)
+			}
+			if w.msg.AuthenticatedData {
+				t.Error("unsigned local answer claims to be authenticated")
+			}
+			if indicated := unsignedIndication(w.msg) != nil; indicated != (policy == DOUnsignedIndicate) {
+				t.Errorf("unsigned indication present = %t, want %t", indicated, policy == DOUnsignedIndicate)
+			}
+
+			// Queries without DO are never marked
+			w = newTestWriter("10.0.0.1", false)
+			server.handleRequest(w, query("local.test", dns.TypeA))
+			if w.msg == nil || unsignedIndication(w.msg) != nil {
+				t.Errorf("got %v, want a plain answer without DO", w.msg)
+			}
+		})
+	}
+}
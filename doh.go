@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultDoHPath is the URL path DoH queries are served on
+	defaultDoHPath = "/dns-query"
+
+	// dohContentType is the media type of DoH requests and responses
+	dohContentType = "application/dns-message"
+
+	// maxDoHMessageSize bounds the size of a DoH request body
+	maxDoHMessageSize = dns.MaxMsgSize
+)
+
+// startDoH starts the DNS-over-HTTPS listener if a DoH listen address is configured
+func (s *DNSServer) startDoH() {
+	config := s.currentConfig().DoH
+	if config.Listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, s.handleDoH)
+
+	s.doh = &http.Server{
+		Addr:    config.Listen,
+		Handler: mux,
+	}
+
+	go func() {
+		log.Printf("Starting DoH server on %s%s", config.Listen, config.Path)
+
+		var err error
+		if config.CertFile != "" {
+			err = s.doh.ListenAndServeTLS(config.CertFile, config.KeyFile)
+		} else {
+			err = s.doh.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("DoH server error: %v", err)
+		}
+	}()
+}
+
+// stopDoH stops the DNS-over-HTTPS listener
+func (s *DNSServer) stopDoH() error {
+	if s.doh == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	return s.doh.Shutdown(ctx)
+}
+
+// handleDoH answers a DNS query sent over HTTPS as described in RFC 8484
+func (s *DNSServer) handleDoH(w http.ResponseWriter, r *http.Request) {
+	packed, err := readDoHQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(packed); err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohResponseWriter{
+		local:  localHTTPAddr(r),
+		remote: remoteHTTPAddr(r),
+	}
+	s.handleRequest(writer, query)
+
+	// Queries dropped by the handler, e.g. by rate limiting, get no answer
+	if writer.msg == nil {
+		http.Error(w, "no response", http.StatusServiceUnavailable)
+		return
+	}
+
+	padResponse(writer.msg, query, s.currentConfig().DoH.PaddingBlockSize)
+
+	response, err := writer.msg.Pack()
+	if err != nil {
+		log.Printf("Error packing DoH response: %v", err)
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", s.dohCacheControl(writer.msg))
+	w.Write(response)
+}
+
+// dohCacheControl returns the Cache-Control header for a DoH response
+// Answers may be cached for their lowest TTL and negative answers for their
+// SOA minimum, as RFC 8484 requires, and errors such as SERVFAIL for error_max_age
+func (s *DNSServer) dohCacheControl(m *dns.Msg) string {
+	if ttl, ok := cacheTTL(m); ok {
+		return fmt.Sprintf("max-age=%d", ttl)
+	}
+
+	isError := m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError
+	if maxAge := s.currentConfig().DoH.ErrorMaxAge; isError && maxAge > 0 {
+		return fmt.Sprintf("max-age=%d", maxAge)
+	}
+	return "no-store"
+}
+
+// readDoHQuery returns the wire format query from a GET or POST DoH request
+func readDoHQuery(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodGet:
+		encoded := r.URL.Query().Get("dns")
+		if encoded == "" {
+			return nil, fmt.Errorf("missing dns parameter")
+		}
+		packed, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode dns parameter: %w", err)
+		}
+		return packed, nil
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			return nil, fmt.Errorf("unsupported content type")
+		}
+		packed, err := io.ReadAll(io.LimitReader(r.Body, maxDoHMessageSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		return packed, nil
+	default:
+		return nil, fmt.Errorf("method not allowed")
+	}
+}
+
+// remoteHTTPAddr returns the client address of an HTTP request
+func remoteHTTPAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// localHTTPAddr returns the local address an HTTP request was received on
+func localHTTPAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// dohResponseWriter captures the response to a DoH query
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg stores the response to be sent in the HTTP reply
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write stores a packed response to be sent in the HTTP reply
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dohExchange posts a query to the server's DoH handler and returns the
+// recorded HTTP response along with the unpacked DNS response, if any
+func dohExchange(t *testing.T, server *DNSServer, r *dns.Msg) (*httptest.ResponseRecorder, *dns.Msg) {
+	t.Helper()
+
+	packed, err := r.Pack()
+	if err != nil {
+		t.Fatalf("failed to pack query: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, defaultDoHPath, bytes.NewReader(packed))
+	req.Header.Set("Content-Type", dohContentType)
+	req.RemoteAddr = "10.0.0.1:40000"
+	server.handleDoH(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return rec, nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatalf("failed to unpack DoH response: %v", err)
+	}
+	return rec, m
+}
+
+func TestTransportPolicyUpstream(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[transport_policy.doh]\nupstream = \"secure\"\n\n[upstreams.secure]\naddress = \"127.0.0.1\"\nport = 53\n")
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	startNamedTestUpstream(t, config, "secure", func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.2", 60))
+	})
+	server := newTestServer(t, config)
+
+	if m := ask(server, "remote.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("UDP got %v, want the primary's answer", m)
+	}
+	if _, m := dohExchange(t, server, query("remote.test", dns.TypeA)); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.2" {
+		t.Errorf("DoH got %v, want the secure upstream's answer", m)
+	}
+}
+
+func TestDoHCacheControl(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[doh]\nerror_max_age = 5\n")
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "answer.test.":
+			m := answerFor(r, "192.0.2.1", 300)
+			m.Answer = append(m.Answer, answerFor(r, "192.0.2.2", 120).Answer...)
+			w.WriteMsg(m)
+		case "missing.test.":
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:     "ns.test.",
+				Mbox:   "hostmaster.test.",
+				Minttl: 90,
+			})
+			w.WriteMsg(m)
+		default:
+			servFail(w, r)
+		}
+	})
+	server := newTestServer(t, config)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"answer.test", "max-age=120"},
+		{"missing.test", "max-age=90"},
+		{"failing.test", "max-age=5"},
+	}
+	for _, tt := range tests {
+		rec, m := dohExchange(t, server, query(tt.name, dns.TypeA))
+		if m == nil {
+			t.Errorf("%s: got HTTP status %d, want a DNS response", tt.name, rec.Code)
+			continue
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: got Cache-Control %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without error_max_age errors are not cached
+	config = loadTestConfig(t, testConfig)
+	startTestUpstream(t, config, servFail)
+	rec, _ := dohExchange(t, newTestServer(t, config), query("failing.test", dns.TypeA))
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q for SERVFAIL, want no-store", got)
+	}
+}
+
+// paddedQuery builds a query carrying the EDNS0 Padding option
+func paddedQuery(name string) *dns.Msg {
+	r := query(name, dns.TypeA)
+	r.SetEdns0(dns.DefaultMsgSize, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 8)})
+	return r
+}
+
+func TestDoHResponsePadding(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "a.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "a-much-longer-name.padding.test", Type: "A", Values: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig+"\n[doh]\npadding_block_size = 128\n"))
+
+	for _, name := range []string{"a.test", "a-much-longer-name.padding.test"} {
+		rec, m := dohExchange(t, server, paddedQuery(name))
+		if m == nil || len(m.Answer) == 0 {
+			t.Fatalf("%s: got %v, want the answer", name, m)
+		}
+		if size := rec.Body.Len(); size%128 != 0 {
+			t.Errorf("%s: padded response is %d bytes, want a multiple of 128", name, size)
+		}
+	}
+
+	// Unpadded queries get unpadded responses
+	rec, m := dohExchange(t, server, query("a.test", dns.TypeA))
+	if m == nil {
+		t.Fatal("got no response to an unpadded query")
+	}
+	if requestsPadding(m) {
+		t.Errorf("unpadded query got a padded %d byte response", rec.Body.Len())
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamTimeout is the read and write timeout for upstream queries
+const upstreamTimeout = 5 * time.Second
+
+// MalformedResponseError reports an upstream response that could not be unpacked
+type MalformedResponseError struct {
+	Upstream string
+	Length   int
+	Err      error
+}
+
+// Error implements the error interface
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed response from upstream %s (%d bytes): %v", e.Upstream, e.Length, e.Err)
+}
+
+// Unwrap returns the underlying unpack error
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
+}
+
+// upstreamTLSConfig builds the TLS client configuration for an upstream
+// Returns nil when the upstream uses no client certificate or custom CA
+func upstreamTLSConfig(upstream UpstreamConfig) (*tls.Config, error) {
+	if upstream.ClientCert == "" && upstream.CACert == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if upstream.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(upstream.ClientCert, upstream.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if upstream.CACert != "" {
+		pem, err := os.ReadFile(upstream.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", upstream.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// newUpstreamClient creates a DNS client for the given protocol
+func newUpstreamClient(protocol string) *dns.Client {
+	return &dns.Client{
+		Net:          protocol,
+		ReadTimeout:  upstreamTimeout,
+		WriteTimeout: upstreamTimeout,
+	}
+}
+
+// exchange sends a request and reads the raw response, so that responses
+// which fail to unpack can be told apart from transport errors
+func exchange(client *dns.Client, r *dns.Msg, upstreamName, upstreamAddr string) (*dns.Msg, error) {
+	conn, err := client.Dial(upstreamAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Size the UDP read buffer from the advertised EDNS0 buffer size
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(client.WriteTimeout))
+	if err := conn.WriteMsg(r); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(client.ReadTimeout))
+	_, isPacketConn := conn.Conn.(net.PacketConn)
+
+	for {
+		raw, err := conn.ReadMsgHeader(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		response := new(dns.Msg)
+		if err := response.Unpack(raw); err != nil {
+			return nil, &MalformedResponseError{Upstream: upstreamName, Length: len(raw), Err: err}
+		}
+
+		if response.Id != r.Id {
+			// Ignore UDP replies to earlier queries that timed out
+			if isPacketConn {
+				continue
+			}
+			return nil, dns.ErrId
+		}
+
+		return response, nil
+	}
+}
+
+// validateResponse sanity checks an upstream response against the query it answers
+// The question must be echoed back, answers must lie on the CNAME chain from
+// the query name, and answer records must be of the queried class and type
+func validateResponse(r, response *dns.Msg) error {
+	q := r.Question[0]
+	if len(response.Question) != 1 {
+		return fmt.Errorf("response has %d questions", len(response.Question))
+	}
+
+	rq := response.Question[0]
+	if !strings.EqualFold(rq.Name, q.Name) || rq.Qtype != q.Qtype || rq.Qclass != q.Qclass {
+		return fmt.Errorf("response question %s %s does not match query %s %s",
+			rq.Name, dns.TypeToString[rq.Qtype], q.Name, dns.TypeToString[q.Qtype])
+	}
+
+	// Names answers may be for: the query name and the targets of CNAMEs and DNAMEs on its chain
+	chain := map[string]bool{normalizeName(q.Name): true}
+	for grew := true; grew; {
+		grew = false
+		for _, rr := range response.Answer {
+			var target string
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				if chain[normalizeName(v.Hdr.Name)] {
+					target = v.Target
+				}
+			case *dns.DNAME:
+				// A DNAME redirects names below its owner, answered with a synthesized CNAME
+				owner := normalizeName(v.Hdr.Name)
+				for name := range chain {
+					if strings.HasSuffix(name, "."+owner) {
+						target = dns.Fqdn(strings.TrimSuffix(name, owner) + v.Target)
+						break
+					}
+				}
+			}
+
+			if target != "" && !chain[normalizeName(target)] {
+				chain[normalizeName(target)] = true
+				grew = true
+			}
+		}
+	}
+
+	for _, rr := range response.Answer {
+		header := rr.Header()
+		name := normalizeName(header.Name)
+
+		inBailiwick := chain[name]
+		if header.Rrtype == dns.TypeDNAME {
+			for chained := range chain {
+				inBailiwick = inBailiwick || strings.HasSuffix(chained, "."+name)
+			}
+		}
+		if !inBailiwick {
+			return fmt.Errorf("answer %s %s is outside the query's bailiwick", header.Name, dns.TypeToString[header.Rrtype])
+		}
+
+		if header.Class != q.Qclass {
+			return fmt.Errorf("answer %s has class %s", header.Name, dns.ClassToString[header.Class])
+		}
+
+		switch header.Rrtype {
+		case q.Qtype, dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+		default:
+			if q.Qtype != dns.TypeANY {
+				return fmt.Errorf("answer %s %s does not match the queried type %s",
+					header.Name, dns.TypeToString[header.Rrtype], dns.TypeToString[q.Qtype])
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// malformedOverUDP answers UDP queries with a response cut short, and TCP
+// queries with a well formed answer
+func malformedOverUDP(w dns.ResponseWriter, r *dns.Msg) {
+	packed, _ := answerFor(r, "198.51.100.1", 60).Pack()
+	if overTCP(w) {
+		w.Write(packed)
+		return
+	}
+	w.Write(packed[:len(packed)-2])
+}
+
+func TestMalformedResponseRetriedOverTCP(t *testing.T) {
+	config := loadTestConfig(t, testConfig)
+	startDualTestUpstream(t, config, "primary", malformedOverUDP)
+	upstream := config.Upstreams["primary"]
+	upstream.RetryMalformedTCP = true
+	config.Upstreams["primary"] = upstream
+	server := newTestServer(t, config)
+
+	response, err := server.exchangeWithUpstream("primary", query("remote.test", dns.TypeA))
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Errorf("got %v, want the answer fetched over TCP", response)
+	}
+}
+
+func TestMalformedResponseReported(t *testing.T) {
+	config := loadTestConfig(t, testConfig)
+	startDualTestUpstream(t, config, "primary", malformedOverUDP)
+	server := newTestServer(t, config)
+
+	_, err := server.exchangeWithUpstream("primary", query("remote.test", dns.TypeA))
+	var malformed *MalformedResponseError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("got error %v, want a MalformedResponseError", err)
+	}
+	if malformed.Upstream != "primary" || malformed.Length == 0 {
+		t.Errorf("got %+v, want the upstream name and response length", malformed)
+	}
+}
+
+func TestFallbackProtocolUsedWhenUDPFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	tcpServer := &dns.Server{Listener: listener, NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+		})}
+	go tcpServer.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { tcpServer.Shutdown() })
+
+	// Nothing answers over UDP on the upstream's own port
+	config := loadTestConfig(t, testConfig)
+	upstream := config.Upstreams["primary"]
+	upstream.Port = freePort(t)
+	upstream.FallbackProtocols = []string{"tcp:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)}
+	config.Upstreams["primary"] = upstream
+	server := newTestServer(t, config)
+
+	response, err := server.exchangeWithUpstream("primary", query("remote.test", dns.TypeA))
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if len(response.Answer) != 1 {
+		t.Errorf("got %v, want the answer over the TCP fallback", response)
+	}
+}
+
+func TestDisableEDNSStripsOPT(t *testing.T) {
+	config := loadTestConfig(t, testConfig+"\n[upstreams.legacy]\naddress = \"127.0.0.1\"\nport = 53\ndisable_edns = true\n")
+	var sawOPT sync.Map
+	for _, name := range []string{"primary", "legacy"} {
+		name := name
+		startNamedTestUpstream(t, config, name, func(w dns.ResponseWriter, r *dns.Msg) {
+			sawOPT.Store(name, r.IsEdns0() != nil)
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		})
+	}
+	server := newTestServer(t, config)
+
+	for _, name := range []string{"primary", "legacy"} {
+		r := query("remote.test", dns.TypeA)
+		r.SetEdns0(dns.DefaultMsgSize, false)
+		if _, err := server.exchangeWithUpstream(name, r); err != nil {
+			t.Fatalf("exchange with %s failed: %v", name, err)
+		}
+		if r.IsEdns0() == nil {
+			t.Fatalf("the client's query lost its OPT record after forwarding to %s", name)
+		}
+	}
+
+	if got, _ := sawOPT.Load("primary"); got != true {
+		t.Error("the normal upstream did not receive the OPT record")
+	}
+	if got, _ := sawOPT.Load("legacy"); got != false {
+		t.Error("the disable_edns upstream received an OPT record")
+	}
+}
+
+// testCert is a generated certificate with its key, written as PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA
+// when parent is nil, and writes it to dir
+func newTestCert(t *testing.T, dir, name string, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	return &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: writeTestFile(t, dir, name+".crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))),
+		keyFile:  writeTestFile(t, dir, name+".key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))),
+	}
+}
+
+// startMTLSTestUpstream serves DNS over TLS requiring client certificates
+// signed by ca, points the primary upstream at it and returns a channel
+// receiving the common name of each verified client
+func startMTLSTestUpstream(t *testing.T, config *Config, ca *testCert) <-chan string {
+	t.Helper()
+
+	dir := t.TempDir()
+	serverCert := newTestCert(t, dir, "server", ca, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	pair, err := tls.LoadX509KeyPair(serverCert.certFile, serverCert.keyFile)
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %v", err)
+	}
+
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+	presented := make(chan string, 10)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			presented <- state.PeerCertificates[0].Subject.CommonName
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		})}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	upstream := config.Upstreams["primary"]
+	upstream.Protocol = "tcp-tls"
+	upstream.Port = listener.Addr().(*net.TCPAddr).Port
+	config.Upstreams["primary"] = upstream
+	return presented
+}
+
+func TestUpstreamMTLSPresentsClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	client := newTestCert(t, dir, "dns-er client", ca, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	config := loadTestConfig(t, testConfig)
+	presented := startMTLSTestUpstream(t, config, ca)
+	upstream := config.Upstreams["primary"]
+	upstream.ClientCert, upstream.ClientKey, upstream.CACert = client.certFile, client.keyFile, ca.certFile
+	config.Upstreams["primary"] = upstream
+	server := newTestServer(t, config)
+
+	response, err := server.exchangeWithUpstream("primary", query("remote.test", dns.TypeA))
+	if err != nil || len(response.Answer) != 1 {
+		t.Fatalf("got %v, %v; want an answer over mutual TLS", response, err)
+	}
+	select {
+	case name := <-presented:
+		if name != "dns-er client" {
+			t.Errorf("upstream saw client certificate %q, want the configured one", name)
+		}
+	default:
+		t.Error("upstream saw no client certificate")
+	}
+}
+
+func TestUpstreamMTLSWithoutClientCertificateFails(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+
+	config := loadTestConfig(t, testConfig)
+	startMTLSTestUpstream(t, config, ca)
+	upstream := config.Upstreams["primary"]
+	upstream.CACert = ca.certFile
+	config.Upstreams["primary"] = upstream
+	server := newTestServer(t, config)
+
+	if response, err := server.exchangeWithUpstream("primary", query("remote.test", dns.TypeA)); err == nil {
+		t.Errorf("got %v, want the handshake rejected without a client certificate", response)
+	}
+}
+
+func TestValidateResponsesRejectsBadAnswers(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(r *dns.Msg) *dns.Msg
+		valid  bool
+	}{
+		{"matching answer", func(r *dns.Msg) *dns.Msg {
+			return answerFor(r, "192.0.2.1", 60)
+		}, true},
+		{"mismatched question", func(r *dns.Msg) *dns.Msg {
+			return answerFor(query("other.test", dns.TypeA), "192.0.2.1", 60)
+		}, false},
+		{"out-of-bailiwick answer", func(r *dns.Msg) *dns.Msg {
+			m := answerFor(r, "192.0.2.1", 60)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "bank.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("203.0.113.66"),
+			})
+			return m
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestRecords(t)
+			config := loadTestConfig(t, serverTestConfig("validate_responses = true"))
+			startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+				m := tt.answer(r)
+				m.Id = r.Id
+				w.WriteMsg(m)
+			})
+			server := newTestServer(t, config)
+
+			_, err := server.exchangeWithUpstream("primary", query("asked.test", dns.TypeA))
+			if tt.valid && err != nil {
+				t.Errorf("valid response rejected: %v", err)
+			}
+			if !tt.valid && (err == nil || !strings.Contains(err.Error(), "rejected response from upstream primary")) {
+				t.Errorf("got error %v, want the response rejected", err)
+			}
+
+			m := ask(server, "asked.test", dns.TypeA)
+			if !tt.valid && (m == nil || m.Rcode != dns.RcodeServerFailure) {
+				t.Errorf("got %v, want SERVFAIL rather than the rejected answer", m)
+			}
+		})
+	}
+}
+
+// truncatedOverUDP answers UDP queries with an empty truncated response, and
+// TCP queries with the full answer
+func truncatedOverUDP(w dns.ResponseWriter, r *dns.Msg) {
+	if overTCP(w) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Truncated = true
+	w.WriteMsg(m)
+}
+
+func TestTruncatedUDPResponseRetriedOverTCP(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		setTestRecords(t)
+		config := loadTestConfig(t, testConfig+"keep_truncated = "+strconv.FormatBool(keep)+"\n")
+		startDualTestUpstream(t, config, "primary", truncatedOverUDP)
+		server := newTestServer(t, config)
+
+		w := newTestWriter("10.0.0.1", true)
+		server.handleRequest(w, query("truncated.test", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("keep_truncated = %t: got %v, want a response", keep, w.msg)
+		}
+		if keep {
+			if !w.msg.Truncated || len(w.msg.Answer) != 0 {
+				t.Errorf("keep_truncated = true: got %v, want the truncated response passed on", w.msg)
+			}
+			continue
+		}
+		if w.msg.Truncated || len(w.msg.Answer) != 1 {
+			t.Errorf("keep_truncated = false: got %v, want the full answer from the TCP retry", w.msg)
+		}
+	}
+}
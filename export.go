@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+// Record export formats
+const (
+	ExportTOML = "toml"
+	ExportJSON = "json"
+	ExportZone = "zone"
+)
+
+// handleRecordsExport serves a snapshot of the loaded records
+// Exports may reveal client restrictions, so they require the admin token
+func (s *DNSServer) handleRecordsExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportTOML
+	}
+
+	var contentType string
+	switch format {
+	case ExportTOML:
+		contentType = "application/toml"
+	case ExportJSON:
+		contentType = "application/json"
+	case ExportZone:
+		contentType = "text/dns"
+	default:
+		http.Error(w, "unsupported format: "+format, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if err := ExportRecords(w, s.records.All(), format); err != nil {
+		log.Printf("Error exporting records: %v", err)
+	}
+}
+
+// ExportRecords writes records in the given format
+func ExportRecords(w io.Writer, records []RecordEntry, format string) error {
+	switch format {
+	case ExportTOML:
+		return toml.NewEncoder(w).Encode(struct {
+			Records []RecordEntry `toml:"records"`
+		}{records})
+	case ExportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case ExportZone:
+		return writeZoneFile(w, records)
+	default:
+		return fmt.Errorf("unsupported export format: %s", format)
+	}
+}
+
+// writeZoneFile writes records as BIND zone file lines
+// Records a zone file cannot express are written as comments
+func writeZoneFile(w io.Writer, records []RecordEntry) error {
+	for i := range records {
+		record := &records[i]
+
+		if record.CatchAll || strings.Contains(record.Domain, "_**") {
+			if _, err := fmt.Fprintf(w, "; skipped %s %s: pattern has no zone file form\n", record.Domain, record.Type); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if record.Type == TombstoneType {
+			if _, err := fmt.Fprintf(w, "; skipped %s %s: tombstone until %s\n", record.Domain, record.Type, record.NotAfter); err != nil {
+				return err
+			}
+			continue
+		}
+
+		m := new(dns.Msg)
+		header := dns.RR_Header{
+			Name:  dns.Fqdn(record.Domain),
+			Class: dns.ClassINET,
+			Ttl:   uint32(record.TTL),
+		}
+		for _, value := range record.AllValues() {
+			addValueToMsg(m, header, record.Domain, record.Type, value)
+		}
+
+		for _, rr := range m.Answer {
+			if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
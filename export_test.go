@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+// exportTestRecords covers plain, multi-value and restricted records
+var exportTestRecords = []RecordEntry{
+	{Domain: "www.example.com", Type: "A", Value: "192.0.2.1", TTL: 300},
+	{Domain: "pool.example.com", Type: "A", Value: "192.0.2.2", TTL: 60, Values: []string{"192.0.2.3"}},
+	{Domain: "alias.example.com", Type: "CNAME", Value: "www.example.com", TTL: 120},
+	{Domain: "office.example.com", Type: "A", Value: "10.0.0.1", TTL: 60, AllowClients: []string{"10.0.0.0/8"}},
+}
+
+// exportRecords exports the test records in the given format
+func exportRecords(t *testing.T, format string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := ExportRecords(&buf, exportTestRecords, format); err != nil {
+		t.Fatalf("failed to export %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportTOMLRoundTrip(t *testing.T) {
+	var decoded struct {
+		Records []RecordEntry `toml:"records"`
+	}
+	if _, err := toml.Decode(string(exportRecords(t, ExportTOML)), &decoded); err != nil {
+		t.Fatalf("failed to decode TOML export: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Records, exportTestRecords) {
+		t.Errorf("got %+v, want %+v", decoded.Records, exportTestRecords)
+	}
+}
+
+func TestExportJSONRoundTrip(t *testing.T) {
+	var decoded []RecordEntry
+	if err := json.Unmarshal(exportRecords(t, ExportJSON), &decoded); err != nil {
+		t.Fatalf("failed to decode JSON export: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, exportTestRecords) {
+		t.Errorf("got %+v, want %+v", decoded, exportTestRecords)
+	}
+}
+
+func TestExportZoneParses(t *testing.T) {
+	exported := exportRecords(t, ExportZone)
+	parser := dns.NewZoneParser(bytes.NewReader(exported), "", "export")
+
+	var got []string
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		got = append(got, rr.String())
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatalf("failed to parse zone export: %v\n%s", err, exported)
+	}
+
+	// Every value becomes one RR with its TTL
+	want := []string{
+		"www.example.com.\t300\tIN\tA\t192.0.2.1",
+		"pool.example.com.\t60\tIN\tA\t192.0.2.2",
+		"pool.example.com.\t60\tIN\tA\t192.0.2.3",
+		"alias.example.com.\t120\tIN\tCNAME\twww.example.com.",
+		"office.example.com.\t60\tIN\tA\t10.0.0.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExportZoneSkipsPatterns(t *testing.T) {
+	var buf bytes.Buffer
+	records := []RecordEntry{{Domain: "_**.example.com", Type: "A", Value: "192.0.2.1", TTL: 60}}
+	if err := ExportRecords(&buf, records, ExportZone); err != nil {
+		t.Fatalf("failed to export zone: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "; skipped _**.example.com A") {
+		t.Errorf("got %q, want the wildcard skipped as a comment", buf.String())
+	}
+}
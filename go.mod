@@ -4,11 +4,12 @@ go 1.21
 
 require (
 	github.com/BurntSushi/toml v1.3.2
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/miekg/dns v1.1.58
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	golang.org/x/mod v0.14.0 // indirect
 	golang.org/x/net v0.20.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
@@ -6,21 +6,55 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	// Define command line flags
 	configPath := flag.String("config", "configs/config.toml", "Path to the configuration file")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration and exit")
 	flag.Parse()
 
-	// Load configuration
+	// Load configuration, records are only read once the server is going to start
 	config, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Print the configuration with defaults applied if requested
+	if *printConfig {
+		if err := WriteEffectiveConfig(os.Stdout, config); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
+
+	if err := LoadStartupRecords(config.Server); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Answer from the records database instead of the records files if configured
+	options := []ServerOption{}
+	if path := config.Server.RecordsDB; path != "" {
+		store, err := NewSQLiteRecordStore(path, realClock{}, config.Server.MinRecordTTL, config.Server.MaxRecordTTL)
+		if err != nil {
+			log.Fatalf("Failed to open records database: %v", err)
+		}
+		defer store.Close()
+		options = append(options, WithRecordStore(store))
+	}
+
 	// Create and start DNS server
-	server := NewDNSServer(config)
+	server, err := NewDNSServer(config, options...)
+	if err != nil {
+		log.Fatalf("Failed to create DNS server: %v", err)
+	}
+
+	// Start watching for config file changes for the life of the process
+	go WatchConfigFile(*configPath, server.Reload, server.ConfigReloadFailed, nil)
+
+	// Start watching for records file changes, restarted when reloads change the records settings
+	server.WatchRecords()
 
 	// Handle OS signals for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -40,7 +74,8 @@ func main() {
 	log.Println("Shutting down DNS server...")
 
 	// Gracefully stop the server
-	if err := server.Stop(); err != nil {
+	timeout := time.Duration(server.currentConfig().Server.ShutdownTimeout) * time.Second
+	if err := server.Stop(timeout); err != nil {
 		log.Printf("Error stopping DNS server: %v", err)
 	}
 
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// weekdayNames maps the day names of maintenance windows to weekdays
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceStatus is the request and response body of the maintenance endpoint
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetMaintenance switches maintenance mode on or off
+func (s *DNSServer) SetMaintenance(enabled bool) {
+	if s.maintenance.Swap(enabled) != enabled {
+		log.Printf("Maintenance mode enabled: %t", enabled)
+	}
+}
+
+// findMaintenanceRecord returns the maintenance override for a domain and type
+// Overrides of maintenance mode win over those of active maintenance windows
+// Returns nil when no override applies
+func (s *DNSServer) findMaintenanceRecord(domain, recordType string) *RecordEntry {
+	config := s.currentConfig()
+
+	if s.maintenance.Load() {
+		if record := matchMaintenanceRecord(config.Maintenance.Records, domain, recordType); record != nil {
+			return record
+		}
+	}
+
+	now := s.clock.Now()
+	for i := range config.MaintenanceWindows {
+		if !config.MaintenanceWindows[i].ActiveAt(now) {
+			continue
+		}
+		if record := matchMaintenanceRecord(config.MaintenanceWindows[i].Records, domain, recordType); record != nil {
+			return record
+		}
+	}
+
+	return nil
+}
+
+// matchMaintenanceRecord returns the first record matching a domain and type
+func matchMaintenanceRecord(records []RecordEntry, domain, recordType string) *RecordEntry {
+	for i := range records {
+		if MatchDomain(records[i].Domain, domain) && records[i].Type == recordType {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// parseSchedule parses and checks the schedule of a maintenance window
+func (mw *MaintenanceWindow) parseSchedule() error {
+	fixed := mw.Start != "" || mw.End != ""
+	recurring := mw.From != "" || mw.To != ""
+	if fixed == recurring {
+		return fmt.Errorf("set either start and end or from and to")
+	}
+
+	if fixed {
+		var err error
+		if mw.start, err = time.Parse(time.RFC3339, mw.Start); err != nil {
+			return fmt.Errorf("invalid start: %w", err)
+		}
+		if mw.end, err = time.Parse(time.RFC3339, mw.End); err != nil {
+			return fmt.Errorf("invalid end: %w", err)
+		}
+		if !mw.start.Before(mw.end) {
+			return fmt.Errorf("start %s is not before end %s", mw.Start, mw.End)
+		}
+		return nil
+	}
+
+	var err error
+	if mw.from, err = parseClockMinutes(mw.From); err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	if mw.to, err = parseClockMinutes(mw.To); err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+
+	mw.weekdays = make(map[time.Weekday]bool)
+	for _, day := range mw.Days {
+		weekday, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+		mw.weekdays[weekday] = true
+	}
+
+	if mw.location, err = time.LoadLocation(mw.TimeZone); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	return nil
+}
+
+// parseClockMinutes parses an "HH:MM" time into minutes after midnight
+func parseClockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ActiveAt reports whether the maintenance window is open at the given time
+func (mw *MaintenanceWindow) ActiveAt(now time.Time) bool {
+	if !mw.start.IsZero() {
+		return !now.Before(mw.start) && now.Before(mw.end)
+	}
+	if mw.location == nil {
+		return false
+	}
+
+	local := now.In(mw.location)
+	minute := local.Hour()*60 + local.Minute()
+	startsOn := func(day time.Weekday) bool {
+		return len(mw.weekdays) == 0 || mw.weekdays[day]
+	}
+
+	if mw.from <= mw.to {
+		return minute >= mw.from && minute < mw.to && startsOn(local.Weekday())
+	}
+
+	// The window crosses midnight: it is open late on its start day and early the next day
+	yesterday := (local.Weekday() + 6) % 7
+	return (minute >= mw.from && startsOn(local.Weekday())) ||
+		(minute < mw.to && startsOn(yesterday))
+}
+
+// handleMaintenance reports or changes maintenance mode
+func (s *DNSServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !s.authorizeAdmin(w, r) {
+			return
+		}
+
+		var status maintenanceStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.SetMaintenance(status.Enabled)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceStatus{Enabled: s.maintenance.Load()})
+}
+
+// authorizeAdmin checks the bearer token of a state-changing admin request
+// Writes an error response and returns false if the request is not authorized
+func (s *DNSServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := s.currentConfig().Admin.Token
+	if token == "" {
+		return true
+	}
+
+	if strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") != token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maintenanceTestConfig overrides a record's answer in maintenance mode
+const maintenanceTestConfig = recordsAdminConfig + `
+[[maintenance.records]]
+domain = "site.test"
+type = "A"
+value = "192.0.2.99"
+ttl = 30
+`
+
+// setMaintenance posts a maintenance mode change and returns the response
+func setMaintenance(server *DNSServer, body, token string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/maintenance", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	server.adminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+// answerValue returns the address of the single A answer to a query, empty if there is none
+func answerValue(server *DNSServer, name string) string {
+	m := ask(server, name, dns.TypeA)
+	if m == nil || len(m.Answer) != 1 {
+		return ""
+	}
+	if a, ok := m.Answer[0].(*dns.A); ok {
+		return a.A.String()
+	}
+	return ""
+}
+
+func TestMaintenanceModeToggle(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "site.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	server := newTestServer(t, loadTestConfig(t, maintenanceTestConfig))
+
+	if got := answerValue(server, "site.test"); got != "192.0.2.1" {
+		t.Fatalf("got %q before maintenance, want the normal 192.0.2.1", got)
+	}
+
+	if rec := setMaintenance(server, `{"enabled": true}`, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with a wrong token, want 401", rec.Code)
+	}
+	if got := answerValue(server, "site.test"); got != "192.0.2.1" {
+		t.Errorf("unauthorized request switched maintenance on, got %q", got)
+	}
+
+	if rec := setMaintenance(server, `{"enabled": true}`, "secret"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"enabled":true`) {
+		t.Fatalf("got %d %q, want maintenance enabled", rec.Code, rec.Body.String())
+	}
+	if got := answerValue(server, "site.test"); got != "192.0.2.99" {
+		t.Errorf("got %q in maintenance, want the override 192.0.2.99", got)
+	}
+
+	setMaintenance(server, `{"enabled": false}`, "secret")
+	if got := answerValue(server, "site.test"); got != "192.0.2.1" {
+		t.Errorf("got %q after maintenance, want the normal 192.0.2.1", got)
+	}
+}
+
+func TestMaintenanceWindowFollowsClock(t *testing.T) {
+	// Tuesday 2023-11-14 22:13:20 UTC
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	setTestRecords(t,
+		RecordEntry{Domain: "shop.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "api.test", Type: "A", Value: "192.0.2.2", TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig+`
+[[maintenance_window]]
+from = "23:00"
+to = "01:00"
+days = ["tue"]
+
+[[maintenance_window.records]]
+domain = "shop.test"
+type = "A"
+value = "192.0.2.99"
+ttl = 30
+
+[[maintenance_window]]
+start = "2023-11-15T12:00:00Z"
+end = "2023-11-15T13:00:00Z"
+
+[[maintenance_window.records]]
+domain = "api.test"
+type = "A"
+value = "192.0.2.98"
+ttl = 30
+`), WithClock(clock))
+
+	steps := []struct {
+		advance time.Duration
+		shop    string
+		api     string
+	}{
+		{0, "192.0.2.1", "192.0.2.2"},
+		// 23:13 Tuesday: inside the recurring window
+		{time.Hour, "192.0.2.99", "192.0.2.2"},
+		// 00:43 Wednesday: still inside, across midnight
+		{90 * time.Minute, "192.0.2.99", "192.0.2.2"},
+		// 01:13 Wednesday: the recurring window has ended
+		{30 * time.Minute, "192.0.2.1", "192.0.2.2"},
+		// 12:13 Wednesday: inside the fixed window only
+		{11 * time.Hour, "192.0.2.1", "192.0.2.98"},
+		// 13:13 Wednesday: after the fixed window
+		{time.Hour, "192.0.2.1", "192.0.2.2"},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		now := clock.Now().UTC().Format(time.RFC3339)
+		if got := answerValue(server, "shop.test"); got != step.shop {
+			t.Errorf("%s: shop.test got %q, want %q", now, got, step.shop)
+		}
+		if got := answerValue(server, "api.test"); got != step.api {
+			t.Errorf("%s: api.test got %q, want %q", now, got, step.api)
+		}
+	}
+}
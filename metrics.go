@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBuckets are the upper bounds in seconds of the query latency histogram
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metricQtypes are the query types given their own label, others are "OTHER"
+var metricQtypes = map[uint16]bool{
+	dns.TypeA: true, dns.TypeAAAA: true, dns.TypeCNAME: true, dns.TypeMX: true,
+	dns.TypeTXT: true, dns.TypeNS: true, dns.TypePTR: true, dns.TypeSOA: true,
+	dns.TypeSRV: true, dns.TypeHTTPS: true, dns.TypeSVCB: true, dns.TypeANY: true,
+}
+
+// Kinds of reloads counted by the reload metrics
+const (
+	ReloadKindConfig  = "config"
+	ReloadKindRecords = "records"
+)
+
+// reloadCounters counts the reloads of one kind
+type reloadCounters struct {
+	successes atomic.Uint64
+	failures  atomic.Uint64
+	// Unix time of the last successful reload, 0 before the first
+	lastSuccess atomic.Int64
+}
+
+// Metrics holds query counters for the DNS server
+type Metrics struct {
+	Queries     atomic.Uint64
+	LocalMisses atomic.Uint64
+	CacheHits   atomic.Uint64
+	CacheMisses atomic.Uint64
+
+	// Counters keyed by "domain type" and by upstream name
+	recordHits      map[string]*atomic.Uint64
+	upstreamAnswers map[string]*atomic.Uint64
+	upstreamErrors  map[string]*atomic.Uint64
+	// Responses keyed by rcode, and latency histograms keyed by "qtype rcode"
+	responses map[string]*atomic.Uint64
+	latencies map[string]*latencyHistogram
+	// Reload counters keyed by reload kind, fixed at creation
+	reloads map[string]*reloadCounters
+
+	// Guards the counter maps, the counters themselves are atomic
+	mu sync.RWMutex
+}
+
+// StatsSnapshot is a point-in-time copy of the metrics
+type StatsSnapshot struct {
+	Queries         uint64            `json:"queries"`
+	LocalMisses     uint64            `json:"local_misses"`
+	CacheHits       uint64            `json:"cache_hits"`
+	CacheMisses     uint64            `json:"cache_misses"`
+	RecordHits      map[string]uint64 `json:"record_hits"`
+	UpstreamAnswers map[string]uint64 `json:"upstream_answers"`
+	UpstreamErrors  map[string]uint64 `json:"upstream_errors"`
+	Responses       map[string]uint64 `json:"responses"`
+}
+
+// latencyHistogram counts query latencies into cumulative buckets
+type latencyHistogram struct {
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	// Sum of latencies in microseconds
+	sumMicros atomic.Uint64
+}
+
+// observe records a single latency
+func (h *latencyHistogram) observe(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	h.sumMicros.Add(uint64(elapsed.Microseconds()))
+}
+
+// CacheHitRatio returns the fraction of cache lookups that were hits
+func (s StatsSnapshot) CacheHitRatio() float64 {
+	lookups := s.CacheHits + s.CacheMisses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(lookups)
+}
+
+// NewMetrics creates an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		recordHits:      make(map[string]*atomic.Uint64),
+		upstreamAnswers: make(map[string]*atomic.Uint64),
+		upstreamErrors:  make(map[string]*atomic.Uint64),
+		responses:       make(map[string]*atomic.Uint64),
+		latencies:       make(map[string]*latencyHistogram),
+		reloads: map[string]*reloadCounters{
+			ReloadKindConfig:  {},
+			ReloadKindRecords: {},
+		},
+	}
+}
+
+// ReloadSucceeded counts a successful reload and records its time
+func (m *Metrics) ReloadSucceeded(kind string) {
+	m.reloads[kind].successes.Add(1)
+	m.reloads[kind].lastSuccess.Store(time.Now().Unix())
+}
+
+// ReloadFailed counts a failed reload
+func (m *Metrics) ReloadFailed(kind string) {
+	m.reloads[kind].failures.Add(1)
+}
+
+// metricQtype returns the qtype label for a query type
+func metricQtype(qtype uint16) string {
+	if metricQtypes[qtype] {
+		return dns.TypeToString[qtype]
+	}
+	return "OTHER"
+}
+
+// metricRcode returns the rcode label for a response code
+func metricRcode(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return "OTHER"
+}
+
+// ObserveQuery counts a response by rcode and records its latency by qtype and rcode
+func (m *Metrics) ObserveQuery(qtype uint16, rcode int, elapsed time.Duration) {
+	rcodeLabel := metricRcode(rcode)
+	m.counter(m.responses, rcodeLabel).Add(1)
+	m.histogram(metricQtype(qtype) + " " + rcodeLabel).observe(elapsed)
+}
+
+// histogram returns the latency histogram for a key, creating it if needed
+func (m *Metrics) histogram(key string) *latencyHistogram {
+	m.mu.RLock()
+	histogram, ok := m.latencies[key]
+	m.mu.RUnlock()
+	if ok {
+		return histogram
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if histogram, ok := m.latencies[key]; ok {
+		return histogram
+	}
+
+	histogram = &latencyHistogram{buckets: make([]atomic.Uint64, len(latencyBuckets))}
+	m.latencies[key] = histogram
+	return histogram
+}
+
+// recordKey returns the counter key for a record
+func recordKey(record *RecordEntry) string {
+	return record.Domain + " " + record.Type
+}
+
+// RecordHit counts a local record being served
+func (m *Metrics) RecordHit(record *RecordEntry) {
+	m.counter(m.recordHits, recordKey(record)).Add(1)
+}
+
+// UpstreamAnswer counts a response received from an upstream
+func (m *Metrics) UpstreamAnswer(upstreamName string) {
+	m.counter(m.upstreamAnswers, upstreamName).Add(1)
+}
+
+// UpstreamError counts a failed exchange with an upstream
+func (m *Metrics) UpstreamError(upstreamName string) {
+	m.counter(m.upstreamErrors, upstreamName).Add(1)
+}
+
+// RecordHits returns the number of times a record has been served
+func (m *Metrics) RecordHits(record *RecordEntry) uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if counter, ok := m.recordHits[recordKey(record)]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// counter returns the counter for a key, creating it if needed
+func (m *Metrics) counter(counters map[string]*atomic.Uint64, key string) *atomic.Uint64 {
+	m.mu.RLock()
+	counter, ok := counters[key]
+	m.mu.RUnlock()
+	if ok {
+		return counter
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another goroutine may have created it in the meantime
+	if counter, ok := counters[key]; ok {
+		return counter
+	}
+
+	counter = new(atomic.Uint64)
+	counters[key] = counter
+	return counter
+}
+
+// Snapshot returns a copy of the current metric values
+func (m *Metrics) Snapshot() StatsSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot := StatsSnapshot{
+		Queries:         m.Queries.Load(),
+		LocalMisses:     m.LocalMisses.Load(),
+		CacheHits:       m.CacheHits.Load(),
+		CacheMisses:     m.CacheMisses.Load(),
+		RecordHits:      make(map[string]uint64, len(m.recordHits)),
+		UpstreamAnswers: make(map[string]uint64, len(m.upstreamAnswers)),
+		UpstreamErrors:  make(map[string]uint64, len(m.upstreamErrors)),
+		Responses:       make(map[string]uint64, len(m.responses)),
+	}
+
+	for key, counter := range m.recordHits {
+		snapshot.RecordHits[key] = counter.Load()
+	}
+	for key, counter := range m.upstreamAnswers {
+		snapshot.UpstreamAnswers[key] = counter.Load()
+	}
+	for key, counter := range m.upstreamErrors {
+		snapshot.UpstreamErrors[key] = counter.Load()
+	}
+	for key, counter := range m.responses {
+		snapshot.Responses[key] = counter.Load()
+	}
+
+	return snapshot
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	snapshot := m.Snapshot()
+
+	fmt.Fprintln(w, "# HELP dnser_queries_total Total number of DNS queries received.")
+	fmt.Fprintln(w, "# TYPE dnser_queries_total counter")
+	fmt.Fprintf(w, "dnser_queries_total %d\n", snapshot.Queries)
+
+	fmt.Fprintln(w, "# HELP dnser_local_misses_total Queries with no matching local record.")
+	fmt.Fprintln(w, "# TYPE dnser_local_misses_total counter")
+	fmt.Fprintf(w, "dnser_local_misses_total %d\n", snapshot.LocalMisses)
+
+	fmt.Fprintln(w, "# HELP dnser_cache_hits_total Responses served from the cache.")
+	fmt.Fprintln(w, "# TYPE dnser_cache_hits_total counter")
+	fmt.Fprintf(w, "dnser_cache_hits_total %d\n", snapshot.CacheHits)
+
+	fmt.Fprintln(w, "# HELP dnser_cache_misses_total Cache lookups that found no entry.")
+	fmt.Fprintln(w, "# TYPE dnser_cache_misses_total counter")
+	fmt.Fprintf(w, "dnser_cache_misses_total %d\n", snapshot.CacheMisses)
+
+	fmt.Fprintln(w, "# HELP dnser_record_hits_total Number of times each local record was served.")
+	fmt.Fprintln(w, "# TYPE dnser_record_hits_total counter")
+	for _, key := range sortedKeys(snapshot.RecordHits) {
+		domain, recordType, _ := strings.Cut(key, " ")
+		fmt.Fprintf(w, "dnser_record_hits_total{domain=%q,type=%q} %d\n", domain, recordType, snapshot.RecordHits[key])
+	}
+
+	fmt.Fprintln(w, "# HELP dnser_upstream_answers_total Number of responses received from each upstream.")
+	fmt.Fprintln(w, "# TYPE dnser_upstream_answers_total counter")
+	for _, key := range sortedKeys(snapshot.UpstreamAnswers) {
+		fmt.Fprintf(w, "dnser_upstream_answers_total{upstream=%q} %d\n", key, snapshot.UpstreamAnswers[key])
+	}
+
+	fmt.Fprintln(w, "# HELP dnser_upstream_errors_total Number of failed exchanges with each upstream.")
+	fmt.Fprintln(w, "# TYPE dnser_upstream_errors_total counter")
+	for _, key := range sortedKeys(snapshot.UpstreamErrors) {
+		fmt.Fprintf(w, "dnser_upstream_errors_total{upstream=%q} %d\n", key, snapshot.UpstreamErrors[key])
+	}
+
+	fmt.Fprintln(w, "# HELP dnser_responses_total Number of responses sent by rcode.")
+	fmt.Fprintln(w, "# TYPE dnser_responses_total counter")
+	for _, key := range sortedKeys(snapshot.Responses) {
+		fmt.Fprintf(w, "dnser_responses_total{rcode=%q} %d\n", key, snapshot.Responses[key])
+	}
+
+	m.writeLatencies(w)
+	m.writeReloads(w)
+}
+
+// writeReloads writes the reload counters in the Prometheus text format
+func (m *Metrics) writeReloads(w io.Writer) {
+	kinds := []string{ReloadKindConfig, ReloadKindRecords}
+
+	fmt.Fprintln(w, "# HELP dnser_reloads_total Number of config and records reloads by result.")
+	fmt.Fprintln(w, "# TYPE dnser_reloads_total counter")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "dnser_reloads_total{kind=%q,result=\"success\"} %d\n", kind, m.reloads[kind].successes.Load())
+		fmt.Fprintf(w, "dnser_reloads_total{kind=%q,result=\"failure\"} %d\n", kind, m.reloads[kind].failures.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP dnser_last_reload_success_timestamp_seconds Unix time of the last successful reload.")
+	fmt.Fprintln(w, "# TYPE dnser_last_reload_success_timestamp_seconds gauge")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "dnser_last_reload_success_timestamp_seconds{kind=%q} %d\n", kind, m.reloads[kind].lastSuccess.Load())
+	}
+}
+
+// writeLatencies writes the query latency histograms in the Prometheus text format
+func (m *Metrics) writeLatencies(w io.Writer) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.latencies))
+	for key := range m.latencies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(w, "# HELP dnser_query_duration_seconds Query latency by query type and rcode.")
+	fmt.Fprintln(w, "# TYPE dnser_query_duration_seconds histogram")
+	for _, key := range keys {
+		histogram := m.latencies[key]
+		qtype, rcode, _ := strings.Cut(key, " ")
+		labels := fmt.Sprintf("qtype=%q,rcode=%q", qtype, rcode)
+
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "dnser_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, histogram.buckets[i].Load())
+		}
+		fmt.Fprintf(w, "dnser_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.count.Load())
+		fmt.Fprintf(w, "dnser_query_duration_seconds_sum{%s} %g\n", labels, float64(histogram.sumMicros.Load())/1e6)
+		fmt.Fprintf(w, "dnser_query_duration_seconds_count{%s} %d\n", labels, histogram.count.Load())
+	}
+}
+
+// rcodeRecorder remembers the rcode of the response written to a client
+type rcodeRecorder struct {
+	dns.ResponseWriter
+	rcode   int
+	written bool
+}
+
+// WriteMsg records the response's rcode before writing it
+func (w *rcodeRecorder) WriteMsg(m *dns.Msg) error {
+	w.rcode = m.Rcode
+	w.written = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// sortedKeys returns the keys of a counter map in sorted order
+func sortedKeys(counters map[string]uint64) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
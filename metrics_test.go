@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordHitsCountServedRecords(t *testing.T) {
+	hit := RecordEntry{Domain: "hit.test", Type: "A", Value: "192.0.2.1", TTL: 60}
+	other := RecordEntry{Domain: "other.test", Type: "A", Value: "192.0.2.2", TTL: 60}
+	setTestRecords(t, hit, other)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	for i := 0; i < 3; i++ {
+		ask(server, "hit.test", dns.TypeA)
+	}
+
+	if got := server.metrics.RecordHits(&hit); got != 3 {
+		t.Errorf("served record has %d hits, want 3", got)
+	}
+	if got := server.metrics.RecordHits(&other); got != 0 {
+		t.Errorf("unserved record has %d hits, want 0", got)
+	}
+	if got := server.metrics.Snapshot().RecordHits[recordKey(&hit)]; got != 3 {
+		t.Errorf("snapshot has %d hits for the served record, want 3", got)
+	}
+}
+
+func TestLatencySeriesLabeledByQtypeAndRcode(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "host.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "host.test", Type: "AAAA", Value: "2001:db8::1", TTL: 60},
+	)
+	config := loadTestConfig(t, testConfig)
+	startTestUpstream(t, config, servFail)
+	server := newTestServer(t, config)
+
+	ask(server, "host.test", dns.TypeA)
+	ask(server, "host.test", dns.TypeAAAA)
+	ask(server, "mail.test", dns.TypeMX)
+	ask(server, "host.test", dns.TypeCAA)
+
+	rec := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, series := range []string{
+		`dnser_query_duration_seconds_count{qtype="A",rcode="NOERROR"} 1`,
+		`dnser_query_duration_seconds_count{qtype="AAAA",rcode="NOERROR"} 1`,
+		`dnser_query_duration_seconds_count{qtype="MX",rcode="SERVFAIL"} 1`,
+		`dnser_query_duration_seconds_count{qtype="OTHER",rcode="SERVFAIL"} 1`,
+		`dnser_query_duration_seconds_bucket{qtype="A",rcode="NOERROR",le="+Inf"} 1`,
+		`dnser_responses_total{rcode="SERVFAIL"} 2`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("missing series %s in:\n%s", series, body)
+		}
+	}
+}
+
+func TestReloadMetricsCountFailuresAndSuccesses(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	server := newTestServer(t, config)
+	writeRecords := func(content string) {
+		writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile), content)
+		server.ReloadRecords()
+	}
+	scrape := func() string {
+		var out strings.Builder
+		server.metrics.WritePrometheus(&out)
+		return out.String()
+	}
+
+	writeRecords("[[records]\n")
+	server.ConfigReloadFailed(errors.New("invalid config"))
+	out := scrape()
+	for _, want := range []string{
+		`dnser_reloads_total{kind="records",result="failure"} 1`,
+		`dnser_reloads_total{kind="config",result="failure"} 1`,
+		`dnser_reloads_total{kind="records",result="success"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s after failed reloads:\n%s", want, out)
+		}
+	}
+	if !strings.Contains(out, `dnser_last_reload_success_timestamp_seconds{kind="records"} 0`) {
+		t.Errorf("failed reload updated the success timestamp:\n%s", out)
+	}
+
+	before := time.Now().Unix()
+	writeRecords(testRecords("good.test", "192.0.2.1"))
+	out = scrape()
+	for _, want := range []string{
+		`dnser_reloads_total{kind="records",result="success"} 1`,
+		`dnser_reloads_total{kind="records",result="failure"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s after a good reload:\n%s", want, out)
+		}
+	}
+	var stamp int64
+	prefix := `dnser_last_reload_success_timestamp_seconds{kind="records"} `
+	if i := strings.Index(out, prefix); i >= 0 {
+		fmt.Sscanf(out[i+len(prefix):], "%d", &stamp)
+	}
+	if stamp < before || stamp > time.Now().Unix() {
+		t.Errorf("got success timestamp %d, want the time of the good reload:\n%s", stamp, out)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// QueryHandler answers a query
+type QueryHandler func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext)
+
+// Middleware is a stage of query processing: it either answers the query
+// itself, short-circuiting the rest of the pipeline, or calls next
+type Middleware func(next QueryHandler) QueryHandler
+
+// Names of the built-in pipeline stages
+const (
+	StageRateLimit   = "ratelimit"
+	StageQueryLog    = "querylog"
+	StageQName       = "qname"
+	StageAnyOverUDP  = "any_over_udp"
+	StageProbe       = "probe"
+	StageResolvable  = "resolvable"
+	StagePolicy      = "policy"
+	StageIterative   = "iterative"
+	StageLocal       = "local"
+	StageReverse     = "reverse"
+	StageOwnedZone   = "owned_zone"
+	StageMissingAAAA = "missing_aaaa"
+	StageUpstream    = "upstream"
+)
+
+// defaultPipeline is the stage order used when the pipeline is not configured
+var defaultPipeline = []string{
+	StageRateLimit,
+	StageQueryLog,
+	StageQName,
+	StageAnyOverUDP,
+	StageProbe,
+	StageResolvable,
+	StagePolicy,
+	StageIterative,
+	StageLocal,
+	StageReverse,
+	StageOwnedZone,
+	StageMissingAAAA,
+	StageUpstream,
+}
+
+// stages maps stage names to constructors of their middleware
+var stages = map[string]func(s *DNSServer) Middleware{
+	StageRateLimit:   (*DNSServer).rateLimitStage,
+	StageQueryLog:    (*DNSServer).queryLogStage,
+	StageQName:       (*DNSServer).qnameStage,
+	StageAnyOverUDP:  (*DNSServer).anyOverUDPStage,
+	StageProbe:       (*DNSServer).probeStage,
+	StageResolvable:  (*DNSServer).resolvableStage,
+	StagePolicy:      (*DNSServer).policyStage,
+	StageIterative:   (*DNSServer).iterativeStage,
+	StageLocal:       (*DNSServer).localStage,
+	StageReverse:     (*DNSServer).reverseStage,
+	StageOwnedZone:   (*DNSServer).ownedZoneStage,
+	StageMissingAAAA: (*DNSServer).missingAAAAStage,
+	StageUpstream:    (*DNSServer).upstreamStage,
+}
+
+// RegisterStage adds a named pipeline stage that can be listed in the pipeline config
+// Stages must be registered before the configuration is loaded
+func RegisterStage(name string, stage func(s *DNSServer) Middleware) {
+	stages[name] = stage
+}
+
+// validatePipeline checks that every configured stage exists
+func validatePipeline(pipeline []string) error {
+	for _, name := range pipeline {
+		if _, ok := stages[name]; !ok {
+			return fmt.Errorf("unknown pipeline stage: %s", name)
+		}
+	}
+	return nil
+}
+
+// buildPipeline chains the configured stages, ending in a handler that
+// refuses queries no stage answered
+func (s *DNSServer) buildPipeline(pipeline []string) QueryHandler {
+	if len(pipeline) == 0 {
+		pipeline = defaultPipeline
+	}
+
+	handler := QueryHandler(func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	})
+
+	// Wrap from the last stage so the first stage runs first
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		handler = stages[pipeline[i]](s)(handler)
+	}
+
+	return handler
+}
+
+// rateLimitStage applies per-client rate and in-flight query limits
+func (s *DNSServer) rateLimitStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			client := rc.clientIP.String()
+			if limiter := s.currentLimiter(); limiter != nil && !limiter.Allow(client) {
+				s.sendRateLimited(w, r, rc.transport)
+				return
+			}
+
+			// Later stages run synchronously, so the query is in flight until next returns
+			if limit := s.currentConfig().RateLimit.MaxInFlight; limit > 0 {
+				if !s.inFlight.Acquire(client, limit) {
+					s.sendRateLimited(w, r, rc.transport)
+					return
+				}
+				defer s.inFlight.Release(client)
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// queryLogStage logs queries if enabled and sampled
+func (s *DNSServer) queryLogStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			rc.logQuery = s.shouldLogQuery()
+			if rc.logQuery {
+				q := r.Question[0]
+				log.Printf("Query: %s, Type: %s", normalizeName(q.Name), dns.TypeToString[q.Qtype])
+
+				if s.currentConfig().Server.LogAnswers {
+					w = &answerLogger{ResponseWriter: w}
+				}
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// qnameStage rejects garbage query names with FORMERR before they reach
+// matching or upstreams, unless invalid_qname forwards them
+func (s *DNSServer) qnameStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.currentConfig().Server.InvalidQName == InvalidQNameFormErr && !validQueryName(r.Question[0].Name) {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeFormatError)
+				w.WriteMsg(m)
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// anyOverUDPStage answers ANY queries over UDP as any_over_udp configures
+func (s *DNSServer) anyOverUDPStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handleAnyOverUDP(w, r, rc.transport) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// probeStage answers built-in probe and diagnostic names
+func (s *DNSServer) probeStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			q := r.Question[0]
+			if s.handleProbe(w, r, q, rc.clientIP) || s.handleStatsQuery(w, r, q) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// resolvableStage refuses names outside the resolvable domains of a closed resolver
+func (s *DNSServer) resolvableStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if !s.isResolvable(getDomainFromQuestion(r.Question[0])) {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeRefused)
+				w.WriteMsg(m)
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// policyStage answers names covered by a policy with its rcode
+func (s *DNSServer) policyStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handlePolicy(w, r, r.Question[0]) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// iterativeStage applies the iterative_queries policy to queries without RD
+func (s *DNSServer) iterativeStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handleIterativeQuery(w, r) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// localStage answers from local records
+func (s *DNSServer) localStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			// Hold, fail or pass on queries until records are loaded
+			if !s.awaitRecords(w, r) {
+				return
+			}
+			if s.degradedAnswer(w, r) {
+				return
+			}
+			if s.handleLocalRecord(s.localAnswerWriter(w, r), r, r.Question[0], rc) {
+				return
+			}
+			s.metrics.LocalMisses.Add(1)
+			next(w, r, rc)
+		}
+	}
+}
+
+// reverseStage synthesizes PTR answers for reverse queries no local record matched
+func (s *DNSServer) reverseStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handleReverseSynthesis(s.localAnswerWriter(w, r), r, r.Question[0]) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// ownedZoneStage answers negatively for unmatched names in owned zones
+func (s *DNSServer) ownedZoneStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handleOwnedZone(s.localAnswerWriter(w, r), r, r.Question[0]) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// missingAAAAStage answers AAAA queries with NODATA instead of forwarding them
+// when IPv6 is disabled or the name only has a local A record
+func (s *DNSServer) missingAAAAStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			if s.handleMissingAAAA(s.localAnswerWriter(w, r), r, r.Question[0], rc.clientIP) {
+				return
+			}
+			next(w, r, rc)
+		}
+	}
+}
+
+// upstreamStage forwards queries upstream once upstreams are ready
+// It always answers, so stages after it are never reached
+func (s *DNSServer) upstreamStage() Middleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+			// Hold or fail forwarded queries until upstreams are ready
+			if !s.awaitUpstreams(w, r) {
+				return
+			}
+			s.handleUpstreamRequest(w, r, rc)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// registerTestStage registers a pipeline stage for the duration of a test
+func registerTestStage(t *testing.T, name string, stage func(s *DNSServer) Middleware) {
+	t.Helper()
+
+	RegisterStage(name, stage)
+	t.Cleanup(func() { delete(stages, name) })
+}
+
+// pipelineConfig returns the test config with the given pipeline stages
+func pipelineConfig(names ...string) string {
+	return serverTestConfig(`pipeline = ["` + strings.Join(names, `", "`) + `"]`)
+}
+
+func TestCustomStageShortCircuits(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "blocked.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "allowed.test", Type: "A", Value: "192.0.2.2", TTL: 60},
+	)
+	registerTestStage(t, "test_block", func(s *DNSServer) Middleware {
+		return func(next QueryHandler) QueryHandler {
+			return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+				if r.Question[0].Name == "blocked.test." {
+					m := new(dns.Msg)
+					m.SetRcode(r, dns.RcodeNameError)
+					w.WriteMsg(m)
+					return
+				}
+				next(w, r, rc)
+			}
+		}
+	})
+
+	server := newTestServer(t, loadTestConfig(t, pipelineConfig("test_block", StageLocal, StageUpstream)))
+	if m := ask(server, "blocked.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeNameError {
+		t.Errorf("got %v, want the custom stage's NXDOMAIN", m)
+	}
+	if m := ask(server, "allowed.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the query passed on to the local stage", m)
+	}
+
+	// Placed after the local stage, the local record answers first
+	server = newTestServer(t, loadTestConfig(t, pipelineConfig(StageLocal, "test_block", StageUpstream)))
+	if m := ask(server, "blocked.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the local answer", m)
+	}
+}
+
+func TestPipelineStageOrder(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "order.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	var order []string
+	for _, name := range []string{"test_first", "test_second"} {
+		name := name
+		registerTestStage(t, name, func(s *DNSServer) Middleware {
+			return func(next QueryHandler) QueryHandler {
+				return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+					order = append(order, name)
+					next(w, r, rc)
+				}
+			}
+		})
+	}
+
+	server := newTestServer(t, loadTestConfig(t, pipelineConfig("test_second", "test_first", StageLocal)))
+	ask(server, "order.test", dns.TypeA)
+	if got := strings.Join(order, ","); got != "test_second,test_first" {
+		t.Errorf("stages ran in order %s, want the configured order", got)
+	}
+
+	// Queries no stage answers are refused
+	if m := ask(server, "missing.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("got %v, want REFUSED at the end of the pipeline", m)
+	}
+}
+
+func TestUnknownPipelineStageRejected(t *testing.T) {
+	_, err := LoadConfig(writeTestFile(t, t.TempDir(), "config.toml", pipelineConfig(StageLocal, "missing_stage")))
+	if err == nil || !strings.Contains(err.Error(), "unknown pipeline stage: missing_stage") {
+		t.Errorf("got %v, want the unknown stage rejected", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// maxPaddingBlockSize bounds the padding block size to what fits in a message
+const maxPaddingBlockSize = dns.MaxMsgSize
+
+// paddingOptionHeader is the size of the padding option code and length fields
+const paddingOptionHeader = 4
+
+// requestsPadding reports whether a query carries the EDNS0 Padding option
+func requestsPadding(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// padResponse pads a response to a multiple of blockSize bytes as described in
+// RFC 7830, replacing any padding it already carries
+// Only queries that were padded themselves get padded responses (RFC 8467)
+func padResponse(m, r *dns.Msg, blockSize int) {
+	if blockSize <= 0 || !requestsPadding(r) {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.MinMsgSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+
+	size := m.Len() + paddingOptionHeader
+	padding := (blockSize - size%blockSize) % blockSize
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// policyRcodes are the rcodes a policy may answer with
+var policyRcodes = map[string]int{
+	"NXDOMAIN": dns.RcodeNameError,
+	"REFUSED":  dns.RcodeRefused,
+	"NOTIMP":   dns.RcodeNotImplemented,
+	"SERVFAIL": dns.RcodeServerFailure,
+}
+
+// validatePolicies checks that every policy has a pattern and a supported rcode
+func validatePolicies(policies []PolicyRule) error {
+	for _, policy := range policies {
+		if policy.Pattern == "" {
+			return fmt.Errorf("policy requires a pattern")
+		}
+
+		if _, ok := policyRcodes[strings.ToUpper(policy.Rcode)]; !ok {
+			return fmt.Errorf("policy %s: unsupported rcode %q", policy.Pattern, policy.Rcode)
+		}
+	}
+
+	return nil
+}
+
+// findPolicyRcode returns the rcode of the first policy matching a domain
+func findPolicyRcode(policies []PolicyRule, domain string) (int, bool) {
+	for _, policy := range policies {
+		if MatchDomain(policy.Pattern, domain) {
+			return policyRcodes[strings.ToUpper(policy.Rcode)], true
+		}
+	}
+
+	return 0, false
+}
+
+// handlePolicy answers a query with the rcode of a matching policy
+// Returns true if a policy matched
+func (s *DNSServer) handlePolicy(w dns.ResponseWriter, r *dns.Msg, q dns.Question) bool {
+	rcode, ok := findPolicyRcode(s.currentConfig().Policies, getDomainFromQuestion(q))
+	if !ok {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	w.WriteMsg(m)
+	return true
+}
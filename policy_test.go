@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPolicyRcodes(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "allowed.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	server := newTestServer(t, loadTestConfig(t, testConfig+`
+[[policy]]
+pattern = "gone.test"
+rcode = "NXDOMAIN"
+
+[[policy]]
+pattern = "_**.blocked.test"
+rcode = "REFUSED"
+
+[[policy]]
+pattern = "legacy.test"
+rcode = "notimp"
+
+[[policy]]
+pattern = "broken.test"
+rcode = "SERVFAIL"
+`))
+
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{"gone.test", dns.RcodeNameError},
+		{"a.blocked.test", dns.RcodeRefused},
+		{"legacy.test", dns.RcodeNotImplemented},
+		{"broken.test", dns.RcodeServerFailure},
+		{"allowed.test", dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		if m := ask(server, tt.name, dns.TypeA); m == nil || m.Rcode != tt.rcode {
+			t.Errorf("%s: got %v, want %s", tt.name, m, dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	if err := validatePolicies([]PolicyRule{{Pattern: "x.test", Rcode: "NOERROR"}}); err == nil {
+		t.Error("expected an unsupported rcode to be rejected")
+	}
+	if err := validatePolicies([]PolicyRule{{Rcode: "NXDOMAIN"}}); err == nil {
+		t.Error("expected a policy without a pattern to be rejected")
+	}
+}
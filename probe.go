@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// handleProbe answers the built-in self-probe and client IP echo names
+// Returns true if the query was for one of these names and a response was sent
+func (s *DNSServer) handleProbe(w dns.ResponseWriter, r *dns.Msg, q dns.Question, clientIP net.IP) bool {
+	probe := s.currentConfig().Probe
+	name := normalizeName(q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	header := dns.RR_Header{
+		Name:  q.Name,
+		Class: dns.ClassINET,
+		Ttl:   uint32(probe.TTL),
+	}
+
+	switch {
+	case probe.Name != "" && name == normalizeName(probe.Name):
+		// Answer with the configured address or the address the query arrived on
+		ip := net.ParseIP(probe.Address)
+		if ip == nil {
+			ip = getClientIP(w.LocalAddr())
+		}
+		addAddressRR(m, header, ip, q.Qtype)
+
+	case probe.ListenName != "" && name == normalizeName(probe.ListenName):
+		// Answer with the effective listen address, or the address the
+		// query arrived on when listening on all addresses
+		ip := net.ParseIP(s.currentConfig().Server.Listen)
+		if ip == nil || ip.IsUnspecified() {
+			ip = getClientIP(w.LocalAddr())
+		}
+		addAddressRR(m, header, ip, q.Qtype)
+
+	case probe.ClientIPName != "" && name == normalizeName(probe.ClientIPName):
+		// Echo the client's address, useful for debugging NAT
+		if q.Qtype == dns.TypeTXT && clientIP != nil {
+			header.Rrtype = dns.TypeTXT
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: header, Txt: []string{clientIP.String()}})
+		}
+
+	default:
+		return false
+	}
+
+	w.WriteMsg(m)
+	return true
+}
+
+// addAddressRR adds an A or AAAA record for the IP if it matches the query type
+// Leaves the answer empty (NODATA) when the address family does not match
+func addAddressRR(m *dns.Msg, header dns.RR_Header, ip net.IP, qtype uint16) {
+	if ip == nil {
+		return
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype == dns.TypeA {
+			header.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: header, A: ip4})
+		}
+		return
+	}
+
+	if qtype == dns.TypeAAAA {
+		header.Rrtype = dns.TypeAAAA
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+	}
+}
+
+// handleStatsQuery answers TXT queries for the diagnostic stats name with live
+// counters as "key=value" strings, one per TXT record
+// Returns true if the query was for the stats name and a response was sent
+func (s *DNSServer) handleStatsQuery(w dns.ResponseWriter, r *dns.Msg, q dns.Question) bool {
+	statsName := s.currentConfig().Probe.StatsName
+	if statsName == "" || normalizeName(q.Name) != normalizeName(statsName) {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if q.Qtype == dns.TypeTXT {
+		snapshot := s.metrics.Snapshot()
+
+		values := []string{
+			fmt.Sprintf("queries=%d", snapshot.Queries),
+			fmt.Sprintf("local_misses=%d", snapshot.LocalMisses),
+			fmt.Sprintf("cache_hits=%d", snapshot.CacheHits),
+			fmt.Sprintf("cache_misses=%d", snapshot.CacheMisses),
+			fmt.Sprintf("cache_hit_ratio=%.4f", snapshot.CacheHitRatio()),
+		}
+		for _, name := range sortedUpstreamNames(s.currentConfig().Upstreams) {
+			values = append(values, fmt.Sprintf("upstream.%s.answers=%d", name, snapshot.UpstreamAnswers[name]))
+			values = append(values, fmt.Sprintf("upstream.%s.errors=%d", name, snapshot.UpstreamErrors[name]))
+		}
+
+		for _, value := range values {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{value},
+			})
+		}
+	}
+
+	w.WriteMsg(m)
+	return true
+}
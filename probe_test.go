@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// probeTestConfig enables the self-probe and client IP echo names
+const probeTestConfig = testConfig + `
+[probe]
+name = "probe.dns-er.internal"
+client_ip_name = "whoami.dns-er.internal"
+ttl = 5
+`
+
+func TestSelfProbeAnswersServerAddress(t *testing.T) {
+	server := newTestServer(t, loadTestConfig(t, probeTestConfig))
+
+	m := ask(server, "probe.dns-er.internal", dns.TypeA)
+	if m == nil || !m.Authoritative || len(m.Answer) != 1 {
+		t.Fatalf("got %v, want an authoritative answer", m)
+	}
+	if a := m.Answer[0].(*dns.A); a.A.String() != "127.0.0.1" || a.Hdr.Ttl != 5 {
+		t.Errorf("got %v, want the address the query arrived on with TTL 5", a)
+	}
+
+	if m := ask(server, "probe.dns-er.internal", dns.TypeAAAA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("AAAA probe got %v, want NODATA", m)
+	}
+
+	configured := loadTestConfig(t, probeTestConfig)
+	configured.Probe.Address = "192.0.2.53"
+	server = newTestServer(t, configured)
+	if m := ask(server, "probe.dns-er.internal", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.53" {
+		t.Errorf("got %v, want the configured address", m)
+	}
+}
+
+func TestClientIPEcho(t *testing.T) {
+	server := newTestServer(t, loadTestConfig(t, probeTestConfig))
+
+	w := newTestWriter("203.0.113.9", false)
+	server.handleRequest(w, query("whoami.dns-er.internal", dns.TypeTXT))
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("got %v, want one TXT answer", w.msg)
+	}
+	if txt := w.msg.Answer[0].(*dns.TXT); len(txt.Txt) != 1 || txt.Txt[0] != "203.0.113.9" {
+		t.Errorf("got %v, want the client address", txt)
+	}
+}
+
+func TestStatsQueryReturnsParseableCounters(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "counted.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+	ask(server, "counted.test", dns.TypeA)
+	ask(server, "counted.test", dns.TypeA)
+
+	m := ask(server, defaultStatsName, dns.TypeTXT)
+	if m == nil || len(m.Answer) == 0 {
+		t.Fatalf("got %v, want stats TXT records", m)
+	}
+
+	stats := map[string]string{}
+	for _, rr := range m.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || len(txt.Txt) != 1 {
+			t.Fatalf("got %v, want single-string TXT records", rr)
+		}
+		key, value, found := strings.Cut(txt.Txt[0], "=")
+		if !found {
+			t.Fatalf("stat %q is not key=value", txt.Txt[0])
+		}
+		stats[key] = value
+	}
+
+	for _, key := range []string{"queries", "local_misses", "cache_hits", "cache_misses", "cache_hit_ratio", "upstream.primary.answers", "upstream.primary.errors"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("stats are missing %s: %v", key, stats)
+		}
+	}
+	if queries, err := strconv.Atoi(stats["queries"]); err != nil || queries < 2 {
+		t.Errorf("got queries=%s, want at least the 2 queries made", stats["queries"])
+	}
+}
+
+func TestListenNameFollowsReload(t *testing.T) {
+	probe := "\n[probe]\nlisten_name = \"dns-er.local\"\n"
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig(`listen = "192.0.2.10"`)+probe))
+
+	if m := ask(server, "dns-er.local", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.10" {
+		t.Fatalf("got %v, want the configured listen address", m)
+	}
+	if m := ask(server, "dns-er.local", dns.TypeAAAA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("AAAA got %v, want NODATA for an IPv4 listen address", m)
+	}
+
+	server.Reload(loadTestConfig(t, serverTestConfig(`listen = "2001:db8::53"`)+probe))
+	if m := ask(server, "dns-er.local", dns.TypeAAAA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::53" {
+		t.Errorf("got %v, want the reloaded listen address", m)
+	}
+
+	// Listening on all addresses answers with the address the query arrived on
+	server.Reload(loadTestConfig(t, serverTestConfig(`listen = "0.0.0.0"`)+probe))
+	if m := ask(server, "dns-er.local", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("got %v, want the local address of the query", m)
+	}
+}
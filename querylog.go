@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxLoggedAnswers caps how many answer records are included in a log line
+const maxLoggedAnswers = 10
+
+// Log levels
+const (
+	LogLevelInfo  = "info"
+	LogLevelTrace = "trace"
+)
+
+// traceEnabled reports whether trace logging is on
+var traceEnabled atomic.Bool
+
+// SetLogLevel switches trace logging on or off for the given log level
+func SetLogLevel(level string) {
+	traceEnabled.Store(level == LogLevelTrace)
+}
+
+// tracef logs a message when trace logging is on
+func tracef(format string, args ...interface{}) {
+	if traceEnabled.Load() {
+		log.Printf("Trace: "+format, args...)
+	}
+}
+
+// shouldLogQuery decides whether a query is included in the query log
+// A sample rate of zero or one logs every query
+func (s *DNSServer) shouldLogQuery() bool {
+	config := s.currentConfig()
+	if !config.Server.LogQueries {
+		return false
+	}
+
+	rate := config.Server.LogSampleRate
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+
+	return rand.Float64() < rate
+}
+
+// logSlowQuery logs queries that took longer than the slow query threshold,
+// regardless of query log sampling
+func (s *DNSServer) logSlowQuery(q dns.Question, start time.Time) {
+	threshold := s.currentConfig().Server.SlowQueryMs
+	if threshold <= 0 {
+		return
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Duration(threshold)*time.Millisecond {
+		log.Printf("Slow query: %s, Type: %s, took %v", normalizeName(q.Name), dns.TypeToString[q.Qtype], elapsed)
+	}
+}
+
+// logUpstreamExchange logs a query sent to an upstream with log_queries set,
+// along with its response and latency
+func logUpstreamExchange(upstreamName string, q dns.Question, response *dns.Msg, err error, elapsed time.Duration) {
+	if err != nil {
+		log.Printf("Upstream %s query: %s, Type: %s, Error: %v, took %v",
+			upstreamName, normalizeName(q.Name), dns.TypeToString[q.Qtype], err, elapsed)
+		return
+	}
+
+	log.Printf("Upstream %s query: %s, Type: %s, Rcode: %s, Records: [%s], took %v",
+		upstreamName, normalizeName(q.Name), dns.TypeToString[q.Qtype], dns.RcodeToString[response.Rcode], formatAnswers(response.Answer), elapsed)
+}
+
+// answerLogger logs the answer section of responses written to a client
+type answerLogger struct {
+	dns.ResponseWriter
+}
+
+// WriteMsg logs the response's answers before writing it
+func (w *answerLogger) WriteMsg(m *dns.Msg) error {
+	name := ""
+	if len(m.Question) > 0 {
+		name = normalizeName(m.Question[0].Name)
+	}
+	log.Printf("Answer: %s, Rcode: %s, Records: [%s]", name, dns.RcodeToString[m.Rcode], formatAnswers(m.Answer))
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// formatAnswers returns a compact representation of answer records
+// At most maxLoggedAnswers records are included
+func formatAnswers(answers []dns.RR) string {
+	parts := make([]string, 0, min(len(answers), maxLoggedAnswers)+1)
+	for i, rr := range answers {
+		if i == maxLoggedAnswers {
+			parts = append(parts, fmt.Sprintf("... %d more", len(answers)-maxLoggedAnswers))
+			break
+		}
+
+		// Drop the owner name and class, keeping the TTL, type and data
+		header := rr.Header()
+		data := strings.TrimPrefix(rr.String(), header.String())
+		parts = append(parts, fmt.Sprintf("%s %d %s", dns.TypeToString[header.Rrtype], header.Ttl, data))
+	}
+
+	return strings.Join(parts, "; ")
+}
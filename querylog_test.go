@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLogSampling(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "sampled.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	config := loadTestConfig(t, serverTestConfig("log_queries = true\nlog_sample_rate = 0.1"))
+	primary := config.Upstreams["primary"]
+	primary.Port = freePort(t)
+	config.Upstreams["primary"] = primary
+	server := newTestServer(t, config)
+	logs := captureLog(t)
+
+	const queries = 2000
+	for i := 0; i < queries; i++ {
+		ask(server, "sampled.test", dns.TypeA)
+	}
+
+	// Expect around 200 of 2000 queries, allowing for chance
+	if logged := strings.Count(logs.String(), "Query: sampled.test"); logged < 120 || logged > 280 {
+		t.Errorf("logged %d of %d queries, want roughly 10%%", logged, queries)
+	}
+
+	// Upstream failures are logged whether or not the query is sampled
+	for i := 0; i < 20; i++ {
+		ask(server, "failing.test", dns.TypeA)
+	}
+	if errors := strings.Count(logs.String(), "Upstream primary failed for failing.test"); errors != 20 {
+		t.Errorf("logged %d of 20 upstream failures, want all", errors)
+	}
+}
+
+func TestAnswersLoggedOnlyWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		setTestRecords(t, RecordEntry{Domain: "logged.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+		server := newTestServer(t, loadTestConfig(t, serverTestConfig("log_queries = true\nlog_answers = "+strconv.FormatBool(enabled))))
+		logs := captureLog(t)
+
+		ask(server, "logged.test", dns.TypeA)
+
+		logged := strings.Contains(logs.String(), "Answer: logged.test, Rcode: NOERROR, Records: [A 60 192.0.2.1]")
+		if logged != enabled {
+			t.Errorf("log_answers = %t: answer logged = %t in %q", enabled, logged, logs.String())
+		}
+	}
+}
+
+func TestLoggedAnswersCapped(t *testing.T) {
+	answers := make([]dns.RR, maxLoggedAnswers+2)
+	for i := range answers {
+		answers[i] = &dns.A{
+			Hdr: dns.RR_Header{Name: "many.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		}
+	}
+
+	formatted := formatAnswers(answers)
+	if got := strings.Count(formatted, "A 60 "); got != maxLoggedAnswers {
+		t.Errorf("logged %d records, want %d", got, maxLoggedAnswers)
+	}
+	if !strings.HasSuffix(formatted, "; ... 2 more") {
+		t.Errorf("got %q, want the remaining records counted", formatted)
+	}
+}
+
+func TestPerUpstreamQueryLogging(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+`
+[routes]
+"*.flaky.test" = "secondary"
+
+[upstreams.secondary]
+address = "127.0.0.1"
+port = 53
+log_queries = true
+`)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	startNamedTestUpstream(t, config, "secondary", func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.2", 60))
+	})
+	server := newTestServer(t, config)
+	logs := captureLog(t)
+
+	ask(server, "quiet.test", dns.TypeA)
+	ask(server, "www.flaky.test", dns.TypeA)
+
+	if !strings.Contains(logs.String(), "Upstream secondary query: www.flaky.test, Type: A, Rcode: NOERROR, Records: [A 60 192.0.2.2]") {
+		t.Errorf("the flagged upstream's query was not logged: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "quiet.test") {
+		t.Errorf("the unflagged upstream's query was logged: %q", logs.String())
+	}
+}
+
+func TestRecordNoteInQueryLog(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "noted.test", Type: "A", Value: "192.0.2.1", TTL: 60, Note: "pinned for the migration"},
+		RecordEntry{Domain: "plain.test", Type: "A", Value: "192.0.2.2", TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig("log_queries = true")))
+	logs := captureLog(t)
+
+	ask(server, "noted.test", dns.TypeA)
+	ask(server, "plain.test", dns.TypeA)
+
+	if !strings.Contains(logs.String(), "Response for noted.test from local records: A (record noted.test A, note: pinned for the migration)") {
+		t.Errorf("note not logged for the noted record:\n%s", logs.String())
+	}
+	if strings.Count(logs.String(), "note:") != 1 {
+		t.Errorf("want a note only for the noted record:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxTrackedClients is the number of client buckets kept before idle ones are pruned
+const maxTrackedClients = 10000
+
+// Responses sent to clients that exceed the rate limit
+const (
+	RateLimitRefuse   = "refuse"
+	RateLimitDrop     = "drop"
+	RateLimitTruncate = "truncate"
+	RateLimitServFail = "servfail"
+)
+
+// RateLimiter limits the query rate of each client using token buckets
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	clients map[string]*tokenBucket
+
+	mu sync.Mutex
+}
+
+// tokenBucket tracks the available tokens for a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter allowing rate queries per second with the given burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow reports whether the client may send another query now
+func (l *RateLimiter) Allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxTrackedClients {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = bucket
+	}
+
+	// Refill tokens for the time elapsed since the last query
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Wait blocks until the client may send another query, for at most maxWait
+// Returns false if the client was not allowed a query within maxWait
+func (l *RateLimiter) Wait(client string, maxWait time.Duration) bool {
+	deadline := time.Now().Add(maxWait)
+	interval := time.Duration(float64(time.Second) / l.rate)
+
+	for !l.Allow(client) {
+		if time.Now().Add(interval).After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
+	}
+
+	return true
+}
+
+// prune removes buckets that have been idle long enough to be full again
+func (l *RateLimiter) prune(now time.Time) {
+	for client, bucket := range l.clients {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// InFlightTracker counts the queries each client has in flight
+type InFlightTracker struct {
+	clients map[string]int
+
+	// Guards clients
+	mu sync.Mutex
+}
+
+// NewInFlightTracker creates a tracker with no queries in flight
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{clients: make(map[string]int)}
+}
+
+// Acquire counts a new query from the client unless it already has limit queries in flight
+// Every successful Acquire must be followed by a Release
+func (t *InFlightTracker) Acquire(client string, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients[client] >= limit {
+		return false
+	}
+
+	t.clients[client]++
+	return true
+}
+
+// Release marks a query from the client as finished
+func (t *InFlightTracker) Release(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Drop idle clients so the map only holds clients with queries in flight
+	if t.clients[client] <= 1 {
+		delete(t.clients, client)
+		return
+	}
+	t.clients[client]--
+}
+
+// sendRateLimited answers an over-limit client according to the configured response
+// Only UDP clients can retry a truncated reply over TCP, clients of other
+// transports are refused instead
+func (s *DNSServer) sendRateLimited(w dns.ResponseWriter, r *dns.Msg, transport string) {
+	m := new(dns.Msg)
+
+	switch s.currentConfig().RateLimit.Response {
+	case RateLimitDrop:
+		return
+	case RateLimitTruncate:
+		if transport != TransportUDP {
+			m.SetRcode(r, dns.RcodeRefused)
+			break
+		}
+		// An empty truncated reply makes the client retry over TCP
+		m.SetReply(r)
+		m.Truncated = true
+	case RateLimitServFail:
+		m.SetRcode(r, dns.RcodeServerFailure)
+	default:
+		m.SetRcode(r, dns.RcodeRefused)
+	}
+
+	w.WriteMsg(m)
+}
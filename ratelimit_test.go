@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimitResponses(t *testing.T) {
+	tests := []struct {
+		response  string
+		written   bool
+		rcode     int
+		truncated bool
+	}{
+		{RateLimitRefuse, true, dns.RcodeRefused, false},
+		{RateLimitServFail, true, dns.RcodeServerFailure, false},
+		{RateLimitTruncate, true, dns.RcodeSuccess, true},
+		{RateLimitDrop, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.response, func(t *testing.T) {
+			setTestRecords(t, RecordEntry{Domain: "limited.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+			config := loadTestConfig(t, testConfig+"\n[rate_limit]\nqueries_per_second = 1\nburst = 1\nresponse = \""+tt.response+"\"\n")
+			server := newTestServer(t, config)
+
+			if m := ask(server, "limited.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+				t.Fatalf("first query got %v, want the answer", m)
+			}
+
+			m := ask(server, "limited.test", dns.TypeA)
+			if !tt.written {
+				if m != nil {
+					t.Errorf("got %v, want no response", m)
+				}
+				return
+			}
+			if m == nil || m.Rcode != tt.rcode || m.Truncated != tt.truncated || len(m.Answer) != 0 {
+				t.Errorf("got %v, want rcode %s truncated %v and no answers", m, dns.RcodeToString[tt.rcode], tt.truncated)
+			}
+		})
+	}
+}
+
+func TestRateLimitTruncateRefusesTCP(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "limited.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	config := loadTestConfig(t, testConfig+"\n[rate_limit]\nqueries_per_second = 1\nburst = 1\nresponse = \"truncate\"\n")
+	server := newTestServer(t, config)
+
+	for i, want := range []int{dns.RcodeSuccess, dns.RcodeRefused} {
+		w := newTestWriter("10.0.0.1", true)
+		server.handleRequest(w, query("limited.test", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != want || w.msg.Truncated {
+			t.Errorf("query %d: got %v, want %s without TC", i+1, w.msg, dns.RcodeToString[want])
+		}
+	}
+}
+
+func TestMaxInFlightRefusesExtraConcurrentQueries(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[rate_limit]\nmax_in_flight = 2\nresponse = \"refuse\"\n")
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 10)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		arrived <- struct{}{}
+		<-release
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	// Hold the client's allowance with slow queries
+	held := make(chan *dns.Msg, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			held <- ask(server, "slow"+strconv.Itoa(i)+".test", dns.TypeA)
+		}(i)
+		<-arrived
+	}
+
+	if m := ask(server, "extra.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("got %v, want the query past the limit refused", m)
+	}
+
+	// Other clients are not affected
+	other := make(chan *dns.Msg, 1)
+	go func() {
+		w := newTestWriter("10.0.0.2", false)
+		server.handleRequest(w, query("other.test", dns.TypeA))
+		other <- w.msg
+	}()
+	<-arrived
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if m := <-held; m == nil || len(m.Answer) != 1 {
+			t.Errorf("held query got %v, want the answer", m)
+		}
+	}
+	if m := <-other; m == nil || len(m.Answer) != 1 {
+		t.Errorf("other client got %v, want the answer", m)
+	}
+
+	// Completed queries free the client's allowance
+	if m := ask(server, "again.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v after the held queries completed, want the answer", m)
+	}
+}
+
+func TestEgressRateLimitThrottlesUpstream(t *testing.T) {
+	config := loadTestConfig(t, testConfig+"rate_limit = 2\n")
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	send := func() error {
+		_, err := server.exchangeWithUpstream("primary", query("egress.test", dns.TypeA))
+		return err
+	}
+
+	// A burst of one second's worth of queries is sent, the rest are shed
+	for i := 0; i < 5; i++ {
+		err := send()
+		if i < 2 && err != nil {
+			t.Fatalf("query %d within the limit failed: %v", i, err)
+		}
+		if i >= 2 && err == nil {
+			t.Errorf("query %d past the limit was sent", i)
+		}
+	}
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("upstream received %d queries, want 2", got)
+	}
+
+	// The allowance refills at the configured rate
+	time.Sleep(600 * time.Millisecond)
+	if err := send(); err != nil {
+		t.Errorf("query after the refill failed: %v", err)
+	}
+	if err := send(); err == nil {
+		t.Error("second query before the next refill was sent")
+	}
+	if got := hits.Load(); got != 3 {
+		t.Errorf("upstream received %d queries, want 3", got)
+	}
+}
+
+func TestEgressRateLimitCountsRetries(t *testing.T) {
+	config := loadTestConfig(t, testConfig+"rate_limit = 2\n")
+	var hits atomic.Int32
+	startDualTestUpstream(t, config, "primary", func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		truncatedOverUDP(w, r)
+	})
+	server := newTestServer(t, config)
+
+	// The truncated UDP answer and its TCP retry use up the burst of two
+	response, err := server.exchangeWithUpstream("primary", query("egress.test", dns.TypeA))
+	if err != nil || response.Truncated || len(response.Answer) != 1 {
+		t.Fatalf("got %v, %v; want the full answer from the TCP retry", response, err)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("upstream received %d queries, want 2", got)
+	}
+
+	if _, err := server.exchangeWithUpstream("primary", query("egress.test", dns.TypeA)); err == nil ||
+		!strings.Contains(err.Error(), "over its rate limit") {
+		t.Errorf("got %v, want the next query shed by the rate limit", err)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream received %d queries, want no more than 2", got)
+	}
+}
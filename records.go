@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Handling of records that share a domain and type
+const (
+	DuplicateWarn  = "warn"
+	DuplicateError = "error"
+	DuplicateMerge = "merge"
+)
+
+// Handling of names with a CNAME and records of other types, which DNS forbids
+const (
+	CNAMEConflictWarn  = "warn"
+	CNAMEConflictError = "error"
+)
+
+// Handling of a records reload that fails, the last good records are kept either way
+const (
+	ReloadFailureKeepServing = "keep-serving"
+	ReloadFailureDegrade     = "degrade"
+)
+
+// TombstoneType is the record type of tombstones, which answer NXDOMAIN for
+// a removed name of any type until their not_after time
+const TombstoneType = "TOMBSTONE"
+
+// recordsLoader loads a records file and the files it includes
+type recordsLoader struct {
+	// Absolute paths of files already loaded, in load order
+	files  []string
+	loaded map[string]bool
+}
+
+// newRecordsLoader creates a loader with no files loaded
+func newRecordsLoader() *recordsLoader {
+	return &recordsLoader{loaded: make(map[string]bool)}
+}
+
+// load decodes a records file and recursively merges its includes
+// stack holds the files currently being loaded, to detect include cycles
+func (l *recordsLoader) load(filePath string, stack []string) ([]RecordEntry, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", filePath, err)
+	}
+
+	for _, parent := range stack {
+		if parent == absPath {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), absPath)
+		}
+	}
+
+	// A file included from several places is only merged once
+	if l.loaded[absPath] {
+		return nil, nil
+	}
+	l.loaded[absPath] = true
+	l.files = append(l.files, absPath)
+
+	config := &RecordsConfig{}
+	if _, err := toml.DecodeFile(absPath, config); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", filePath, err)
+	}
+
+	for i := range config.Records {
+		if err := prepareRecord(&config.Records[i]); err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		qualifyRecordTarget(&config.Records[i], config.Origin)
+	}
+
+	records := config.Records
+	stack = append(stack, absPath)
+
+	for _, pattern := range config.Include {
+		paths, err := expandInclude(filepath.Dir(absPath), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+
+		for _, path := range paths {
+			included, err := l.load(path, stack)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, included...)
+		}
+	}
+
+	return records, nil
+}
+
+// prepareRecord parses a record's client networks and validity window and
+// checks the settings that cannot be combined
+func prepareRecord(record *RecordEntry) error {
+	if err := record.parseClientNets(); err != nil {
+		return err
+	}
+	if err := record.parseValidity(); err != nil {
+		return err
+	}
+	if record.Type == TombstoneType && record.NotAfter == "" {
+		return fmt.Errorf("tombstone %s requires not_after", record.Domain)
+	}
+	if record.Type == "CNAME" && len(record.Values) > 0 {
+		return fmt.Errorf("CNAME %s cannot have multiple values", record.Domain)
+	}
+	for transport := range record.Transport {
+		if !validTransport(transport) {
+			return fmt.Errorf("%s %s has an override for unknown transport %s", record.Domain, record.Type, transport)
+		}
+	}
+	return nil
+}
+
+// expandInclude resolves an include entry relative to the including file's
+// directory, expanding glob patterns in sorted order
+func expandInclude(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+
+	// filepath.Glob returns matches in lexical order
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+	}
+
+	return paths, nil
+}
+
+// duplicateKey identifies records that answer the same name, type and clients
+// at the same time, so that only one of them can ever be served
+func duplicateKey(record *RecordEntry) string {
+	return strings.Join([]string{
+		normalizeName(record.Domain),
+		record.Type,
+		fmt.Sprint(record.CatchAll),
+		strings.Join(record.AllowClients, ","),
+		strings.Join(record.DenyClients, ","),
+		record.NotBefore,
+		record.NotAfter,
+	}, "|")
+}
+
+// applyDuplicatePolicy warns about, rejects, or merges duplicate records
+// Merged records keep the first record's settings and the lowest TTL
+func applyDuplicatePolicy(records []RecordEntry, policy string) ([]RecordEntry, error) {
+	result := make([]RecordEntry, 0, len(records))
+	seen := make(map[string]int)
+
+	for _, record := range records {
+		key := duplicateKey(&record)
+		index, duplicate := seen[key]
+		if !duplicate {
+			seen[key] = len(result)
+			result = append(result, record)
+			continue
+		}
+
+		switch policy {
+		case DuplicateError:
+			return nil, fmt.Errorf("duplicate %s record for %s", record.Type, record.Domain)
+		case DuplicateMerge:
+			if record.Type == "CNAME" {
+				return nil, fmt.Errorf("cannot merge duplicate CNAME records for %s", record.Domain)
+			}
+
+			merged := &result[index]
+			for _, value := range record.AllValues() {
+				if !slices.Contains(merged.AllValues(), value) {
+					merged.Values = append(merged.Values, value)
+				}
+			}
+			if record.TTL < merged.TTL {
+				merged.TTL = record.TTL
+			}
+		default:
+			log.Printf("Warning: duplicate %s record for %s, only the first one is served", record.Type, record.Domain)
+			result = append(result, record)
+		}
+	}
+
+	return result, nil
+}
+
+// checkCNAMEConflicts warns about or rejects names that have a CNAME record
+// alongside records of other types
+func checkCNAMEConflicts(records []RecordEntry, policy string) error {
+	types := make(map[string][]string)
+	for _, record := range records {
+		if record.Type == TombstoneType {
+			continue
+		}
+
+		name := normalizeName(record.Domain)
+		if !slices.Contains(types[name], record.Type) {
+			types[name] = append(types[name], record.Type)
+		}
+	}
+
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if !slices.Contains(types[name], "CNAME") || len(types[name]) == 1 {
+			continue
+		}
+
+		others := slices.DeleteFunc(slices.Clone(types[name]), func(t string) bool { return t == "CNAME" })
+		if policy == CNAMEConflictError {
+			return fmt.Errorf("%s has a CNAME record alongside %s records", name, strings.Join(others, ", "))
+		}
+		log.Printf("Warning: %s has a CNAME record alongside %s records, the CNAME only answers the other types",
+			name, strings.Join(others, ", "))
+	}
+
+	return nil
+}
+
+// overrideRecords replaces the records of base that share a domain and type
+// with a record in overrides, and appends the overrides
+func overrideRecords(base, overrides []RecordEntry) []RecordEntry {
+	overridden := make(map[string]bool, len(overrides))
+	for i := range overrides {
+		overridden[normalizeName(overrides[i].Domain)+"|"+overrides[i].Type] = true
+	}
+
+	result := make([]RecordEntry, 0, len(base)+len(overrides))
+	for _, record := range base {
+		if !overridden[normalizeName(record.Domain)+"|"+record.Type] {
+			result = append(result, record)
+		}
+	}
+
+	return append(result, overrides...)
+}
+
+// recordVersion identifies a record together with everything it answers with
+func recordVersion(record *RecordEntry) string {
+	return fmt.Sprintf("%s|%q|%d|%t|%t|%v", duplicateKey(record), record.AllValues(), record.TTL, record.FixedTTL, record.NoData, record.Transport)
+}
+
+// changedRecords returns the records present in only one of previous and current
+func changedRecords(previous, current []RecordEntry) []RecordEntry {
+	oldVersions := make(map[string]bool, len(previous))
+	for i := range previous {
+		oldVersions[recordVersion(&previous[i])] = true
+	}
+
+	newVersions := make(map[string]bool, len(current))
+	changed := []RecordEntry{}
+	for i := range current {
+		version := recordVersion(&current[i])
+		newVersions[version] = true
+		if !oldVersions[version] {
+			changed = append(changed, current[i])
+		}
+	}
+
+	for i := range previous {
+		if !newVersions[recordVersion(&previous[i])] {
+			changed = append(changed, previous[i])
+		}
+	}
+
+	return changed
+}
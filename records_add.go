@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// maxAddRecordBody bounds the size of a record posted to the admin API
+const maxAddRecordBody = 64 << 10
+
+// handleRecordsAdd adds a record posted as JSON to the records file
+// The record gets the checks records files get on load, so a record that
+// would fail a reload is rejected before it reaches the live set
+func (s *DNSServer) handleRecordsAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	config := s.currentConfig().Server
+	if config.RecordsDB != "" {
+		http.Error(w, "records are served from records_db, add them to the database", http.StatusConflict)
+		return
+	}
+
+	var record RecordEntry
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAddRecordBody)).Decode(&record); err != nil {
+		http.Error(w, "invalid record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAddedRecord(&record, s.records.All(), config); err != nil {
+		http.Error(w, "invalid record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.recordsAddMu.Lock()
+	defer s.recordsAddMu.Unlock()
+
+	original, err := appendRecord(config.RecordsFile, record)
+	if err != nil {
+		log.Printf("Error adding %s %s record: %v", record.Domain, record.Type, err)
+		http.Error(w, "failed to add record", http.StatusInternalServerError)
+		return
+	}
+
+	// A record the records no longer load with is taken out of the file again
+	changed, err := LoadRecords(config)
+	if err != nil {
+		if err := os.WriteFile(config.RecordsFile, original, 0o644); err != nil {
+			log.Printf("Error restoring records file %s: %v", config.RecordsFile, err)
+		}
+		http.Error(w, "invalid record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.RecordsChanged(changed)
+
+	log.Printf("Added %s %s record through the admin API", record.Domain, record.Type)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(record)
+}
+
+// validateAddedRecord applies the load-time checks to a record added through
+// the admin API alongside the existing records
+func validateAddedRecord(record *RecordEntry, existing []RecordEntry, config ServerConfig) error {
+	if record.Domain == "" || record.Type == "" {
+		return fmt.Errorf("domain and type are required")
+	}
+
+	if err := prepareRecord(record); err != nil {
+		return err
+	}
+
+	minTTL, maxTTL := recordTTLRange(config)
+	if err := ValidateRecordTTL(record, minTTL, maxTTL); err != nil {
+		return err
+	}
+
+	// Only the added record's name can gain a CNAME conflict
+	name := normalizeName(record.Domain)
+	sameName := []RecordEntry{*record}
+	for _, other := range existing {
+		if normalizeName(other.Domain) == name {
+			sameName = append(sameName, other)
+		}
+	}
+	return checkCNAMEConflicts(sameName, config.CNAMEConflictPolicy)
+}
+
+// appendRecord appends a record to the records file and returns the file's
+// previous contents
+func appendRecord(filePath string, record RecordEntry) ([]byte, error) {
+	original, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read records file: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(original)
+	if len(original) > 0 {
+		if !bytes.HasSuffix(original, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+	}
+	if err := toml.NewEncoder(&buf).Encode(struct {
+		Records []RecordEntry `toml:"records"`
+	}{[]RecordEntry{record}}); err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	if err := os.WriteFile(filePath, buf.Bytes(), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write records file: %w", err)
+	}
+	return original, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loadedDomains returns the sorted domains of loaded records
+func loadedDomains(records []RecordEntry) []string {
+	domains := make([]string, 0, len(records))
+	for _, record := range records {
+		domains = append(domains, record.Domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func TestRecordsIncludes(t *testing.T) {
+	dir := t.TempDir()
+	main := writeTestFile(t, dir, "records.toml", "include = [\"sub/level1.toml\", \"zones/*.toml\"]\n"+testRecords("main.test", "192.0.2.1"))
+	writeTestFile(t, filepath.Join(dir, "sub"), "level1.toml", "include = [\"level2.toml\"]\n"+testRecords("one.test", "192.0.2.2"))
+	writeTestFile(t, filepath.Join(dir, "sub"), "level2.toml", testRecords("two.test", "192.0.2.3"))
+	writeTestFile(t, filepath.Join(dir, "zones"), "a.toml", testRecords("a.test", "192.0.2.4"))
+	writeTestFile(t, filepath.Join(dir, "zones"), "b.toml", testRecords("b.test", "192.0.2.5"))
+	writeTestFile(t, filepath.Join(dir, "zones"), "ignored.txt", testRecords("ignored.test", "192.0.2.6"))
+
+	loader := newRecordsLoader()
+	records, err := loader.load(main, nil)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	want := "a.test b.test main.test one.test two.test"
+	if got := strings.Join(loadedDomains(records), " "); got != want {
+		t.Errorf("loaded %s, want %s", got, want)
+	}
+	if len(loader.files) != 5 {
+		t.Errorf("tracked %d files, want 5: %v", len(loader.files), loader.files)
+	}
+}
+
+func TestRecordsIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	main := writeTestFile(t, dir, "records.toml", "include = [\"a.toml\"]\n")
+	writeTestFile(t, dir, "a.toml", "include = [\"b.toml\"]\n")
+	writeTestFile(t, dir, "b.toml", "include = [\"a.toml\"]\n")
+
+	_, err := newRecordsLoader().load(main, nil)
+	if err == nil || !strings.Contains(err.Error(), "include cycle") ||
+		!strings.Contains(err.Error(), filepath.Join(dir, "b.toml")+" -> "+filepath.Join(dir, "a.toml")) {
+		t.Errorf("got error %v, want the include cycle through a.toml and b.toml", err)
+	}
+}
+
+func TestRecordValidityWindow(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "cutover.test", Type: "A", Value: "192.0.2.1", TTL: 60,
+		NotBefore: "2024-01-01T00:00:00Z", NotAfter: "2024-01-02T00:00:00Z"})
+	clock := NewFakeClock(time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC))
+	server := newTestServer(t, loadTestConfig(t, testConfig), WithClock(clock))
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		active  bool
+	}{
+		{"not yet active", 0, false},
+		{"active", 2 * time.Hour, true},
+		{"expired", 24 * time.Hour, false},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		found := server.findRecord("cutover.test", "A", nil) != nil
+		if found != step.active {
+			t.Errorf("%s: record found = %t, want %t", step.name, found, step.active)
+		}
+	}
+}
+
+func TestCatchAllIsLowestTier(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "example.com", Type: "A", Value: "192.0.2.3", TTL: 60, CatchAll: true},
+		RecordEntry{Domain: "_**.dev.example.com", Type: "A", Value: "192.0.2.2", TTL: 60},
+		RecordEntry{Domain: "www.example.com", Type: "A", Value: "192.0.2.1", TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "192.0.2.1"},
+		{"api.dev.example.com", "192.0.2.2"},
+		{"other.example.com", "192.0.2.3"},
+		{"example.com", "192.0.2.3"},
+	}
+	for _, tt := range tests {
+		record := server.findRecord(tt.name, "A", nil)
+		if record == nil || record.Value != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, record, tt.want)
+		}
+	}
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	duplicates := func() []RecordEntry {
+		return []RecordEntry{
+			{Domain: "dup.test", Type: "A", Value: "192.0.2.1", TTL: 300},
+			{Domain: "DUP.test.", Type: "A", Value: "192.0.2.2", TTL: 60},
+		}
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		logs := captureLog(t)
+		records, err := applyDuplicatePolicy(duplicates(), DuplicateWarn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(records) != 2 || records[0].Value != "192.0.2.1" {
+			t.Errorf("got %+v, want both records with the first served", records)
+		}
+		if !strings.Contains(logs.String(), "duplicate A record for DUP.test.") {
+			t.Errorf("expected a duplicate warning, got %q", logs.String())
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		if _, err := applyDuplicatePolicy(duplicates(), DuplicateError); err == nil {
+			t.Error("expected the duplicate to be rejected")
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		records, err := applyDuplicatePolicy(duplicates(), DuplicateMerge)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("got %d records, want one merged record", len(records))
+		}
+		if values := records[0].AllValues(); !reflect.DeepEqual(values, []string{"192.0.2.1", "192.0.2.2"}) || records[0].TTL != 60 {
+			t.Errorf("got values %v with ttl %d, want both values with the lowest ttl", values, records[0].TTL)
+		}
+	})
+}
+
+func TestCNAMEConflictPolicies(t *testing.T) {
+	conflicting := testRecords("www.test", "192.0.2.1") +
+		"[[records]]\ndomain = \"www.test\"\ntype = \"CNAME\"\nvalue = \"other.test\"\nttl = 60\n"
+
+	t.Run("error", func(t *testing.T) {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig(`cname_conflict_policy = "error"`))
+		config.Server.RecordsFile = writeTestFile(t, t.TempDir(), "records.toml", conflicting)
+
+		_, err := LoadRecords(config.Server)
+		if err == nil || !strings.Contains(err.Error(), "www.test has a CNAME record alongside A records") {
+			t.Errorf("got %v, want the conflict rejected", err)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig(`cname_conflict_policy = "warn"`))
+		config.Server.RecordsFile = writeTestFile(t, t.TempDir(), "records.toml", conflicting)
+		logs := captureLog(t)
+
+		if _, err := LoadRecords(config.Server); err != nil {
+			t.Fatalf("LoadRecords: %v", err)
+		}
+		if record := FindMatchingRecord("www.test", "A", nil, time.Now()); record == nil || record.Value != "192.0.2.1" {
+			t.Errorf("got %v, want the A record loaded", record)
+		}
+		if !strings.Contains(logs.String(), "Warning: www.test has a CNAME record alongside A records") {
+			t.Errorf("expected a conflict warning, got %q", logs.String())
+		}
+	})
+}
+
+func TestRecordsFilesOverrideBase(t *testing.T) {
+	setTestRecords(t)
+	dir := t.TempDir()
+	config := loadTestConfig(t, testConfig)
+	config.Server.RecordsFile = writeTestFile(t, dir, "base.toml",
+		testRecords("shared.test", "192.0.2.1")+testRecords("base.test", "192.0.2.10"))
+	config.Server.RecordsFiles = []string{
+		writeTestFile(t, dir, "staging.toml", testRecords("shared.test", "192.0.2.2")),
+		writeTestFile(t, dir, "local.toml", testRecords("shared.test", "192.0.2.3")),
+	}
+
+	if _, err := LoadRecords(config.Server); err != nil {
+		t.Fatalf("LoadRecords: %v", err)
+	}
+
+	now := time.Now()
+	if record := FindMatchingRecord("shared.test", "A", nil, now); record == nil || record.Value != "192.0.2.3" {
+		t.Errorf("got %v, want the last override file's record", record)
+	}
+	if record := FindMatchingRecord("base.test", "A", nil, now); record == nil || record.Value != "192.0.2.10" {
+		t.Errorf("got %v, want the base record without an override", record)
+	}
+}
+
+func TestTombstoneForcesNXDomainUntilExpiry(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "removed.test", Type: TombstoneType, NotAfter: "2024-01-02T00:00:00Z"})
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	config := loadTestConfig(t, testConfig)
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config, WithClock(clock))
+
+	m := ask(server, "removed.test", dns.TypeA)
+	if m == nil || m.Rcode != dns.RcodeNameError || !m.Authoritative {
+		t.Errorf("got %v, want authoritative NXDOMAIN for the tombstoned name", m)
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("tombstoned name forwarded %d times", got)
+	}
+
+	clock.Advance(12 * time.Hour)
+	if m := ask(server, "removed.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v after expiry, want the forwarded answer", m)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream queried %d times after expiry, want 1", got)
+	}
+}
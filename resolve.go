@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Cache outcomes reported by the resolve endpoint
+const (
+	CacheStatusHit      = "hit"
+	CacheStatusMiss     = "miss"
+	CacheStatusDisabled = "disabled"
+	CacheStatusBypass   = "bypass"
+)
+
+// defaultResolveClient is the simulated client when the resolve endpoint is given none
+const defaultResolveClient = "127.0.0.1"
+
+// resolveTrace records the decisions made while answering a query
+type resolveTrace struct {
+	LocalRecord *RecordEntry `json:"local_record,omitempty"`
+	Upstream    string       `json:"upstream,omitempty"`
+	Cache       string       `json:"cache,omitempty"`
+}
+
+// ResolveResult describes how a query was answered
+type ResolveResult struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Client string `json:"client"`
+	resolveTrace
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers []string `json:"answers"`
+	// The pipeline did not answer, e.g. the query was rate limited and dropped
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// local records the local record a query was answered from
+func (t *resolveTrace) local(record *RecordEntry) {
+	if t != nil {
+		t.LocalRecord = record
+	}
+}
+
+// upstream records the upstream a query was answered by
+func (t *resolveTrace) upstream(name string) {
+	if t != nil {
+		t.Upstream = name
+	}
+}
+
+// cache records whether a query was answered from the cache
+func (t *resolveTrace) cache(status string) {
+	if t != nil {
+		t.Cache = status
+	}
+}
+
+// handleResolve runs a query through the pipeline for a simulated client and
+// reports how it was answered
+// Lookups may reveal client restrictions and reach upstreams, so they require the admin token
+func (s *DNSServer) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	params := r.URL.Query()
+	name := params.Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	recordType := strings.ToUpper(params.Get("type"))
+	if recordType == "" {
+		recordType = "A"
+	}
+	qtype, ok := dns.StringToType[recordType]
+	if !ok {
+		http.Error(w, "unknown record type: "+recordType, http.StatusBadRequest)
+		return
+	}
+
+	client := params.Get("client")
+	if client == "" {
+		client = defaultResolveClient
+	}
+	clientIP := unmapIP(net.ParseIP(client))
+	if clientIP == nil {
+		http.Error(w, "invalid client address: "+client, http.StatusBadRequest)
+		return
+	}
+
+	result := s.Resolve(dns.Fqdn(name), qtype, clientIP)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error encoding resolve result: %v", err)
+	}
+}
+
+// Resolve answers a query as the pipeline would for a UDP client and
+// returns the response along with the decisions that produced it
+func (s *DNSServer) Resolve(name string, qtype uint16, clientIP net.IP) ResolveResult {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+
+	writer := &dohResponseWriter{
+		local:  &net.UDPAddr{},
+		remote: &net.UDPAddr{IP: clientIP},
+	}
+	rc := &requestContext{
+		clientIP:  clientIP,
+		transport: TransportUDP,
+		trace:     &resolveTrace{},
+	}
+	s.currentPipeline()(writer, query, rc)
+
+	result := ResolveResult{
+		Name:         name,
+		Type:         dns.TypeToString[qtype],
+		Client:       clientIP.String(),
+		resolveTrace: *rc.trace,
+		Answers:      []string{},
+	}
+	if writer.msg == nil {
+		result.Dropped = true
+		return result
+	}
+
+	result.Rcode = dns.RcodeToString[writer.msg.Rcode]
+	for _, rr := range writer.msg.Answer {
+		result.Answers = append(result.Answers, rr.String())
+	}
+
+	return result
+}
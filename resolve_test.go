@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getResolve calls the resolve endpoint and decodes its result
+func getResolve(t *testing.T, server *DNSServer, target string) ResolveResult {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var result ResolveResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	return result
+}
+
+func TestResolveSimulatesClient(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "office.test", Type: "A", Value: "10.1.1.1", TTL: 60, AllowClients: []string{"10.0.0.0/8"}})
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	inside := getResolve(t, server, "/resolve?name=office.test&client=10.2.3.4")
+	if inside.LocalRecord == nil || inside.Upstream != "" {
+		t.Errorf("inside client: got record %+v upstream %q, want the local record", inside.LocalRecord, inside.Upstream)
+	}
+
+	// The name is hidden from other clients rather than forwarded
+	outside := getResolve(t, server, "/resolve?name=office.test&client=203.0.113.5")
+	if outside.LocalRecord != nil || outside.Upstream != "" || outside.Rcode != "NXDOMAIN" {
+		t.Errorf("outside client: got record %+v upstream %q rcode %s, want NXDOMAIN", outside.LocalRecord, outside.Upstream, outside.Rcode)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reverseTemplateIP is replaced with the queried address, dashed, in reverse synthesis templates
+const reverseTemplateIP = "{ip}"
+
+// Suffixes of reverse lookup names
+const (
+	reverseSuffixIPv4 = ".in-addr.arpa"
+	reverseSuffixIPv6 = ".ip6.arpa"
+)
+
+// validateReverseSynthesis parses the network of every reverse synthesis rule
+// and checks that its template yields valid names
+func validateReverseSynthesis(rules []ReverseSynthesisRule) error {
+	for i := range rules {
+		_, network, err := net.ParseCIDR(rules[i].Network)
+		if err != nil {
+			return fmt.Errorf("reverse_synthesis has invalid network %q: %w", rules[i].Network, err)
+		}
+		rules[i].network = network
+
+		if rules[i].Template == "" {
+			continue
+		}
+		example := expandReverseTemplate(rules[i].Template, network.IP)
+		if _, ok := dns.IsDomainName(example); !ok {
+			return fmt.Errorf("reverse_synthesis %s: template %q does not yield a valid name", rules[i].Network, rules[i].Template)
+		}
+	}
+
+	return nil
+}
+
+// expandReverseTemplate fills a reverse synthesis template for an address
+// Dots and colons in the address become dashes so it forms a single label
+func expandReverseTemplate(template string, ip net.IP) string {
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return dns.Fqdn(strings.ReplaceAll(template, reverseTemplateIP, dashed))
+}
+
+// reverseNameIP returns the address a reverse lookup name refers to, or nil
+// when the name is not a complete in-addr.arpa or ip6.arpa name
+func reverseNameIP(name string) net.IP {
+	name = normalizeName(name)
+
+	if labels, ok := strings.CutSuffix(name, reverseSuffixIPv4); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+			octets[i], octets[j] = octets[j], octets[i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+
+	if labels, ok := strings.CutSuffix(name, reverseSuffixIPv6); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != net.IPv6len*2 {
+			return nil
+		}
+
+		var hex strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			hex.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				hex.WriteByte(':')
+			}
+		}
+		return net.ParseIP(hex.String())
+	}
+
+	return nil
+}
+
+// handleReverseSynthesis answers PTR queries for addresses in a reverse
+// synthesis network with the rule's templated name, or NXDOMAIN without a template
+// Returns true if a response was sent
+func (s *DNSServer) handleReverseSynthesis(w dns.ResponseWriter, r *dns.Msg, q dns.Question) bool {
+	if q.Qtype != dns.TypePTR {
+		return false
+	}
+
+	rules := s.currentConfig().ReverseSynthesis
+	if len(rules) == 0 {
+		return false
+	}
+
+	ip := reverseNameIP(q.Name)
+	if ip == nil {
+		return false
+	}
+
+	for _, rule := range rules {
+		if rule.network == nil || !rule.network.Contains(ip) {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+
+		if rule.Template == "" {
+			m.Rcode = dns.RcodeNameError
+			if zone := s.findOwnedZone(getDomainFromQuestion(q)); zone != nil {
+				m.Ns = append(m.Ns, s.ownedZoneSOA(zone))
+			}
+		} else {
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(rule.TTL)},
+				Ptr: expandReverseTemplate(rule.Template, ip),
+			})
+		}
+
+		w.WriteMsg(m)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseSynthesis(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "5.1.168.192.in-addr.arpa", Type: "PTR", Value: "printer.example.com", TTL: 60})
+	config := loadTestConfig(t, testConfig+`
+[[reverse_synthesis]]
+network = "192.168.1.0/24"
+template = "host-{ip}.example.com"
+ttl = 300
+
+[[reverse_synthesis]]
+network = "2001:db8::/64"
+template = "v6-{ip}.example.com"
+ttl = 300
+
+[[reverse_synthesis]]
+network = "10.99.0.0/16"
+`)
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	server := newTestServer(t, config)
+
+	tests := []struct {
+		name  string
+		rcode int
+		ptr   string
+	}{
+		{"7.1.168.192.in-addr.arpa", dns.RcodeSuccess, "host-192-168-1-7.example.com."},
+		{"5.1.168.192.in-addr.arpa", dns.RcodeSuccess, "printer.example.com."},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", dns.RcodeSuccess, "v6-2001-db8--1.example.com."},
+		{"3.2.99.10.in-addr.arpa", dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		m := ask(server, tt.name, dns.TypePTR)
+		if m == nil || m.Rcode != tt.rcode {
+			t.Errorf("%s: got %v, want rcode %s", tt.name, m, dns.RcodeToString[tt.rcode])
+			continue
+		}
+		if tt.ptr == "" {
+			continue
+		}
+		if len(m.Answer) != 1 {
+			t.Errorf("%s: got answers %v, want one PTR", tt.name, m.Answer)
+			continue
+		}
+		if ptr, ok := m.Answer[0].(*dns.PTR); !ok || ptr.Ptr != tt.ptr {
+			t.Errorf("%s: got %v, want PTR %s", tt.name, m.Answer[0], tt.ptr)
+		}
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream queried %d times for addresses in synthesis networks", got)
+	}
+
+	// Addresses outside every network are forwarded
+	ask(server, "1.0.0.172.in-addr.arpa", dns.TypePTR)
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream queried %d times, want the unmatched address forwarded", got)
+	}
+}
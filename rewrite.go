@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteQueryName returns the rewritten name for a query name, if a rule matches
+// Rules match an exact name, or with a leading "*." any name below a suffix,
+// in which case the prefix labels are kept. Rules limited to a transport
+// only apply to queries arriving over it
+func rewriteQueryName(rules []QNameRewrite, name, transport string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for _, rule := range rules {
+		if rule.Transport != "" && rule.Transport != transport {
+			continue
+		}
+
+		match := strings.ToLower(dns.Fqdn(rule.Match))
+		replace := strings.ToLower(dns.Fqdn(rule.Replace))
+
+		if suffix, ok := strings.CutPrefix(match, "*."); ok {
+			if prefix, found := strings.CutSuffix(name, "."+suffix); found {
+				return prefix + "." + strings.TrimPrefix(replace, "*."), true
+			}
+			continue
+		}
+
+		if name == match {
+			return replace, true
+		}
+	}
+
+	return "", false
+}
+
+// validateRewriteRules checks that wildcard rules map to wildcard replacements
+// and that transports are known
+func validateRewriteRules(rules []QNameRewrite) error {
+	for _, rule := range rules {
+		if rule.Match == "" || rule.Replace == "" {
+			return fmt.Errorf("qname_rewrite requires match and replace")
+		}
+
+		if strings.HasPrefix(rule.Match, "*.") != strings.HasPrefix(rule.Replace, "*.") {
+			return fmt.Errorf("qname_rewrite %s: match and replace must both be wildcards or both be names", rule.Match)
+		}
+
+		if rule.Transport != "" && !validTransport(rule.Transport) {
+			return fmt.Errorf("qname_rewrite %s: unknown transport %s", rule.Match, rule.Transport)
+		}
+	}
+
+	return nil
+}
+
+// rewriteWriter restores the client's original query name in responses
+type rewriteWriter struct {
+	dns.ResponseWriter
+	original  string
+	rewritten string
+}
+
+// WriteMsg rewrites the question and matching owner names back before writing
+func (w *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	for i := range m.Question {
+		if strings.EqualFold(m.Question[i].Name, w.rewritten) {
+			m.Question[i].Name = w.original
+		}
+	}
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, w.rewritten) {
+				rr.Header().Name = w.original
+			}
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewriteQueryName(t *testing.T) {
+	rules := []QNameRewrite{
+		{Match: "old.test", Replace: "new.test"},
+		{Match: "*.legacy.test", Replace: "*.modern.test"},
+		{Match: "doh.test", Replace: "web.test", Transport: "doh"},
+	}
+
+	tests := []struct {
+		name      string
+		transport string
+		want      string
+		ok        bool
+	}{
+		{"OLD.test.", "udp", "new.test.", true},
+		{"a.b.legacy.test", "udp", "a.b.modern.test.", true},
+		{"legacy.test", "udp", "", false},
+		{"doh.test", "udp", "", false},
+		{"doh.test", "doh", "web.test.", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := rewriteQueryName(rules, tt.name, tt.transport)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("rewriteQueryName(%s, %s) = %q, %v, want %q, %v", tt.name, tt.transport, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRewrittenQueryAnsweredUnderOriginalName(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[[qname_rewrite]]\nmatch = \"*.legacy.test\"\nreplace = \"*.modern.test\"\n")
+	var mu sync.Mutex
+	var forwarded string
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		forwarded = r.Question[0].Name
+		mu.Unlock()
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	m := ask(server, "www.legacy.test", dns.TypeA)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if forwarded != "www.modern.test." {
+		t.Errorf("upstream was asked for %q, want www.modern.test.", forwarded)
+	}
+	if m == nil || len(m.Answer) != 1 {
+		t.Fatalf("got %v, want one answer", m)
+	}
+	if m.Question[0].Name != "www.legacy.test." || m.Answer[0].Header().Name != "www.legacy.test." {
+		t.Errorf("got question %s and answer %s, want both under www.legacy.test.", m.Question[0].Name, m.Answer[0].Header().Name)
+	}
+}
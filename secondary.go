@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// SecondaryZones holds records transferred from primary servers, keyed by zone
+type SecondaryZones struct {
+	Zones map[string][]RecordEntry
+
+	// Zones with a transfer currently in progress
+	refreshing map[string]bool
+	// Primaries to transfer from again once the running transfer finishes,
+	// keyed by zone, for NOTIFYs that arrived during it
+	pending map[string]string
+
+	// Guards Zones, refreshing and pending
+	mu sync.RWMutex
+}
+
+// Global secondary zone data
+var Secondaries = &SecondaryZones{
+	Zones:      make(map[string][]RecordEntry),
+	refreshing: make(map[string]bool),
+	pending:    make(map[string]string),
+}
+
+// findSecondaryConfig returns the secondary zone configuration for a zone name
+func (s *DNSServer) findSecondaryConfig(zone string) *SecondaryConfig {
+	zone = normalizeName(zone)
+
+	config := s.currentConfig()
+	for i := range config.Secondaries {
+		if normalizeName(config.Secondaries[i].Zone) == zone {
+			return &config.Secondaries[i]
+		}
+	}
+
+	return nil
+}
+
+// handleNotify processes a NOTIFY message from a primary server
+func (s *DNSServer) handleNotify(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if len(r.Question) == 0 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	zone := getDomainFromQuestion(r.Question[0])
+	source := remoteHost(w.RemoteAddr())
+
+	secondary := s.findSecondaryConfig(zone)
+	if secondary == nil {
+		log.Printf("Ignoring NOTIFY for unknown zone %s from %s", zone, source)
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+
+	primary, ok := secondary.primaryFor(source)
+	if !ok {
+		log.Printf("Ignoring NOTIFY for zone %s from unauthorized source %s", zone, source)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	log.Printf("Received NOTIFY for zone %s from %s", zone, source)
+
+	// Acknowledge the NOTIFY before transferring
+	m.Authoritative = true
+	w.WriteMsg(m)
+
+	go s.refreshZone(secondary.Zone, primary)
+}
+
+// primaryFor returns the primary address matching the given source host
+// Primaries are IP addresses, which LoadConfig checks
+func (c *SecondaryConfig) primaryFor(source string) (string, bool) {
+	sourceIP := net.ParseIP(source)
+	for _, primary := range c.Primaries {
+		addr := primaryAddress(primary)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil && ip.Equal(sourceIP) {
+			return addr, true
+		}
+	}
+
+	return "", false
+}
+
+// primaryAddress returns the host:port address of a primary, defaulting to port 53
+func primaryAddress(primary string) string {
+	if _, _, err := net.SplitHostPort(primary); err == nil {
+		return primary
+	}
+	return net.JoinHostPort(primary, strconv.Itoa(53))
+}
+
+// refreshZone transfers a zone from the given primary and replaces its records
+// A refresh requested while a transfer runs is done once that transfer
+// finishes, as the NOTIFY behind it may announce changes the running
+// transfer does not include
+func (s *DNSServer) refreshZone(zone, primary string) {
+	zone = normalizeName(zone)
+
+	// Only allow one transfer per zone at a time
+	Secondaries.mu.Lock()
+	if Secondaries.refreshing[zone] {
+		Secondaries.pending[zone] = primary
+		Secondaries.mu.Unlock()
+		return
+	}
+	Secondaries.refreshing[zone] = true
+	Secondaries.mu.Unlock()
+
+	for {
+		s.transferAndReplace(zone, primary)
+
+		Secondaries.mu.Lock()
+		next, ok := Secondaries.pending[zone]
+		delete(Secondaries.pending, zone)
+		if !ok {
+			delete(Secondaries.refreshing, zone)
+			Secondaries.mu.Unlock()
+			return
+		}
+		Secondaries.mu.Unlock()
+
+		primary = next
+	}
+}
+
+// transferAndReplace transfers a zone from a primary and swaps in its records
+func (s *DNSServer) transferAndReplace(zone, primary string) {
+	// Queries keep seeing the old records until the whole transfer completes
+	records, err := transferZone(zone, primary)
+	if err != nil {
+		log.Printf("Error transferring zone %s from %s: %v", zone, primary, err)
+		return
+	}
+
+	Secondaries.replaceZone(zone, records)
+
+	log.Printf("Transferred %d records for zone %s from %s", len(records), zone, primary)
+}
+
+// FindRecord returns the most specific transferred record matching a domain
+// and type, preferring the deepest zone on a tie
+// Returns nil if no record matches
+func (z *SecondaryZones) FindRecord(domain string, recordType string) *RecordEntry {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var best *RecordEntry
+	bestZone := ""
+	for zone, records := range z.Zones {
+		for i := range records {
+			record := &records[i]
+			if record.Type != recordType || !MatchDomain(record.Domain, domain) {
+				continue
+			}
+
+			if best == nil || recordSpecificity(record) > recordSpecificity(best) ||
+				(recordSpecificity(record) == recordSpecificity(best) && len(zone) > len(bestZone)) {
+				best, bestZone = record, zone
+			}
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	found := *best
+	return &found
+}
+
+// replaceZone swaps in a complete set of records for a zone
+// The records must not be modified afterwards, so readers holding the lock
+// see either the old or the new zone, never a mix of both
+func (z *SecondaryZones) replaceZone(zone string, records []RecordEntry) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.Zones[zone] = records
+}
+
+// transferZone performs an AXFR of a zone and converts the result into record entries
+func transferZone(zone, primary string) ([]RecordEntry, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+
+	transfer := new(dns.Transfer)
+	env, err := transfer.In(m, primary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transfer: %w", err)
+	}
+
+	records := []RecordEntry{}
+	for e := range env {
+		if e.Error != nil {
+			return nil, fmt.Errorf("transfer failed: %w", e.Error)
+		}
+
+		for _, rr := range e.RR {
+			if record, ok := recordFromRR(rr); ok {
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// recordFromRR converts a resource record into a record entry
+// Returns false for record types that cannot be served locally
+func recordFromRR(rr dns.RR) (RecordEntry, bool) {
+	header := rr.Header()
+	record := RecordEntry{
+		Domain: strings.TrimSuffix(header.Name, "."),
+		Type:   dns.TypeToString[header.Rrtype],
+		TTL:    int(header.Ttl),
+	}
+
+	switch v := rr.(type) {
+	case *dns.A:
+		record.Value = v.A.String()
+	case *dns.AAAA:
+		record.Value = v.AAAA.String()
+	case *dns.CNAME:
+		record.Value = strings.TrimSuffix(v.Target, ".")
+	case *dns.TXT:
+		record.Value = strings.Join(v.Txt, "")
+	case *dns.MX:
+		record.Value = fmt.Sprintf("%d %s", v.Preference, strings.TrimSuffix(v.Mx, "."))
+	case *dns.NS:
+		record.Value = strings.TrimSuffix(v.Ns, ".")
+	case *dns.PTR:
+		record.Value = strings.TrimSuffix(v.Ptr, ".")
+	default:
+		return RecordEntry{}, false
+	}
+
+	return record, true
+}
+
+// remoteHost returns the host part of a remote address
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startStalledPrimary serves an AXFR of zone.test whose first message is sent
+// at once and whose rest waits for release
+// The returned channel receives a value as each transfer sends its first message
+func startStalledPrimary(t *testing.T, release <-chan struct{}) (string, <-chan struct{}) {
+	t.Helper()
+
+	soa, _ := dns.NewRR("zone.test. 3600 IN SOA ns.zone.test. admin.zone.test. 2 3600 600 86400 60")
+	first, _ := dns.NewRR("host.zone.test. 60 IN A 192.0.2.10")
+	second, _ := dns.NewRR("new.zone.test. 60 IN A 192.0.2.11")
+
+	sent := make(chan struct{}, 10)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		ch := make(chan *dns.Envelope)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			new(dns.Transfer).Out(w, r, ch)
+		}()
+
+		ch <- &dns.Envelope{RR: []dns.RR{soa, first}}
+		sent <- struct{}{}
+		<-release
+		ch <- &dns.Envelope{RR: []dns.RR{second, soa}}
+		close(ch)
+		wg.Wait()
+		w.Close()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return listener.Addr().String(), sent
+}
+
+// setTestSecondaryZone installs transferred records for a zone for the duration of a test
+func setTestSecondaryZone(t *testing.T, zone string, records ...RecordEntry) {
+	t.Helper()
+
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	Secondaries.mu.Lock()
+	previous, existed := Secondaries.Zones[zone]
+	Secondaries.Zones[zone] = records
+	Secondaries.mu.Unlock()
+
+	t.Cleanup(func() {
+		Secondaries.mu.Lock()
+		if existed {
+			Secondaries.Zones[zone] = previous
+		} else {
+			delete(Secondaries.Zones, zone)
+		}
+		Secondaries.mu.Unlock()
+	})
+}
+
+// secondaryValue returns the value of the transferred record for name, empty if none
+func secondaryValue(zone, name string) string {
+	Secondaries.mu.RLock()
+	defer Secondaries.mu.RUnlock()
+
+	for _, record := range Secondaries.Zones[zone] {
+		if record.Domain == name {
+			return record.Value
+		}
+	}
+	return ""
+}
+
+// notify builds a NOTIFY message for a zone
+func notify(zone string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetNotify(dns.Fqdn(zone))
+	return m
+}
+
+func TestNotifyFromPrimaryRefreshesZone(t *testing.T) {
+	setTestRecords(t)
+	setTestSecondaryZone(t, "zone.test")
+	release := make(chan struct{})
+	close(release)
+	primary, sent := startStalledPrimary(t, release)
+	server := newTestServer(t, loadTestConfig(t, testConfig+"\n[[secondary]]\nzone = \"zone.test\"\nprimaries = [\""+primary+"\"]\n"))
+
+	w := newTestWriter("127.0.0.1", false)
+	server.handleRequest(w, notify("zone.test"))
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || !w.msg.Authoritative {
+		t.Fatalf("got %v, want an authoritative acknowledgement", w.msg)
+	}
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("NOTIFY did not start a transfer")
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return secondaryValue("zone.test", "new.zone.test") == "192.0.2.11" }) {
+		t.Error("transferred records were not applied")
+	}
+}
+
+func TestNotifyFromUnauthorizedSourceIgnored(t *testing.T) {
+	setTestRecords(t)
+	setTestSecondaryZone(t, "zone.test")
+	release := make(chan struct{})
+	close(release)
+	primary, sent := startStalledPrimary(t, release)
+	server := newTestServer(t, loadTestConfig(t, testConfig+"\n[[secondary]]\nzone = \"zone.test\"\nprimaries = [\""+primary+"\"]\n"))
+
+	w := newTestWriter("10.0.0.9", false)
+	server.handleRequest(w, notify("zone.test"))
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("got %v, want REFUSED", w.msg)
+	}
+	select {
+	case <-sent:
+		t.Error("NOTIFY from an unauthorized source started a transfer")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	w = newTestWriter("127.0.0.1", false)
+	server.handleRequest(w, notify("other.test"))
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNotAuth {
+		t.Errorf("got %v for an unknown zone, want NOTAUTH", w.msg)
+	}
+}
+
+func TestQueriesDuringTransferSeeOldZone(t *testing.T) {
+	setTestRecords(t)
+	setTestSecondaryZone(t, "zone.test", RecordEntry{Domain: "host.zone.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	release := make(chan struct{})
+	primary, sent := startStalledPrimary(t, release)
+	server := newTestServer(t, loadTestConfig(t, testConfig+"\n[[secondary]]\nzone = \"zone.test\"\nprimaries = [\""+primary+"\"]\n"))
+
+	hostAddress := func() string {
+		response := ask(server, "host.zone.test", dns.TypeA)
+		if response == nil || len(response.Answer) != 1 {
+			return ""
+		}
+		return response.Answer[0].(*dns.A).A.String()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.refreshZone("zone.test", primary)
+	}()
+
+	// The first message of the transfer has arrived, the rest is held back
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("transfer did not start")
+	}
+	for i := 0; i < 5; i++ {
+		if got := hostAddress(); got != "192.0.2.1" {
+			close(release)
+			t.Fatalf("mid-transfer query got %q, want the old record 192.0.2.1", got)
+		}
+		if got := secondaryValue("zone.test", "new.zone.test"); got != "" {
+			close(release)
+			t.Fatalf("record %q from the unfinished transfer is visible", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	close(release)
+	<-done
+	if got := hostAddress(); got != "192.0.2.10" {
+		t.Errorf("after the transfer got %q, want the new record 192.0.2.10", got)
+	}
+	if got := secondaryValue("zone.test", "new.zone.test"); got != "192.0.2.11" {
+		t.Errorf("new.zone.test = %q after the transfer, want 192.0.2.11", got)
+	}
+}
+
+func TestNotifyDuringTransferTransfersAgain(t *testing.T) {
+	setTestRecords(t)
+	setTestSecondaryZone(t, "zone.test")
+	release := make(chan struct{})
+	primary, sent := startStalledPrimary(t, release)
+	server := newTestServer(t, loadTestConfig(t, testConfig+"\n[[secondary]]\nzone = \"zone.test\"\nprimaries = [\""+primary+"\"]\n"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.refreshZone("zone.test", primary)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("transfer did not start")
+	}
+
+	// NOTIFYs arriving mid-transfer are coalesced into one more transfer
+	server.refreshZone("zone.test", primary)
+	server.refreshZone("zone.test", primary)
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("transfers did not finish")
+	}
+	if got := len(sent); got != 1 {
+		t.Errorf("got %d transfers after the first, want 1", got)
+	}
+
+	Secondaries.mu.RLock()
+	defer Secondaries.mu.RUnlock()
+	if Secondaries.refreshing["zone.test"] || Secondaries.pending["zone.test"] != "" {
+		t.Error("zone still marked as refreshing after the transfers finished")
+	}
+}
+
+func TestSecondaryPrimaryMustBeIP(t *testing.T) {
+	for primary, valid := range map[string]bool{
+		"192.0.2.53":       true,
+		"192.0.2.53:5353":  true,
+		"2001:db8::53":     true,
+		"[2001:db8::53]":   false,
+		"ns1.zone.test":    false,
+		"ns1.zone.test:53": false,
+	} {
+		path := writeTestFile(t, t.TempDir(), "config.toml", testConfig+"\n[[secondary]]\nzone = \"zone.test\"\nprimaries = [\""+primary+"\"]\n")
+		_, err := LoadConfig(path)
+		if valid && err != nil {
+			t.Errorf("%s: unexpected error %v", primary, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "must be an IP address")) {
+			t.Errorf("%s: got %v, want the primary rejected", primary, err)
+		}
+	}
+
+	// Sources are compared as addresses, not strings
+	secondary := SecondaryConfig{Zone: "zone.test", Primaries: []string{"2001:DB8::53"}}
+	if _, ok := secondary.primaryFor("2001:db8::53"); !ok {
+		t.Error("NOTIFY source did not match the differently written primary")
+	}
+}
+
+func TestSecondaryFindRecordPrefersMostSpecific(t *testing.T) {
+	setTestSecondaryZone(t, "example.test",
+		RecordEntry{Domain: "*.example.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "host.sub.example.test", Type: "A", Value: "192.0.2.2", TTL: 60},
+		RecordEntry{Domain: "*.sub.example.test", Type: "A", Value: "192.0.2.3", TTL: 60},
+	)
+	setTestSecondaryZone(t, "sub.example.test",
+		RecordEntry{Domain: "www.sub.example.test", Type: "A", Value: "192.0.2.4", TTL: 60},
+		RecordEntry{Domain: "host.sub.example.test", Type: "A", Value: "192.0.2.5", TTL: 60},
+	)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"other.example.test", "192.0.2.1"},
+		{"other.sub.example.test", "192.0.2.3"},
+		{"www.sub.example.test", "192.0.2.4"},
+		// Both zones hold the name, the deeper zone answers
+		{"host.sub.example.test", "192.0.2.5"},
+	}
+
+	// Map order varies between runs, so look each name up repeatedly
+	for i := 0; i < 20; i++ {
+		for _, tt := range tests {
+			if record := Secondaries.FindRecord(tt.name, "A"); record == nil || record.Value != tt.want {
+				t.Fatalf("FindRecord(%s) = %v, want %s", tt.name, record, tt.want)
+			}
+		}
+	}
+}
@@ -1,97 +1,757 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// tagRoutePrefix marks a route target naming an upstream tag rather than an upstream
+const tagRoutePrefix = "tag:"
+
+// defaultMaxCNAMEDepth is the number of CNAMEs followed when max_cname_depth is not set
+const defaultMaxCNAMEDepth = 8
+
+// Handling of the CD (checking disabled) bit of forwarded queries
+// With "forward" upstreams skip DNSSEC validation for CD queries, so their
+// answers carry no AD bit; with "clear" upstreams always validate
+const (
+	CDBitForward = "forward"
+	CDBitClear   = "clear"
+)
+
 // DNSServer represents a DNS server instance
 type DNSServer struct {
 	config    *Config
 	server    *dns.Server
+	tcpServer *dns.Server
 	client    *dns.Client
 	upstreams map[string]*dns.Client
+	egress    map[string]*RateLimiter
+	limiter   *RateLimiter
+	cache     *ResponseCache
+	pipeline  QueryHandler
+	records   RecordStore
+	serials   *zoneSerials
+	inFlight  *InFlightTracker
+	metrics   *Metrics
+	clock     Clock
+	missed    *missedNames
+	active    *activeQueries
+	admin     *http.Server
+	doh       *http.Server
+
+	// Whether maintenance overrides are being served
+	maintenance atomic.Bool
+
+	// Set while the last records reload failed under the degrade policy
+	recordsDegraded atomic.Bool
+
+	// Rotates tag routes between the tagged upstreams
+	tagTurn atomic.Uint64
+
+	// Closed once upstreams answer or the startup grace period ends
+	upstreamsReady chan struct{}
+	readyOnce      sync.Once
+	graceUntil     time.Time
+
+	// Closed once records are loaded or the records gate times out
+	recordsReady chan struct{}
+	recordsOnce  sync.Once
+	recordsUntil time.Time
+
+	// Closed when the server stops to end background tasks
+	done chan struct{}
+	// Runs the shutdown once, later Stop calls return its result
+	stopOnce sync.Once
+	stopErr  error
+
+	// Closed to stop the records file watcher when it is restarted
+	recordsWatchStop chan struct{}
+	recordsWatchMu   sync.Mutex
+
+	// Serializes records added through the admin API
+	recordsAddMu sync.Mutex
+
+	// Guards config, upstreams, egress, limiter, cache and pipeline, which are replaced on reload
+	mu sync.RWMutex
+}
+
+// ServerOption customizes a DNS server at construction
+type ServerOption func(*serverOptions)
+
+// serverOptions holds the dependencies a DNS server can be built with
+type serverOptions struct {
+	clock   Clock
+	records RecordStore
+}
+
+// WithClock makes the server's cache expiry, record validity and schedules follow clock
+func WithClock(clock Clock) ServerOption {
+	return func(o *serverOptions) {
+		o.clock = clock
+	}
+}
+
+// WithRecordStore makes the server answer from store instead of the loaded records
+func WithRecordStore(store RecordStore) ServerOption {
+	return func(o *serverOptions) {
+		o.records = store
+	}
 }
 
 // NewDNSServer creates a new DNS server with the given configuration
-func NewDNSServer(config *Config) *DNSServer {
+// Returns an error if no configured upstream can be used
+func NewDNSServer(config *Config, options ...ServerOption) (*DNSServer, error) {
+	opts := serverOptions{clock: realClock{}}
+	for _, option := range options {
+		option(&opts)
+	}
+	clock := opts.clock
+	if opts.records == nil {
+		opts.records = memoryRecordStore{clock: clock}
+	}
+
+	upstreams := buildUpstreamClients(config, nil, nil)
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream DNS servers configured")
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no valid upstream DNS servers: all %d configured upstreams have an invalid protocol", len(config.Upstreams))
+	}
+
 	dnsServer := &DNSServer{
 		config:    config,
-		upstreams: make(map[string]*dns.Client),
+		upstreams: upstreams,
+		egress:    buildEgressLimiters(config, nil, nil),
+		records:   opts.records,
+		serials:   newZoneSerials(clock),
+		inFlight:  NewInFlightTracker(),
+		metrics:   NewMetrics(),
+		clock:     clock,
+		missed:    newMissedNames(maxMissedNames),
+		active:    newActiveQueries(),
+
+		upstreamsReady: make(chan struct{}),
+		recordsReady:   make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	dnsServer.maintenance.Store(config.Maintenance.Enabled)
+	SetLogLevel(config.Server.LogLevel)
+
+	// Initialize the response cache
+	if config.Cache.Enabled {
+		dnsServer.cache = NewResponseCache(config.Cache.MaxEntries, clock)
+		dnsServer.cache.SetMaxStale(cacheMaxStale(config))
+	}
+
+	// Initialize per-client rate limiting
+	if config.RateLimit.QueriesPerSecond > 0 {
+		dnsServer.limiter = NewRateLimiter(config.RateLimit.QueriesPerSecond, config.RateLimit.Burst)
 	}
 
-	// Initialize upstream clients
+	dnsServer.pipeline = dnsServer.buildPipeline(config.Server.Pipeline)
+
+	return dnsServer, nil
+}
+
+// buildUpstreamClients creates a client for each configured upstream
+// Clients of upstreams whose configuration is unchanged are reused, upstreams
+// with an unsupported protocol get no client and are never queried
+func buildUpstreamClients(config *Config, oldConfig *Config, oldClients map[string]*dns.Client) map[string]*dns.Client {
+	clients := make(map[string]*dns.Client, len(config.Upstreams))
+
 	for name, upstream := range config.Upstreams {
-		client := &dns.Client{
-			Net:          upstream.Protocol,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 5 * time.Second,
+		if !validUpstreamProtocol(upstream.Protocol) {
+			log.Printf("Skipping upstream %s: invalid protocol %q", name, upstream.Protocol)
+			continue
+		}
+
+		if oldConfig != nil {
+			if old, ok := oldConfig.Upstreams[name]; ok && reflect.DeepEqual(old, upstream) && oldClients[name] != nil {
+				clients[name] = oldClients[name]
+				continue
+			}
+		}
+
+		client := newUpstreamClient(upstream.Protocol)
+
+		// Keep the TLS settings on every client so tcp-tls fallbacks can use them
+		tlsConfig, err := upstreamTLSConfig(upstream)
+		if err != nil {
+			log.Printf("Error configuring TLS for upstream %s: %v", name, err)
+		}
+		client.TLSConfig = tlsConfig
+
+		clients[name] = client
+	}
+
+	return clients
+}
+
+// buildEgressLimiters creates a rate limiter for each upstream with a rate_limit
+// Limiters of upstreams whose limit is unchanged are kept
+func buildEgressLimiters(config *Config, oldConfig *Config, oldLimiters map[string]*RateLimiter) map[string]*RateLimiter {
+	limiters := make(map[string]*RateLimiter)
+
+	for name, upstream := range config.Upstreams {
+		if upstream.RateLimit <= 0 {
+			continue
+		}
+
+		if oldConfig != nil {
+			if old, ok := oldConfig.Upstreams[name]; ok && old.RateLimit == upstream.RateLimit && oldLimiters[name] != nil {
+				limiters[name] = oldLimiters[name]
+				continue
+			}
+		}
+
+		// Allow at most one second's worth of queries in a burst
+		limiters[name] = NewRateLimiter(upstream.RateLimit, max(1, int(upstream.RateLimit)))
+	}
+
+	return limiters
+}
+
+// Reload applies a new configuration to the running server
+// Upstream clients are rebuilt atomically, so in-flight queries finish on the
+// clients they started with while new queries see the updated upstreams
+func (s *DNSServer) Reload(config *Config) {
+	old := s.applyConfig(config)
+
+	// Records are loaded by the records watcher, which must follow new files and policies
+	if config.Server.RecordsDB == "" && recordsSettingsChanged(old.Server, config.Server) {
+		log.Printf("Records settings changed, reloading records")
+		s.ReloadRecords()
+		s.WatchRecords()
+	}
+}
+
+// applyConfig swaps in a new configuration and returns the one it replaced
+func (s *DNSServer) applyConfig(config *Config) *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.upstreams = buildUpstreamClients(config, s.config, s.upstreams)
+	s.egress = buildEgressLimiters(config, s.config, s.egress)
+
+	// Rebuild the rate limiter only when its settings change
+	if config.RateLimit != s.config.RateLimit {
+		s.limiter = nil
+		if config.RateLimit.QueriesPerSecond > 0 {
+			s.limiter = NewRateLimiter(config.RateLimit.QueriesPerSecond, config.RateLimit.Burst)
+		}
+	}
+
+	// Rebuild the cache only when it is switched on or resized
+	if config.Cache.Enabled != s.config.Cache.Enabled || config.Cache.MaxEntries != s.config.Cache.MaxEntries {
+		s.cache = nil
+		if config.Cache.Enabled {
+			s.cache = NewResponseCache(config.Cache.MaxEntries, s.clock)
+		}
+	}
+	if s.cache != nil {
+		s.cache.SetMaxStale(cacheMaxStale(config))
+	}
+
+	// Only a changed setting overrides maintenance mode toggled at runtime
+	if config.Maintenance.Enabled != s.config.Maintenance.Enabled {
+		s.SetMaintenance(config.Maintenance.Enabled)
+	}
+
+	// Stages read settings at query time, so only a new order needs a new chain
+	if !slices.Equal(config.Server.Pipeline, s.config.Server.Pipeline) {
+		s.pipeline = s.buildPipeline(config.Server.Pipeline)
+	}
+
+	SetLogLevel(config.Server.LogLevel)
+	old := s.config
+	s.config = config
+	s.metrics.ReloadSucceeded(ReloadKindConfig)
+
+	log.Printf("Applied reloaded configuration with %d upstreams", len(config.Upstreams))
+	return old
+}
+
+// recordsSettingsChanged reports whether settings deciding which records
+// files are loaded, and how, differ between two configurations
+func recordsSettingsChanged(old, config ServerConfig) bool {
+	return old.RecordsFile != config.RecordsFile ||
+		!slices.Equal(old.RecordsFiles, config.RecordsFiles) ||
+		old.RecordsRequired != config.RecordsRequired ||
+		old.DuplicatePolicy != config.DuplicatePolicy ||
+		old.CNAMEConflictPolicy != config.CNAMEConflictPolicy ||
+		old.MinRecordTTL != config.MinRecordTTL ||
+		old.MaxRecordTTL != config.MaxRecordTTL
+}
+
+// ReloadRecords loads the records with the current settings and applies the
+// changes, as a records file change does
+func (s *DNSServer) ReloadRecords() {
+	changed, err := LoadRecords(s.currentConfig().Server)
+	if err != nil {
+		log.Printf("Error reloading records: %v", err)
+		s.RecordsReloadFailed(err)
+		return
+	}
+	s.RecordsChanged(changed)
+}
+
+// WatchRecords starts watching the records files of the current configuration,
+// stopping the watcher started before
+func (s *DNSServer) WatchRecords() {
+	s.recordsWatchMu.Lock()
+	defer s.recordsWatchMu.Unlock()
+
+	s.stopRecordsWatchLocked()
+	// Records served from a database are not read from files
+	if s.currentConfig().Server.RecordsDB != "" {
+		return
+	}
+	stop := make(chan struct{})
+	s.recordsWatchStop = stop
+
+	go WatchRecordsFile(s.currentConfig().Server, s.RecordsChanged, s.RecordsReloadFailed, stop)
+}
+
+// stopRecordsWatchLocked stops the records file watcher, if one is running
+// Must be called with recordsWatchMu held
+func (s *DNSServer) stopRecordsWatchLocked() {
+	if s.recordsWatchStop != nil {
+		close(s.recordsWatchStop)
+		s.recordsWatchStop = nil
+	}
+}
+
+// ConfigReloadFailed counts a config reload that failed, the last good
+// configuration stays in effect
+func (s *DNSServer) ConfigReloadFailed(err error) {
+	s.metrics.ReloadFailed(ReloadKindConfig)
+}
+
+// RecordsChanged applies reloaded records: cached answers for the changed
+// records are evicted and the serials of their owned zones incremented
+func (s *DNSServer) RecordsChanged(changed []RecordEntry) {
+	s.metrics.ReloadSucceeded(ReloadKindRecords)
+	if s.recordsDegraded.Swap(false) {
+		log.Printf("Records reloaded, no longer degraded")
+	}
+	s.InvalidateRecords(changed)
+	s.bumpZoneSerials(changed)
+}
+
+// RecordsReloadFailed applies the reload failure policy after a records reload
+// fails, the last good records keep being served either way
+func (s *DNSServer) RecordsReloadFailed(err error) {
+	s.metrics.ReloadFailed(ReloadKindRecords)
+	if s.currentConfig().Server.ReloadFailurePolicy != ReloadFailureDegrade {
+		return
+	}
+
+	if !s.recordsDegraded.Swap(true) {
+		log.Printf("WARNING: records reload failed, degraded until a good reload: %v", err)
+	}
+}
+
+// degradedAnswer answers SERVFAIL for names with local records while a
+// failed records reload has degraded the server and degraded_servfail is set
+// Returns true if the query was answered
+func (s *DNSServer) degradedAnswer(w dns.ResponseWriter, r *dns.Msg) bool {
+	if !s.recordsDegraded.Load() || !s.currentConfig().Server.DegradedServFail {
+		return false
+	}
+
+	if !s.records.Exists(getDomainFromQuestion(r.Question[0])) {
+		return false
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+	return true
+}
+
+// InvalidateRecords evicts cached responses for names matching changed records,
+// keeping unrelated cache entries across records reloads
+func (s *DNSServer) InvalidateRecords(changed []RecordEntry) {
+	cache := s.currentCache()
+	if cache == nil || len(changed) == 0 {
+		return
+	}
+
+	removed := cache.Invalidate(func(name string) bool {
+		for i := range changed {
+			if changed[i].Matches(name) {
+				return true
+			}
 		}
-		dnsServer.upstreams[name] = client
+		return false
+	})
+
+	log.Printf("Invalidated %d cache entries for %d changed records", removed, len(changed))
+}
+
+// currentConfig returns the configuration currently in effect
+func (s *DNSServer) currentConfig() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// currentPipeline returns the query pipeline currently in effect
+func (s *DNSServer) currentPipeline() QueryHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pipeline
+}
+
+// currentLimiter returns the rate limiter currently in effect
+func (s *DNSServer) currentLimiter() *RateLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limiter
+}
+
+// currentCache returns the response cache currently in effect
+func (s *DNSServer) currentCache() *ResponseCache {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache
+}
+
+// getUpstream returns the configuration and client of the named upstream
+func (s *DNSServer) getUpstream(name string) (UpstreamConfig, *dns.Client, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Upstreams skipped for an invalid configuration have no client
+	upstream, ok := s.config.Upstreams[name]
+	client := s.upstreams[name]
+	if !ok || client == nil {
+		return UpstreamConfig{}, nil, false
 	}
+	return upstream, client, true
+}
 
-	return dnsServer
+// egressLimiter returns the egress rate limiter of an upstream, nil if it has none
+func (s *DNSServer) egressLimiter(name string) *RateLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.egress[name]
 }
 
 // Start starts the DNS server
 func (s *DNSServer) Start() error {
 	// Create a new DNS server
-	addr := fmt.Sprintf("%s:%d", s.config.Server.Listen, s.config.Server.Port)
+	config := s.currentConfig()
+	addr := fmt.Sprintf("%s:%d", config.Server.Listen, config.Server.Port)
+	// Keep IPv4-only hosts from binding IPv6 sockets
+	udpNet, tcpNet := "udp", "tcp"
+	if config.Server.DisableIPv6 {
+		udpNet, tcpNet = "udp4", "tcp4"
+	}
+
 	s.server = &dns.Server{
 		Addr:    addr,
-		Net:     "udp",
+		Net:     udpNet,
 		Handler: dns.HandlerFunc(s.handleRequest),
 	}
 
+	// Connection limits are read from the current config as each connection
+	// opens, so reloads apply to new connections
+	s.tcpServer = &dns.Server{
+		Addr:        addr,
+		Net:         tcpNet,
+		Handler:     dns.HandlerFunc(s.handleRequest),
+		ReadTimeout: time.Duration(config.Server.TCPReadTimeout) * time.Second,
+		// Queries per connection are counted by the reader instead
+		MaxTCPQueries: -1,
+		IdleTimeout: func() time.Duration {
+			return time.Duration(s.currentConfig().Server.TCPIdleTimeout) * time.Second
+		},
+		// TCP messages are length prefixed, reject oversized ones before reading them
+		DecorateReader: func(reader dns.Reader) dns.Reader {
+			server := s.currentConfig().Server
+			return &sizeLimitReader{Reader: reader, maxSize: server.MaxMessageSize, maxQueries: server.TCPMaxQueriesPerConn}
+		},
+	}
+
+	// Load secondary zones from their primaries
+	for _, secondary := range config.Secondaries {
+		if len(secondary.Primaries) > 0 {
+			go s.refreshZone(secondary.Zone, primaryAddress(secondary.Primaries[0]))
+		}
+	}
+
+	s.startAdmin()
+	s.startDoH()
+	s.startCachePersistence()
+	s.startCacheStats()
+	s.beginStartupGrace()
+	s.beginRecordsLoad()
+	go s.warmCache()
+
+	log.Print(s.startupSummary())
 	log.Printf("Starting DNS server on %s\n", addr)
+	go func() {
+		if err := s.tcpServer.ListenAndServe(); err != nil {
+			log.Printf("TCP server error: %v", err)
+		}
+	}()
 	return s.server.ListenAndServe()
 }
 
-// Stop stops the DNS server
-func (s *DNSServer) Stop() error {
+// startupSummary describes the effective configuration in a single log line
+func (s *DNSServer) startupSummary() string {
+	config := s.currentConfig()
+
+	upstreams := make([]string, 0, len(config.Upstreams))
+	for _, name := range sortedUpstreamNames(config.Upstreams) {
+		upstream := config.Upstreams[name]
+		upstreams = append(upstreams, fmt.Sprintf("%s(%s://%s)", name, upstream.Protocol,
+			net.JoinHostPort(upstream.Address, strconv.Itoa(upstream.Port))))
+	}
+
+	recordCount := len(s.records.All())
+
+	// Collect optional features that are switched on
+	features := []string{}
+	if config.Server.LogQueries {
+		features = append(features, "log_queries")
+	}
+	if config.Server.TTLJitter > 0 {
+		features = append(features, fmt.Sprintf("ttl_jitter=%ds", config.Server.TTLJitter))
+	}
+	if config.Server.PassthroughServFail {
+		features = append(features, "passthrough_servfail")
+	}
+	if config.RateLimit.QueriesPerSecond > 0 {
+		features = append(features, fmt.Sprintf("rate_limit=%gqps/%s",
+			config.RateLimit.QueriesPerSecond, config.RateLimit.Response))
+	}
+	if config.Cache.Enabled {
+		features = append(features, fmt.Sprintf("cache=%d_entries", config.Cache.MaxEntries))
+	}
+	if config.Admin.Listen != "" {
+		features = append(features, "admin="+config.Admin.Listen)
+	}
+	if len(config.Secondaries) > 0 {
+		features = append(features, fmt.Sprintf("secondary_zones=%d", len(config.Secondaries)))
+	}
+	if config.DoH.Listen != "" {
+		features = append(features, "doh="+config.DoH.Listen)
+	}
+	if config.Server.DisableIPv6 {
+		features = append(features, "ipv6=disabled")
+	}
+
+	return fmt.Sprintf("Startup summary: listen=%s protocols=udp,tcp upstreams=[%s] records=%d records_file=%s features=[%s]",
+		net.JoinHostPort(config.Server.Listen, strconv.Itoa(config.Server.Port)),
+		strings.Join(upstreams, " "), recordCount, config.Server.RecordsFile,
+		strings.Join(features, " "))
+}
+
+// Stop stops the DNS server, waiting up to timeout for in-flight queries
+// Listeners are closed once the timeout passes and the abandoned queries logged
+// Calling Stop again returns the result of the first call
+func (s *DNSServer) Stop(timeout time.Duration) error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop(timeout)
+	})
+	return s.stopErr
+}
+
+// stop shuts the server down for Stop
+func (s *DNSServer) stop(timeout time.Duration) error {
+	close(s.done)
+	s.saveCache()
+
+	s.recordsWatchMu.Lock()
+	s.stopRecordsWatchLocked()
+	s.recordsWatchMu.Unlock()
+
+	if err := s.stopAdmin(); err != nil {
+		log.Printf("Error stopping admin API: %v", err)
+	}
+
+	if err := s.stopDoH(); err != nil {
+		log.Printf("Error stopping DoH server: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Both listeners drain at once, so neither eats into the other's share of the timeout
+	var wg sync.WaitGroup
+	var tcpErr, err error
+	if s.tcpServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tcpErr = s.tcpServer.ShutdownContext(ctx)
+		}()
+	}
 	if s.server != nil {
-		return s.server.Shutdown()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err = s.server.ShutdownContext(ctx)
+		}()
 	}
-	return nil
+	wg.Wait()
+
+	if tcpErr != nil && ctx.Err() == nil {
+		log.Printf("Error stopping TCP server: %v", tcpErr)
+	}
+
+	if ctx.Err() != nil {
+		for _, query := range s.active.list() {
+			log.Printf("Abandoned in-flight query on shutdown: %s", query)
+		}
+		return fmt.Errorf("shutdown timed out after %s", timeout)
+	}
+	return err
 }
 
 // handleRequest processes incoming DNS requests
 func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	// NOTIFY messages from primaries trigger a zone refresh
+	if r.Opcode == dns.OpcodeNotify {
+		s.handleNotify(w, r)
+		return
+	}
+
 	if len(r.Question) == 0 {
 		s.sendServerFailure(w, r, fmt.Errorf("empty question section"))
 		return
 	}
 
+	id := s.active.begin(r.Question[0], remoteHost(w.RemoteAddr()))
+	defer s.active.end(id)
+
+	transport := getTransport(w)
+
+	// Large answers must be truncated for UDP clients whatever the upstream transport
+	if transport == TransportUDP {
+		w = &truncatingWriter{ResponseWriter: w, size: udpBufferSize(r)}
+	}
+
+	// Rewrite the query name, restoring the original name in the response
+	if rewritten, ok := rewriteQueryName(s.currentConfig().QNameRewrites, r.Question[0].Name, transport); ok {
+		w = &rewriteWriter{ResponseWriter: w, original: r.Question[0].Name, rewritten: rewritten}
+		r.Question[0].Name = rewritten
+	}
+
 	q := r.Question[0]
+	rc := &requestContext{
+		clientIP:  getClientIP(w.RemoteAddr()),
+		transport: transport,
+	}
+	s.metrics.Queries.Add(1)
 
-	// Log query if enabled
-	if s.config.Server.LogQueries {
-		log.Printf("Query: %s, Type: %s", q.Name, dns.TypeToString[q.Qtype])
+	// Recognize and untag queries from debug clients
+	if debugQuery, ok := s.untagDebugQuery(r); ok {
+		r = debugQuery
+		rc.debug = true
+		log.Printf("Debug query: %s, Type: %s, Client: %s, Transport: %s",
+			normalizeName(q.Name), dns.TypeToString[q.Qtype], rc.clientIP, rc.transport)
 	}
 
-	// Try to respond from local records first
-	if s.handleLocalRecord(w, r, q) {
-		return
+	start := time.Now()
+	defer s.logSlowQuery(q, start)
+
+	// Record the response code and latency once the query is answered
+	recorder := &rcodeRecorder{ResponseWriter: w}
+	w = recorder
+	defer func() {
+		if recorder.written {
+			s.metrics.ObserveQuery(q.Qtype, recorder.rcode, time.Since(start))
+		}
+	}()
+
+	// Run the query through the configured pipeline of stages
+	s.currentPipeline()(w, r, rc)
+}
+
+// isResolvable reports whether a domain matches the resolvable_domains allowlist
+func (s *DNSServer) isResolvable(domain string) bool {
+	patterns := s.currentConfig().Server.ResolvableDomains
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if MatchDomain(pattern, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// answerTombstone answers a query for a tombstoned name with an authoritative NXDOMAIN
+func (s *DNSServer) answerTombstone(w dns.ResponseWriter, r *dns.Msg, domain string, tombstone *RecordEntry, rc *requestContext) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Authoritative = true
+	if zone := s.findOwnedZone(domain); zone != nil {
+		m.Ns = append(m.Ns, s.ownedZoneSOA(zone))
 	}
 
-	// Forward to upstream if no local record found
-	s.handleUpstreamRequest(w, r)
+	if rc.logQuery {
+		log.Printf("Response for %s from local records: NXDOMAIN (tombstone until %s)%s", domain, tombstone.NotAfter, recordNote(tombstone))
+	}
+	if rc.debug {
+		s.attachDebugNote(m, r, tombstone)
+	}
+	s.metrics.RecordHit(tombstone)
+	rc.trace.local(tombstone)
+	w.WriteMsg(m)
 }
 
 // handleLocalRecord attempts to respond using a local DNS record
 // Returns true if a local record was found and used
-func (s *DNSServer) handleLocalRecord(w dns.ResponseWriter, r *dns.Msg, q dns.Question) bool {
+func (s *DNSServer) handleLocalRecord(w dns.ResponseWriter, r *dns.Msg, q dns.Question, rc *requestContext) bool {
+	clientIP := rc.clientIP
 	recordType := dns.TypeToString[q.Qtype]
 	domain := getDomainFromQuestion(q)
 
-	record := FindMatchingRecord(domain, recordType)
+	// Maintenance overrides take precedence over normal records
+	record := s.findMaintenanceRecord(domain, recordType)
+	if record == nil {
+		// Removed names stay gone, whatever upstreams still answer for them
+		if tombstone := s.records.Tombstone(domain); tombstone != nil {
+			s.answerTombstone(w, r, domain, tombstone, rc)
+			return true
+		}
+		record = s.findRecord(domain, recordType, clientIP)
+	}
+	if record == nil && recordType != "CNAME" {
+		// Answer with the name's CNAME when there is no record of the requested type
+		record = s.findRecord(domain, "CNAME", clientIP)
+	}
 	if record == nil {
+		// Hide the existence of names the client is not allowed to resolve
+		if s.records.Hidden(domain, clientIP) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+			return true
+		}
 		return false
 	}
 
@@ -99,14 +759,47 @@ func (s *DNSServer) handleLocalRecord(w dns.ResponseWriter, r *dns.Msg, q dns.Qu
 	m := new(dns.Msg)
 	m.SetReply(r)
 
+	// Declared NODATA: the name exists but deliberately has no records of this type
+	if record.NoData && record.Type == recordType {
+		m.Authoritative = true
+		if zone := s.findOwnedZone(domain); zone != nil {
+			m.Ns = append(m.Ns, s.ownedZoneSOA(zone))
+		}
+		if rc.logQuery {
+			log.Printf("Response for %s from local records: NODATA %s%s", domain, recordType, recordNote(record))
+		}
+		if rc.debug {
+			s.attachDebugNote(m, r, record)
+		}
+		s.metrics.RecordHit(record)
+		rc.trace.local(record)
+		w.WriteMsg(m)
+		return true
+	}
+
 	// Add appropriate record to answer
-	s.addRecordToMsg(m, q, record, recordType)
+	record = record.ForTransport(rc.transport)
+	s.addRecordToMsg(m, q.Name, record, record.Type)
+	s.metrics.RecordHit(record)
+
+	// Follow the CNAME through local records of the requested type
+	if record.Type == "CNAME" && recordType != "CNAME" {
+		if err := s.chaseLocalCNAME(m, q.Name, record, recordType, rc); err != nil {
+			s.sendServerFailure(w, r, fmt.Errorf("failed to follow CNAME chain for %s: %w", domain, err))
+			return true
+		}
+		m.Answer = orderCNAMEChain(m.Answer, q.Name)
+	}
 
 	// Only send if we added an answer
 	if len(m.Answer) > 0 {
-		if s.config.Server.LogQueries {
-			log.Printf("Response for %s from local records: %s", domain, recordType)
+		if rc.logQuery {
+			log.Printf("Response for %s from local records: %s%s", domain, recordType, recordNote(record))
+		}
+		if rc.debug {
+			s.attachDebugNote(m, r, record)
 		}
+		rc.trace.local(record)
 		w.WriteMsg(m)
 		return true
 	}
@@ -114,42 +807,222 @@ func (s *DNSServer) handleLocalRecord(w dns.ResponseWriter, r *dns.Msg, q dns.Qu
 	return false
 }
 
-// addRecordToMsg adds the appropriate DNS record to the message based on record type
-func (s *DNSServer) addRecordToMsg(m *dns.Msg, q dns.Question, record *RecordEntry, recordType string) {
+// orderCNAMEChain orders answers along the CNAME chain starting at qname:
+// each CNAME follows the one pointing to its owner, and the final records
+// come last. Records outside the chain keep their order at the end
+func orderCNAMEChain(answers []dns.RR, qname string) []dns.RR {
+	ordered := make([]dns.RR, 0, len(answers))
+	used := make([]bool, len(answers))
+
+	name := qname
+	for range answers {
+		found := false
+		for i, rr := range answers {
+			if used[i] || !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				ordered = append(ordered, rr)
+				used[i] = true
+				name = cname.Target
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	// Records of the final name, then anything else
+	for i, rr := range answers {
+		if !used[i] && strings.EqualFold(rr.Header().Name, name) {
+			ordered = append(ordered, rr)
+			used[i] = true
+		}
+	}
+	for i, rr := range answers {
+		if !used[i] {
+			ordered = append(ordered, rr)
+		}
+	}
+
+	return ordered
+}
+
+// sortRRsets orders the records within each RRset by their data, leaving
+// RRsets where they first appear so CNAME chains keep their order
+func sortRRsets(answers []dns.RR) {
+	position := map[string]int{}
+	for i, rr := range answers {
+		key := rrsetKey(rr)
+		if _, ok := position[key]; !ok {
+			position[key] = i
+		}
+	}
+
+	sort.SliceStable(answers, func(i, j int) bool {
+		pi, pj := position[rrsetKey(answers[i])], position[rrsetKey(answers[j])]
+		if pi != pj {
+			return pi < pj
+		}
+		return rdata(answers[i]) < rdata(answers[j])
+	})
+}
+
+// truncateAnswer cuts an answer to at most limit records at an RRset boundary
+// An RRset is only split when not even the first one fits, and an answer never
+// ends in a CNAME whose target records were cut
+func truncateAnswer(answers []dns.RR, limit int) []dns.RR {
+	if len(answers) <= limit {
+		return answers
+	}
+
+	boundary := limit
+	for boundary > 0 && rrsetKey(answers[boundary-1]) == rrsetKey(answers[boundary]) {
+		boundary--
+	}
+
+	truncated := trimTrailingCNAMEs(answers[:boundary])
+	if len(truncated) == 0 {
+		truncated = trimTrailingCNAMEs(answers[:limit])
+	}
+	return truncated
+}
+
+// trimTrailingCNAMEs drops CNAMEs left dangling at the end of an answer
+func trimTrailingCNAMEs(answers []dns.RR) []dns.RR {
+	for len(answers) > 0 && answers[len(answers)-1].Header().Rrtype == dns.TypeCNAME {
+		answers = answers[:len(answers)-1]
+	}
+	return answers
+}
+
+// rrsetKey identifies the RRset a record belongs to
+func rrsetKey(rr dns.RR) string {
+	header := rr.Header()
+	return fmt.Sprintf("%s|%d|%d", normalizeName(header.Name), header.Rrtype, header.Class)
+}
+
+// rdata returns the presentation form of a record's data
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// cnameChain tracks the names visited while following a CNAME chain,
+// cutting off loops and chains longer than max_cname_depth
+type cnameChain struct {
+	seen     map[string]bool
+	maxDepth int
+}
+
+// newCNAMEChain starts a CNAME chain at the query name
+func newCNAMEChain(qname string, maxDepth int) *cnameChain {
+	return &cnameChain{
+		seen:     map[string]bool{normalizeName(qname): true},
+		maxDepth: maxDepth,
+	}
+}
+
+// follow records a CNAME pointing to target
+// Returns an error if the target was already visited or the chain is too long
+func (c *cnameChain) follow(target string) error {
+	target = normalizeName(target)
+	if c.seen[target] {
+		return fmt.Errorf("CNAME loop at %s", target)
+	}
+	if len(c.seen) > c.maxDepth {
+		return fmt.Errorf("CNAME chain longer than max_cname_depth %d", c.maxDepth)
+	}
+
+	c.seen[target] = true
+	return nil
+}
+
+// chaseLocalCNAME appends local records found by following a CNAME chain
+// The chain stops at the first target without a local record
+// Returns an error for CNAME loops and chains longer than max_cname_depth
+func (s *DNSServer) chaseLocalCNAME(m *dns.Msg, qname string, cname *RecordEntry, recordType string, rc *requestContext) error {
+	chain := newCNAMEChain(qname, s.currentConfig().Server.MaxCNAMEDepth)
+	for {
+		target := strings.TrimSuffix(cname.Value, ".")
+		if err := chain.follow(target); err != nil {
+			return err
+		}
+
+		if record := s.findRecord(target, recordType, rc.clientIP); record != nil {
+			s.addRecordToMsg(m, dns.Fqdn(target), record.ForTransport(rc.transport), recordType)
+			s.metrics.RecordHit(record)
+			return nil
+		}
+
+		next := s.findRecord(target, "CNAME", rc.clientIP)
+		if next == nil {
+			return nil
+		}
+		next = next.ForTransport(rc.transport)
+
+		s.addRecordToMsg(m, dns.Fqdn(target), next, "CNAME")
+		s.metrics.RecordHit(next)
+		cname = next
+	}
+}
+
+// addRecordToMsg adds the appropriate DNS records to the message based on record type
+// Records with several values emit one RR per value, up to max_rrset_size
+func (s *DNSServer) addRecordToMsg(m *dns.Msg, name string, record *RecordEntry, recordType string) {
 	header := dns.RR_Header{
-		Name:  q.Name,
+		Name:  name,
 		Class: dns.ClassINET,
-		Ttl:   uint32(record.TTL),
+		Ttl:   s.localRecordTTL(record),
+	}
+
+	// Cap the RRset to avoid huge responses
+	values := record.AllValues()
+	if limit := s.currentConfig().Server.MaxRRsetSize; limit > 0 && len(values) > limit {
+		log.Printf("Truncating %s %s RRset from %d to %d records", record.Domain, recordType, len(values), limit)
+		values = values[:limit]
+	}
+
+	for _, value := range values {
+		addValueToMsg(m, header, record.Domain, recordType, value)
 	}
+}
 
+// addValueToMsg adds a single record value to the answer section
+func addValueToMsg(m *dns.Msg, header dns.RR_Header, domain string, recordType string, value string) {
 	switch recordType {
 	case "A":
 		header.Rrtype = dns.TypeA
 		m.Answer = append(m.Answer, &dns.A{
 			Hdr: header,
-			A:   net.ParseIP(record.Value),
+			A:   net.ParseIP(value),
 		})
 	case "AAAA":
 		header.Rrtype = dns.TypeAAAA
 		m.Answer = append(m.Answer, &dns.AAAA{
 			Hdr:  header,
-			AAAA: net.ParseIP(record.Value),
+			AAAA: net.ParseIP(value),
 		})
 	case "CNAME":
 		header.Rrtype = dns.TypeCNAME
 		m.Answer = append(m.Answer, &dns.CNAME{
 			Hdr:    header,
-			Target: dns.Fqdn(record.Value),
+			Target: dns.Fqdn(value),
 		})
 	case "TXT":
 		header.Rrtype = dns.TypeTXT
+		if len(value) > maxTXTValueLength {
+			log.Printf("Warning: truncating TXT value for %s from %d to %d bytes", domain, len(value), maxTXTValueLength)
+			value = value[:maxTXTValueLength]
+		}
 		m.Answer = append(m.Answer, &dns.TXT{
 			Hdr: header,
-			Txt: []string{record.Value},
+			Txt: splitTXTValue(value),
 		})
 	case "MX":
 		header.Rrtype = dns.TypeMX
-		priority, target := s.parseMXRecord(record.Value)
+		priority, target := parseMXRecord(value)
 		m.Answer = append(m.Answer, &dns.MX{
 			Hdr:        header,
 			Preference: priority,
@@ -159,19 +1032,19 @@ func (s *DNSServer) addRecordToMsg(m *dns.Msg, q dns.Question, record *RecordEnt
 		header.Rrtype = dns.TypeNS
 		m.Answer = append(m.Answer, &dns.NS{
 			Hdr: header,
-			Ns:  dns.Fqdn(record.Value),
+			Ns:  dns.Fqdn(value),
 		})
 	case "PTR":
 		header.Rrtype = dns.TypePTR
 		m.Answer = append(m.Answer, &dns.PTR{
 			Hdr: header,
-			Ptr: dns.Fqdn(record.Value),
+			Ptr: dns.Fqdn(value),
 		})
 	}
 }
 
 // parseMXRecord parses an MX record value into priority and target
-func (s *DNSServer) parseMXRecord(value string) (uint16, string) {
+func parseMXRecord(value string) (uint16, string) {
 	parts := strings.Split(value, " ")
 	priority := uint16(10) // Default priority
 	target := parts[0]
@@ -187,14 +1060,20 @@ func (s *DNSServer) parseMXRecord(value string) (uint16, string) {
 }
 
 // handleUpstreamRequest forwards the request to an upstream DNS server
-func (s *DNSServer) handleUpstreamRequest(w dns.ResponseWriter, r *dns.Msg) {
-	response, err := s.forwardRequest(r)
+func (s *DNSServer) handleUpstreamRequest(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+	response, err := s.forwardRequest(r, rc)
 	if err != nil {
 		s.sendServerFailure(w, r, err)
 		return
 	}
 
+	// Replace negative upstream answers with a configured default answer
+	if synthesized, ok := s.synthesizeAnswer(r, response); ok {
+		response = synthesized
+	}
+
 	// Send the response
+	s.applyTTLJitter(response)
 	w.WriteMsg(response)
 }
 
@@ -208,50 +1087,481 @@ func (s *DNSServer) sendServerFailure(w dns.ResponseWriter, r *dns.Msg, err erro
 }
 
 // forwardRequest forwards a DNS request to the appropriate upstream server
-func (s *DNSServer) forwardRequest(r *dns.Msg) (*dns.Msg, error) {
+// Transport errors fail over to the next upstream; SERVFAIL responses are
+// passed through when passthrough_servfail is set and fail over otherwise
+func (s *DNSServer) forwardRequest(r *dns.Msg, rc *requestContext) (*dns.Msg, error) {
 	if len(r.Question) == 0 {
 		return nil, fmt.Errorf("empty question section")
 	}
 
-	// Always use the first upstream for now
-	// In a more advanced implementation, this is where routing logic would go
-	var upstreamName string
-	for name := range s.config.Upstreams {
-		upstreamName = name
-		break
+	domain := getDomainFromQuestion(r.Question[0])
+
+	// Apply the policy for the transport the query arrived over
+	policy := s.transportPolicy(rc.transport)
+	if policy.StripECS {
+		r = stripECS(r)
 	}
 
-	upstream := s.config.Upstreams[upstreamName]
-	client := s.upstreams[upstreamName]
+	// Ask upstreams to validate even when the client set the CD bit
+	clientCD := r.CheckingDisabled
+	if clientCD && s.currentConfig().Server.CDBit == CDBitClear {
+		r = r.Copy()
+		r.CheckingDisabled = false
+	}
+
+	// Serve from the cache when possible, debug queries and bypass clients
+	// always go upstream and leave the cache untouched
+	cache := s.currentCache()
+	key := cacheKey(r, s.currentConfig().Cache.RespectECS)
+	if policy.Upstream != "" {
+		// Keep answers from a transport's own upstream apart
+		key += "|" + rc.transport
+	}
+	switch {
+	case cache == nil:
+		rc.trace.cache(CacheStatusDisabled)
+	case rc.debug || containsIP(s.currentConfig().Server.cacheBypassNets, rc.clientIP):
+		rc.trace.cache(CacheStatusBypass)
+		cache = nil
+	default:
+		if cached, ok := cache.Get(key); ok {
+			s.metrics.CacheHits.Add(1)
+			rc.trace.cache(CacheStatusHit)
+			cached.Id = r.Id
+			cached.Question = r.Question
+			cached.CheckingDisabled = clientCD
+			return cached, nil
+		}
+		s.metrics.CacheMisses.Add(1)
+		if s.currentConfig().Cache.StatsInterval > 0 {
+			s.missed.add(domain)
+		}
+		rc.trace.cache(CacheStatusMiss)
+	}
+
+	upstreamNames, reason, err := s.upstreamOrder(domain, r.Question[0].Qtype)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Upstream != "" {
+		upstreamNames = []string{policy.Upstream}
+		reason = fmt.Sprintf("%s transport policy", rc.transport)
+	}
+	if pinned := s.currentConfig().Debug.Upstream; rc.debug && pinned != "" {
+		upstreamNames = []string{pinned}
+		reason = "pinned for debug client"
+	}
+	logRouting := s.currentConfig().Server.LogRouting
+
+	var lastErr error
+	var lastResponse *dns.Msg
+
+	for i, upstreamName := range upstreamNames {
+		if logRouting {
+			if i > 0 {
+				reason = fmt.Sprintf("failover after %s failed", upstreamNames[i-1])
+			}
+			log.Printf("Routing %s %s to upstream %s: %s", domain, dns.TypeToString[r.Question[0].Qtype], upstreamName, reason)
+		}
 
+		exchangeStart := time.Now()
+		response, err := s.exchangeWithUpstream(upstreamName, r)
+		if rc.debug {
+			logDebugExchange(upstreamName, domain, response, err)
+		}
+		if s.currentConfig().Upstreams[upstreamName].LogQueries {
+			logUpstreamExchange(upstreamName, r.Question[0], response, err, time.Since(exchangeStart))
+		}
+		if err != nil {
+			log.Printf("Upstream %s failed for %s: %v", upstreamName, domain, err)
+			s.metrics.UpstreamError(upstreamName)
+			lastErr = err
+			continue
+		}
+
+		s.metrics.UpstreamAnswer(upstreamName)
+		rc.trace.upstream(upstreamName)
+
+		if s.currentConfig().Server.StableAnswerOrder {
+			sortRRsets(response.Answer)
+		}
+
+		// Bound the size of absurdly large upstream answers, marking them
+		// truncated so clients know they are partial and they are not cached
+		if limit := s.currentConfig().Server.MaxUpstreamAnswers; limit > 0 && len(response.Answer) > limit {
+			truncated := truncateAnswer(response.Answer, limit)
+			log.Printf("Truncating answer from upstream %s for %s from %d to %d records", upstreamName, domain, len(response.Answer), len(truncated))
+			response.Answer = truncated
+			response.Truncated = true
+		}
+
+		// Try the NXDOMAIN fallback upstream, e.g. for split-horizon names
+		if response.Rcode == dns.RcodeNameError {
+			if retried, ok := s.retryNXDomain(upstreamName, domain, r); ok {
+				response = retried
+			}
+		}
+
+		if cache != nil {
+			minTTL := uint32(s.currentConfig().Cache.MinCacheTTL)
+			if s.currentConfig().Cache.FloorClientTTL {
+				floorTTLs(response, minTTL)
+			}
+			if ttl, ok := findCacheOverride(s.currentConfig().CacheOverrides, domain); ok {
+				cache.SetOverride(key, response, ttl)
+			} else {
+				cache.Set(key, response, minTTL)
+			}
+		}
+
+		if response.Rcode == dns.RcodeServerFailure && !s.currentConfig().Server.PassthroughServFail {
+			log.Printf("Upstream %s returned SERVFAIL for %s", upstreamName, domain)
+			lastResponse = response
+			continue
+		}
+
+		// Reflect the client's CD bit, the AD bit is passed through from the upstream
+		response.CheckingDisabled = clientCD
+		return response, nil
+	}
+
+	// Fall back to a recently expired answer rather than failing
+	if cache != nil && s.currentConfig().Cache.ServeStaleOnError {
+		if stale, ok := cache.GetStale(key, cacheMaxStale(s.currentConfig())); ok {
+			log.Printf("Serving stale answer for %s after upstream failure", domain)
+			stale.Id = r.Id
+			stale.Question = r.Question
+			stale.CheckingDisabled = clientCD
+			return stale, nil
+		}
+	}
+
+	// Briefly remember the failure so repeated queries don't hammer broken upstreams
+	if servfailTTL := s.currentConfig().Cache.ServFailTTL; cache != nil && servfailTTL > 0 {
+		failure := lastResponse
+		if failure == nil {
+			failure = new(dns.Msg)
+			failure.SetRcode(r, dns.RcodeServerFailure)
+		}
+		cache.SetFailure(key, failure, time.Duration(servfailTTL)*time.Second)
+	}
+
+	// Every upstream failed, prefer an actual upstream answer over an error
+	if lastResponse != nil {
+		return lastResponse, nil
+	}
+
+	return nil, lastErr
+}
+
+// upstreamQuery adjusts the EDNS options of a request for an upstream
+// The request is copied when it needs changes
+func upstreamQuery(upstream UpstreamConfig, r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return r
+	}
+
+	switch {
+	case upstream.DisableEDNS:
+		query := r.Copy()
+		extra := query.Extra[:0]
+		for _, rr := range query.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		query.Extra = extra
+		return query
+	case upstream.EDNSUDPSize != 0 && opt.UDPSize() != upstream.EDNSUDPSize:
+		query := r.Copy()
+		query.IsEdns0().SetUDPSize(upstream.EDNSUDPSize)
+		return query
+	}
+
+	return r
+}
+
+// exchangeWithUpstream sends a DNS request to the named upstream server
+// Failed or truncated exchanges are retried over the upstream's fallback protocols
+func (s *DNSServer) exchangeWithUpstream(upstreamName string, r *dns.Msg) (*dns.Msg, error) {
+	upstream, client, ok := s.getUpstream(upstreamName)
+	if !ok {
+		return nil, fmt.Errorf("upstream %s is no longer configured", upstreamName)
+	}
+
+	r = upstreamQuery(upstream, r)
+
+	// Forward the request
+	response, err := s.exchangeOverTransport(upstreamName, upstream, client, upstream.Port, r)
+
+	// Fetch the full answer for truncated UDP responses, clients with a
+	// smaller buffer still get it truncated by the UDP response writer
+	if err == nil && response.Truncated && !upstream.KeepTruncated && (client.Net == "" || client.Net == "udp") {
+		log.Printf("Retrying truncated response from upstream %s over TCP", upstreamName)
+		tcpClient := newUpstreamClient("tcp")
+		if full, tcpErr := s.exchangeOverTransport(upstreamName, upstream, tcpClient, upstream.Port, r); tcpErr == nil {
+			response = full
+		} else {
+			log.Printf("TCP retry to upstream %s failed: %v", upstreamName, tcpErr)
+		}
+	}
+
+	for _, fallback := range upstream.FallbackProtocols {
+		if err == nil && !response.Truncated {
+			break
+		}
+
+		protocol, port, parseErr := ParseFallbackProtocol(fallback, upstream.Port)
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to query upstream %s: %w", upstreamName, parseErr)
+		}
+
+		log.Printf("Falling back to %s on port %d for upstream %s", protocol, port, upstreamName)
+		fallbackClient := newUpstreamClient(protocol)
+		fallbackClient.TLSConfig = client.TLSConfig
+		response, err = s.exchangeOverTransport(upstreamName, upstream, fallbackClient, port, r)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream %s: %w", upstreamName, err)
+	}
+
+	if s.currentConfig().Server.ValidateResponses {
+		if err := validateResponse(r, response); err != nil {
+			return nil, fmt.Errorf("rejected response from upstream %s: %w", upstreamName, err)
+		}
+	}
+
+	return response, nil
+}
+
+// exchangeOverTransport sends a DNS request to an upstream using the given client and port
+func (s *DNSServer) exchangeOverTransport(upstreamName string, upstream UpstreamConfig, client *dns.Client, port int, r *dns.Msg) (*dns.Msg, error) {
 	// Construct the address
 	upstreamAddr := net.JoinHostPort(
 		upstream.Address,
-		strconv.Itoa(upstream.Port),
+		strconv.Itoa(port),
 	)
 
-	// Forward the request
-	response, _, err := client.Exchange(r, upstreamAddr)
+	if err := s.waitEgress(upstreamName, upstream); err != nil {
+		return nil, err
+	}
+	response, err := exchange(client, r, upstreamName, upstreamAddr)
+
+	var malformed *MalformedResponseError
+	if errors.As(err, &malformed) {
+		log.Printf("Malformed response from upstream %s: %d bytes: %v", upstreamName, malformed.Length, malformed.Err)
+
+		// A malformed UDP response may still succeed over TCP
+		if upstream.RetryMalformedTCP && (client.Net == "" || client.Net == "udp") {
+			log.Printf("Retrying query to upstream %s over TCP", upstreamName)
+			if err := s.waitEgress(upstreamName, upstream); err != nil {
+				return nil, err
+			}
+			response, err = exchange(newUpstreamClient("tcp"), r, upstreamName, upstreamAddr)
+		}
+	}
+
+	return response, err
+}
+
+// waitEgress takes a token from an upstream's egress rate limit before a
+// query is sent to it, so retries and fallbacks count against the limit too
+func (s *DNSServer) waitEgress(upstreamName string, upstream UpstreamConfig) error {
+	limiter := s.egressLimiter(upstreamName)
+	if limiter == nil {
+		return nil
+	}
+
+	if !limiter.Wait(upstreamName, time.Duration(upstream.RateLimitWait)*time.Millisecond) {
+		return fmt.Errorf("upstream %s is over its rate limit", upstreamName)
+	}
+	return nil
+}
+
+// nxdomainRetryUpstream returns the upstream to retry NXDOMAIN answers for a domain with
+// A matching nxdomain_retry_routes pattern wins over on_nxdomain_retry_upstream
+func (s *DNSServer) nxdomainRetryUpstream(domain string) string {
+	config := s.currentConfig()
+	if name, ok := matchRoute(config.NXDomainRetryRoutes, domain); ok {
+		return name
+	}
+	return config.Server.OnNXDomainRetryUpstream
+}
+
+// retryNXDomain re-queries the NXDOMAIN fallback upstream after an NXDOMAIN answer
+// Returns the fallback's response only when it is a positive answer
+func (s *DNSServer) retryNXDomain(upstreamName, domain string, r *dns.Msg) (*dns.Msg, bool) {
+	fallback := s.nxdomainRetryUpstream(domain)
+	if fallback == "" || fallback == upstreamName {
+		return nil, false
+	}
+
+	response, err := s.exchangeWithUpstream(fallback, r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query upstream %s: %w", upstreamName, err)
+		log.Printf("NXDOMAIN fallback upstream %s failed for %s: %v", fallback, domain, err)
+		s.metrics.UpstreamError(fallback)
+		return nil, false
 	}
+	s.metrics.UpstreamAnswer(fallback)
 
-	return response, nil
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) == 0 {
+		return nil, false
+	}
+
+	return response, true
 }
 
-// RouteByDomain would route DNS requests based on the domain name
-// This is a placeholder for future implementation
-func (s *DNSServer) routeByDomain(domain string) (string, error) {
-	// This is where you would implement domain-based routing logic
-	// For now, we'll just return the first upstream
-	for name := range s.config.Upstreams {
-		return name, nil
+// upstreamOrder returns the upstreams to try for a query, starting with the
+// routed upstream and followed by the others in name order for failover,
+// along with the reason the first one was chosen
+func (s *DNSServer) upstreamOrder(domain string, qtype uint16) ([]string, string, error) {
+	preferred, reason, err := s.route(domain, qtype)
+	if err != nil {
+		return nil, "", err
+	}
+
+	names := []string{preferred}
+	for _, name := range sortedUpstreamNames(s.currentConfig().Upstreams) {
+		if name != preferred {
+			names = append(names, name)
+		}
 	}
 
-	return "", fmt.Errorf("no suitable upstream found for domain: %s", domain)
+	return names, reason, nil
 }
 
-// getDomainFromQuestion extracts the domain name from a DNS question
+// route selects the upstream for a query: a matching domain route wins,
+// then a route for the query type, then the first upstream
+// The reason describes which of them applied
+func (s *DNSServer) route(domain string, qtype uint16) (string, string, error) {
+	routes := s.currentConfig().Routes
+	if pattern, ok := matchRoutePattern(routes, domain); ok {
+		return s.routeTarget(routes[pattern]), fmt.Sprintf("domain route %s -> %s", pattern, routes[pattern]), nil
+	}
+
+	if target, ok := s.routeByType(qtype); ok {
+		return s.routeTarget(target), fmt.Sprintf("type route %s -> %s", dns.TypeToString[qtype], target), nil
+	}
+
+	for _, name := range sortedUpstreamNames(s.currentConfig().Upstreams) {
+		return name, "no matching route, first upstream", nil
+	}
+
+	return "", "", fmt.Errorf("no suitable upstream found for domain: %s", domain)
+}
+
+// matchRoute returns the value of the most specific pattern in routes matching the domain
+func matchRoute(routes map[string]string, domain string) (string, bool) {
+	pattern, ok := matchRoutePattern(routes, domain)
+	return routes[pattern], ok
+}
+
+// matchRoutePattern returns the most specific pattern in routes matching the domain
+func matchRoutePattern(routes map[string]string, domain string) (string, bool) {
+	bestPattern := ""
+	bestScore := -1
+
+	for pattern := range routes {
+		if !MatchDomain(pattern, domain) {
+			continue
+		}
+
+		// Break ties by pattern so the choice does not depend on map order
+		score := matchSpecificity(pattern)
+		if score > bestScore || (score == bestScore && pattern < bestPattern) {
+			bestPattern, bestScore = pattern, score
+		}
+	}
+
+	if bestScore < 0 {
+		return "", false
+	}
+	return bestPattern, true
+}
+
+// routeByType returns the upstream routed for a query type
+func (s *DNSServer) routeByType(qtype uint16) (string, bool) {
+	name, ok := s.currentConfig().TypeRoutes[dns.TypeToString[qtype]]
+	return name, ok
+}
+
+// routeTarget returns the upstream a route target refers to, taking turns
+// between the members of a tag for "tag:<name>" targets
+func (s *DNSServer) routeTarget(target string) string {
+	tag, ok := strings.CutPrefix(target, tagRoutePrefix)
+	if !ok {
+		return target
+	}
+
+	members := taggedUpstreams(s.currentConfig().Upstreams, tag)
+	if len(members) == 0 {
+		return target
+	}
+	return members[s.tagTurn.Add(1)%uint64(len(members))]
+}
+
+// taggedUpstreams returns the names of the upstreams with a tag in a stable order
+func taggedUpstreams(upstreams map[string]UpstreamConfig, tag string) []string {
+	members := []string{}
+	for _, name := range sortedUpstreamNames(upstreams) {
+		if slices.Contains(upstreams[name].Tags, tag) {
+			members = append(members, name)
+		}
+	}
+	return members
+}
+
+// validRouteTarget reports whether a route target names an upstream or a tag
+// carried by at least one upstream
+func validRouteTarget(upstreams map[string]UpstreamConfig, target string) bool {
+	if tag, ok := strings.CutPrefix(target, tagRoutePrefix); ok {
+		return len(taggedUpstreams(upstreams, tag)) > 0
+	}
+	_, ok := upstreams[target]
+	return ok
+}
+
+// sortedUpstreamNames returns the upstream names in a stable order
+func sortedUpstreamNames(upstreams map[string]UpstreamConfig) []string {
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// getDomainFromQuestion extracts the normalized domain name from a DNS question
 func getDomainFromQuestion(q dns.Question) string {
-	return strings.TrimSuffix(q.Name, ".")
+	return normalizeName(q.Name)
+}
+
+// normalizeName returns the form of a domain name used for matching, cache
+// keys and logs: lower case without the trailing dot
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// getClientIP extracts the client IP address from a remote address
+func getClientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return unmapIP(a.IP)
+	case *net.TCPAddr:
+		return unmapIP(a.IP)
+	}
+
+	return unmapIP(net.ParseIP(remoteHost(addr)))
+}
+
+// unmapIP returns IPv4-mapped IPv6 addresses, as reported for IPv4 clients
+// of a listener bound to ::, in their IPv4 form so IPv4 rules apply to them
+func unmapIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
 }
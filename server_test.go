@@ -0,0 +1,1079 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testConfig is a minimal configuration for servers built in tests
+const testConfig = `
+[server]
+records_file = "records.toml"
+
+[upstreams.primary]
+address = "127.0.0.1"
+port = 53
+protocol = "udp"
+`
+
+// writeTestFile writes a file in dir, creating dir if needed, and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("failed to create %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// loadTestConfig writes a config file and loads it
+// Relative records paths are resolved against the config file's directory
+func loadTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	config, err := LoadConfig(writeTestFile(t, dir, "config.toml", content))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if !filepath.IsAbs(config.Server.RecordsFile) {
+		config.Server.RecordsFile = filepath.Join(dir, config.Server.RecordsFile)
+	}
+	return config
+}
+
+// newTestServer creates a server for the config
+func newTestServer(t *testing.T, config *Config, options ...ServerOption) *DNSServer {
+	t.Helper()
+
+	server, err := NewDNSServer(config, options...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	return server
+}
+
+// setTestRecords replaces the loaded records for the duration of a test
+func setTestRecords(t *testing.T, records ...RecordEntry) {
+	t.Helper()
+
+	for i := range records {
+		if err := records[i].parseClientNets(); err != nil {
+			t.Fatalf("failed to parse client networks: %v", err)
+		}
+		if err := records[i].parseValidity(); err != nil {
+			t.Fatalf("failed to parse validity: %v", err)
+		}
+	}
+
+	Records.mu.Lock()
+	previous := Records.Records
+	Records.Records = records
+	Records.mu.Unlock()
+
+	t.Cleanup(func() {
+		Records.mu.Lock()
+		Records.Records = previous
+		Records.mu.Unlock()
+	})
+}
+
+// testWriter captures the response written to a client
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+// newTestWriter returns a writer for a client at addr over UDP or, with tcp set, TCP
+func newTestWriter(addr string, tcp bool) *testWriter {
+	ip := net.ParseIP(addr)
+	if tcp {
+		return &testWriter{remote: &net.TCPAddr{IP: ip, Port: 5353}}
+	}
+	return &testWriter{remote: &net.UDPAddr{IP: ip, Port: 5353}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg stores the response
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write stores a packed response
+func (w *testWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return nil }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+// waitFor polls cond until it holds or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+// ask sends a query for name and type to the server from a UDP client and
+// returns the response, nil if none was written
+func ask(server *DNSServer, name string, qtype uint16) *dns.Msg {
+	w := newTestWriter("10.0.0.1", false)
+	server.handleRequest(w, query(name, qtype))
+	return w.msg
+}
+
+// query builds a recursive query for a name and type
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	return m
+}
+
+// serverTestConfig returns testConfig with extra [server] settings
+func serverTestConfig(settings string) string {
+	return strings.Replace(testConfig, "[server]\n", "[server]\n"+settings+"\n", 1)
+}
+
+// startTestUpstream serves DNS over UDP on a loopback port with handler and
+// points the config's primary upstream at it
+func startTestUpstream(t *testing.T, config *Config, handler dns.HandlerFunc) {
+	t.Helper()
+	startNamedTestUpstream(t, config, "primary", handler)
+}
+
+// startNamedTestUpstream serves DNS over UDP on a loopback port with handler
+// and points the named upstream at it, adding the upstream if needed
+func startNamedTestUpstream(t *testing.T, config *Config, name string, handler dns.HandlerFunc) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	upstream, ok := config.Upstreams[name]
+	if !ok {
+		upstream = UpstreamConfig{Address: "127.0.0.1", Protocol: "udp"}
+	}
+	upstream.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	config.Upstreams[name] = upstream
+}
+
+// answerFor builds a positive response to r with a single A record
+func answerFor(r *dns.Msg, ip string, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP(ip),
+	})
+	return m
+}
+
+// freePort returns a loopback port free for both UDP and TCP
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	for i := 0; i < 10; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+
+		if listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			listener.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+// startDualTestUpstream serves DNS over both UDP and TCP on the same loopback
+// port with handler and points the named upstream at it
+func startDualTestUpstream(t *testing.T, config *Config, name string, handler dns.HandlerFunc) {
+	t.Helper()
+
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan struct{})
+		server := &dns.Server{Addr: addr, Net: network, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+		go server.ListenAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+
+	upstream, ok := config.Upstreams[name]
+	if !ok {
+		upstream = UpstreamConfig{Address: "127.0.0.1", Protocol: "udp"}
+	}
+	upstream.Port = port
+	config.Upstreams[name] = upstream
+}
+
+// overTCP reports whether a query was received over TCP
+func overTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
+// recordsAdminConfig is a test configuration with an admin token
+const recordsAdminConfig = testConfig + `
+[admin]
+token = "secret"
+`
+
+// captureLog redirects the standard logger for the duration of a test
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+// logBuffer collects log output written from several goroutines
+type logBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testRecords is a records file with a single A record for name
+func testRecords(name, value string) string {
+	return "[[records]]\ndomain = \"" + name + "\"\ntype = \"A\"\nvalue = \"" + value + "\"\nttl = 60\n"
+}
+
+// largeAnswerFor answers r with a CNAME to target.test followed by count A records for it
+func largeAnswerFor(r *dns.Msg, count int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "target.test.",
+	})
+	for i := 0; i < count; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "target.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		})
+	}
+	return m
+}
+
+func TestQueryForMissingTypeAnswersWithCNAME(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "alias.test", Type: "CNAME", Value: "target.example.", TTL: 60},
+		RecordEntry{Domain: "alias.test", Type: "TXT", Value: "note", TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	m := ask(server, "alias.test", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 {
+		t.Fatalf("got %v, want the CNAME", m)
+	}
+	if cname, ok := m.Answer[0].(*dns.CNAME); !ok || cname.Target != "target.example." {
+		t.Errorf("got %v, want a CNAME to target.example.", m.Answer[0])
+	}
+
+	m = ask(server, "alias.test", dns.TypeTXT)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeTXT {
+		t.Errorf("got %v, want the TXT record rather than the CNAME", m)
+	}
+}
+
+func TestRecordClientRestrictions(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "internal.test", Type: "A", Value: "10.0.0.10", TTL: 60,
+			AllowClients: []string{"10.0.0.0/8"}, DenyClients: []string{"10.9.0.0/16"}},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	tests := []struct {
+		client string
+		rcode  int
+		answer bool
+	}{
+		{"10.1.2.3", dns.RcodeSuccess, true},
+		{"10.9.1.1", dns.RcodeNameError, false},
+		{"203.0.113.5", dns.RcodeNameError, false},
+	}
+
+	for _, tt := range tests {
+		w := newTestWriter(tt.client, false)
+		server.handleRequest(w, query("internal.test", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != tt.rcode || (len(w.msg.Answer) > 0) != tt.answer {
+			t.Errorf("client %s got %v, want rcode %s with answer %v", tt.client, w.msg, dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+}
+
+// servFail answers every query with SERVFAIL
+func servFail(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+func TestUpstreamServFailHandling(t *testing.T) {
+	for _, passthrough := range []bool{false, true} {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig("passthrough_servfail = "+strconv.FormatBool(passthrough)))
+		startTestUpstream(t, config, servFail)
+		startNamedTestUpstream(t, config, "secondary", func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+		})
+		server := newTestServer(t, config)
+
+		m := ask(server, "remote.test", dns.TypeA)
+		if passthrough {
+			if m == nil || m.Rcode != dns.RcodeServerFailure {
+				t.Errorf("with passthrough got %v, want the primary's SERVFAIL", m)
+			}
+		} else if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+			t.Errorf("without passthrough got %v, want the secondary's answer", m)
+		}
+	}
+}
+
+func TestUpstreamTransportErrorFailsOver(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("passthrough_servfail = true"))
+	primary := config.Upstreams["primary"]
+	primary.Port = freePort(t)
+	config.Upstreams["primary"] = primary
+	startNamedTestUpstream(t, config, "secondary", func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	m := ask(server, "remote.test", dns.TypeA)
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the secondary's answer after the primary failed", m)
+	}
+}
+
+func TestStartupSummary(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "one.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+		RecordEntry{Domain: "two.test", Type: "A", Value: "192.0.2.2", TTL: 60},
+	)
+	config := loadTestConfig(t, serverTestConfig("ttl_jitter = 5")+`
+[upstreams.secondary]
+address = "192.0.2.53"
+port = 53
+protocol = "tcp"
+`)
+	server := newTestServer(t, config)
+
+	summary := server.startupSummary()
+	for _, want := range []string{"records=2", "primary(udp://127.0.0.1:53)", "secondary(tcp://192.0.2.53:53)", "ttl_jitter=5s"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary %q does not contain %q", summary, want)
+		}
+	}
+}
+
+func TestReloadAddsSelectableUpstream(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	if m := ask(server, "www.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Fatalf("before the reload got %v, want 198.51.100.1", m)
+	}
+
+	// The reloaded config replaces primary with a new upstream
+	reloaded := loadTestConfig(t, testConfig)
+	delete(reloaded.Upstreams, "primary")
+	startNamedTestUpstream(t, reloaded, "standby", func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.2", 60))
+	})
+	server.Reload(reloaded)
+
+	if m := ask(server, "www.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.2" {
+		t.Errorf("after the reload got %v, want 198.51.100.2", m)
+	}
+}
+
+func TestNewDNSServerRequiresValidUpstream(t *testing.T) {
+	config := loadTestConfig(t, testConfig)
+
+	// Configs built without LoadConfig may still hold invalid upstreams
+	upstream := config.Upstreams["primary"]
+	upstream.Protocol = "quic"
+	config.Upstreams["primary"] = upstream
+	if _, err := NewDNSServer(config); err == nil || !strings.Contains(err.Error(), "no valid upstream") {
+		t.Errorf("got %v, want an error for no valid upstream", err)
+	}
+
+	// A valid upstream is kept and the invalid one skipped
+	config.Upstreams["backup"] = UpstreamConfig{Address: "127.0.0.1", Port: 53, Protocol: "udp"}
+	server, err := NewDNSServer(config)
+	if err != nil {
+		t.Fatalf("NewDNSServer: %v", err)
+	}
+	if _, _, ok := server.getUpstream("primary"); ok {
+		t.Error("the invalid upstream has a client")
+	}
+	if _, _, ok := server.getUpstream("backup"); !ok {
+		t.Error("the valid upstream has no client")
+	}
+}
+
+func TestTypeRouteSendsMXToMailUpstream(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+"\n[type_routes]\nMX = \"smtp\"\n\n[upstreams.smtp]\naddress = \"127.0.0.1\"\nport = 53\n")
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	startNamedTestUpstream(t, config, "smtp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.MX{
+			Hdr:        dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+			Preference: 10,
+			Mx:         "mx.mail.test.",
+		})
+		w.WriteMsg(m)
+	})
+	server := newTestServer(t, config)
+
+	m := ask(server, "example.test", dns.TypeMX)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeMX {
+		t.Errorf("MX query got %v, want the mail upstream's answer", m)
+	}
+
+	m = ask(server, "example.test", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("A query got %v, want the primary's answer", m)
+	}
+}
+
+func TestMaxRRsetSize(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "many.test", Type: "A", Value: "192.0.2.1", TTL: 60,
+		Values: []string{"192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"}})
+	logs := captureLog(t)
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig("max_rrset_size = 3")))
+
+	m := ask(server, "many.test", dns.TypeA)
+	if m == nil || len(m.Answer) != 3 {
+		t.Fatalf("got %v, want exactly 3 answers", m)
+	}
+	if !strings.Contains(logs.String(), "Truncating many.test A RRset from 5 to 3 records") {
+		t.Errorf("expected the truncation to be logged, got %q", logs.String())
+	}
+}
+
+func TestMaxUpstreamAnswers(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("max_upstream_answers = 5")+"\n[cache]\nenabled = true\n")
+	var queries atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		w.WriteMsg(largeAnswerFor(r, 10))
+	})
+	logs := captureLog(t)
+	server := newTestServer(t, config)
+
+	for i := 0; i < 2; i++ {
+		m := ask(server, "large.test", dns.TypeA)
+		if m == nil || len(m.Answer) != 5 || !m.Truncated {
+			t.Fatalf("got %v, want 5 answers with TC set", m)
+		}
+		if _, ok := m.Answer[0].(*dns.CNAME); !ok {
+			t.Fatalf("got %v, want the CNAME kept ahead of its target records", m.Answer)
+		}
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("upstream queried %d times, want 2 as truncated answers are not cached", got)
+	}
+	if !strings.Contains(logs.String(), "for large.test from 11 to 5 records") {
+		t.Errorf("expected the truncation to be logged, got %q", logs.String())
+	}
+}
+
+func TestTruncateAnswer(t *testing.T) {
+	rrs := func(records ...string) []dns.RR {
+		var answers []dns.RR
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatalf("bad record %q: %v", record, err)
+			}
+			answers = append(answers, rr)
+		}
+		return answers
+	}
+
+	tests := []struct {
+		name    string
+		answers []dns.RR
+		limit   int
+		want    int
+	}{
+		{"under limit", rrs("a.test. 60 IN A 192.0.2.1"), 2, 1},
+		{"cut at RRset boundary", rrs(
+			"a.test. 60 IN A 192.0.2.1", "a.test. 60 IN A 192.0.2.2",
+			"a.test. 60 IN TXT x", "a.test. 60 IN TXT y"), 3, 2},
+		{"first RRset split", rrs(
+			"a.test. 60 IN A 192.0.2.1", "a.test. 60 IN A 192.0.2.2", "a.test. 60 IN A 192.0.2.3"), 2, 2},
+		{"no dangling CNAME", rrs(
+			"a.test. 60 IN A 192.0.2.1", "b.test. 60 IN CNAME c.test.",
+			"c.test. 60 IN A 192.0.2.2", "c.test. 60 IN A 192.0.2.3"), 3, 1},
+	}
+
+	for _, tt := range tests {
+		got := truncateAnswer(tt.answers, tt.limit)
+		if len(got) != tt.want {
+			t.Errorf("%s: got %d records %v, want %d", tt.name, len(got), got, tt.want)
+		}
+	}
+}
+
+func TestResolvableDomainsAllowlist(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "open.internal.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig(`resolvable_domains = ["*.internal.test"]`)))
+
+	if m := ask(server, "open.internal.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the in-list name to resolve", m)
+	}
+	if m := ask(server, "example.com", dns.TypeA); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("got %v, want REFUSED for an out-of-list name", m)
+	}
+}
+
+func TestNXDomainRetriedOnFallbackUpstream(t *testing.T) {
+	nxdomain := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	}
+	tests := []struct {
+		name     string
+		settings string
+		routes   string
+	}{
+		{"global", `on_nxdomain_retry_upstream = "retry"`, ""},
+		{"per route", "", "\n[nxdomain_retry_routes]\n\"_**.corp.test\" = \"retry\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestRecords(t)
+			config := loadTestConfig(t, serverTestConfig(tt.settings)+tt.routes+"\n[upstreams.retry]\naddress = \"127.0.0.1\"\nport = 53\n")
+			startTestUpstream(t, config, nxdomain)
+			startNamedTestUpstream(t, config, "retry", func(w dns.ResponseWriter, r *dns.Msg) {
+				w.WriteMsg(answerFor(r, "10.1.2.3", 60))
+			})
+			server := newTestServer(t, config)
+
+			m := ask(server, "intranet.corp.test", dns.TypeA)
+			if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.1.2.3" {
+				t.Errorf("got %v, want the fallback's answer", m)
+			}
+		})
+	}
+}
+
+// answerOwners lists the owner and type of each answer record
+func answerOwners(answers []dns.RR) string {
+	parts := make([]string, len(answers))
+	for i, rr := range answers {
+		parts[i] = rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TestLocalCNAMEChainOrder(t *testing.T) {
+	setTestRecords(t,
+		RecordEntry{Domain: "www.chain.test", Type: "CNAME", Value: "edge.chain.test", TTL: 60},
+		RecordEntry{Domain: "edge.chain.test", Type: "CNAME", Value: "host.chain.test", TTL: 60},
+		RecordEntry{Domain: "host.chain.test", Type: "A", Value: "192.0.2.1", TTL: 60, Values: []string{"192.0.2.2"}},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	m := ask(server, "www.chain.test", dns.TypeA)
+	want := "www.chain.test. CNAME, edge.chain.test. CNAME, host.chain.test. A, host.chain.test. A"
+	if m == nil || answerOwners(m.Answer) != want {
+		t.Errorf("got %v, want answers in chain order: %s", m, want)
+	}
+}
+
+func TestOrderCNAMEChain(t *testing.T) {
+	rr := func(s string) dns.RR {
+		record, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+		return record
+	}
+
+	// Gathered out of order, with an unrelated record mixed in
+	answers := []dns.RR{
+		rr("host.chain.test. 60 IN A 192.0.2.1"),
+		rr("other.test. 60 IN A 192.0.2.9"),
+		rr("edge.chain.test. 60 IN CNAME host.chain.test."),
+		rr("WWW.chain.test. 60 IN CNAME edge.chain.test."),
+	}
+
+	got := answerOwners(orderCNAMEChain(answers, "www.chain.test."))
+	want := "WWW.chain.test. CNAME, edge.chain.test. CNAME, host.chain.test. A, other.test. A"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCDBitPropagation(t *testing.T) {
+	for _, tt := range []struct {
+		policy     string
+		upstreamCD bool
+	}{
+		{CDBitForward, true},
+		{CDBitClear, false},
+	} {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig(`cd_bit = "`+tt.policy+`"`)+"\n[cache]\nenabled = true\n")
+		seen := make(chan bool, 4)
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			seen <- r.CheckingDisabled
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		})
+		server := newTestServer(t, config)
+
+		r := query("signed.test", dns.TypeA)
+		r.CheckingDisabled = true
+		w := newTestWriter("10.0.0.1", false)
+		server.handleRequest(w, r)
+
+		if w.msg == nil || len(w.msg.Answer) != 1 || !w.msg.CheckingDisabled {
+			t.Errorf("%s: got %v, want the answer with the client's CD bit", tt.policy, w.msg)
+		}
+		if got := <-seen; got != tt.upstreamCD {
+			t.Errorf("%s: upstream saw CD = %t, want %t", tt.policy, got, tt.upstreamCD)
+		}
+
+		// A query without CD is answered with CD clear, and never from a
+		// CD query's unvalidated answer
+		if m := ask(server, "signed.test", dns.TypeA); m == nil || m.CheckingDisabled {
+			t.Errorf("%s: got %v, want CD clear", tt.policy, m)
+		}
+		if tt.policy == CDBitForward && len(seen) != 1 {
+			t.Errorf("%s: the query without CD was answered from the CD query's cache entry", tt.policy)
+		}
+	}
+}
+
+func TestLargeStreamAnswerTruncatedForUDPClient(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	upstream := config.Upstreams["primary"]
+	upstream.Protocol = "tcp"
+	config.Upstreams["primary"] = upstream
+	startDualTestUpstream(t, config, "primary", func(w dns.ResponseWriter, r *dns.Msg) {
+		if !overTCP(w) {
+			servFail(w, r)
+			return
+		}
+		w.WriteMsg(largeAnswerFor(r, 60))
+	})
+	server := newTestServer(t, config)
+
+	tests := []struct {
+		name      string
+		tcp       bool
+		bufSize   uint16
+		truncated bool
+	}{
+		{"udp without edns", false, 0, true},
+		{"udp with a small buffer", false, 800, true},
+		{"udp with a large buffer", false, 4096, false},
+		{"tcp", true, 0, false},
+	}
+	for _, tt := range tests {
+		r := query("big.test", dns.TypeA)
+		if tt.bufSize != 0 {
+			r.SetEdns0(tt.bufSize, false)
+		}
+		w := newTestWriter("10.0.0.1", tt.tcp)
+		server.handleRequest(w, r)
+
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: got %v, want an answer", tt.name, w.msg)
+			continue
+		}
+		if w.msg.Truncated != tt.truncated {
+			t.Errorf("%s: truncated = %t, want %t", tt.name, w.msg.Truncated, tt.truncated)
+		}
+		limit := dns.MaxMsgSize
+		if !tt.tcp {
+			limit = int(max(tt.bufSize, dns.MinMsgSize))
+		}
+		if size := w.msg.Len(); size > limit {
+			t.Errorf("%s: response of %d bytes exceeds the %d byte limit", tt.name, size, limit)
+		}
+		if !tt.truncated && len(w.msg.Answer) != 61 {
+			t.Errorf("%s: got %d answers, want all 61", tt.name, len(w.msg.Answer))
+		}
+	}
+}
+
+func TestTagRouteBalancesAcrossTaggedUpstreams(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+`
+[routes]
+"*.private.test" = "tag:encrypted"
+
+[upstreams.secure-a]
+address = "127.0.0.1"
+port = 53
+tags = ["encrypted"]
+
+[upstreams.secure-b]
+address = "127.0.0.1"
+port = 53
+tags = ["encrypted", "fast"]
+`)
+	var mu sync.Mutex
+	counts := map[string]int{}
+	for _, name := range []string{"primary", "secure-a", "secure-b"} {
+		name := name
+		startNamedTestUpstream(t, config, name, func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			counts[name]++
+			mu.Unlock()
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		})
+	}
+	server := newTestServer(t, config)
+
+	for i := 0; i < 6; i++ {
+		if m := ask(server, "host"+strconv.Itoa(i)+".private.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+			t.Fatalf("query %d: got %v, want an answer", i, m)
+		}
+	}
+	ask(server, "public.test", dns.TypeA)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts["secure-a"] != 3 || counts["secure-b"] != 3 || counts["primary"] != 1 {
+		t.Errorf("got %v, want tagged queries split evenly and the rest on primary", counts)
+	}
+}
+
+func TestRouteToUnknownTagRejected(t *testing.T) {
+	_, err := LoadConfig(writeTestFile(t, t.TempDir(), "config.toml", testConfig+"\n[routes]\n\"*.private.test\" = \"tag:missing\"\n"))
+	if err == nil {
+		t.Error("expected a route to a tag no upstream carries to be rejected")
+	}
+}
+
+func TestCNAMEChainDepthAndLoops(t *testing.T) {
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig("max_cname_depth = 4")))
+
+	// A chain of four CNAMEs is within the limit and fully resolved
+	setTestRecords(t,
+		RecordEntry{Domain: "c1.test", Type: "CNAME", Value: "c2.test", TTL: 60},
+		RecordEntry{Domain: "c2.test", Type: "CNAME", Value: "c3.test", TTL: 60},
+		RecordEntry{Domain: "c3.test", Type: "CNAME", Value: "c4.test", TTL: 60},
+		RecordEntry{Domain: "c4.test", Type: "CNAME", Value: "end.test", TTL: 60},
+		RecordEntry{Domain: "end.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+	)
+	resp := ask(server, "c1.test", dns.TypeA)
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 5 {
+		t.Fatalf("got %v, want the four CNAMEs and the A record", resp)
+	}
+	if a, ok := resp.Answer[4].(*dns.A); !ok || a.Hdr.Name != "end.test." {
+		t.Errorf("chain does not end with the target's A record: %v", resp.Answer)
+	}
+
+	// One more link exceeds the limit
+	setTestRecords(t,
+		RecordEntry{Domain: "c0.test", Type: "CNAME", Value: "c1.test", TTL: 60},
+		RecordEntry{Domain: "c1.test", Type: "CNAME", Value: "c2.test", TTL: 60},
+		RecordEntry{Domain: "c2.test", Type: "CNAME", Value: "c3.test", TTL: 60},
+		RecordEntry{Domain: "c3.test", Type: "CNAME", Value: "c4.test", TTL: 60},
+		RecordEntry{Domain: "c4.test", Type: "CNAME", Value: "end.test", TTL: 60},
+		RecordEntry{Domain: "end.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+	)
+	if resp := ask(server, "c0.test", dns.TypeA); resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL for a chain past max_cname_depth", resp)
+	}
+
+	// A cycle is cut off rather than followed forever
+	setTestRecords(t,
+		RecordEntry{Domain: "loop-a.test", Type: "CNAME", Value: "loop-b.test", TTL: 60},
+		RecordEntry{Domain: "loop-b.test", Type: "CNAME", Value: "loop-a.test", TTL: 60},
+	)
+	logs := captureLog(t)
+	if resp := ask(server, "loop-a.test", dns.TypeA); resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL for a CNAME loop", resp)
+	}
+	if !strings.Contains(logs.String(), "CNAME loop at loop-a.test") {
+		t.Errorf("loop not logged:\n%s", logs.String())
+	}
+}
+
+func TestStableAnswerOrder(t *testing.T) {
+	for _, stable := range []bool{true, false} {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig("stable_answer_order = "+strconv.FormatBool(stable)))
+		addresses := []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}
+		var calls atomic.Int32
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			// Rotate the RRset on every query, as round-robin upstreams do
+			n := int(calls.Add(1))
+			m := new(dns.Msg)
+			m.SetReply(r)
+			for i := range addresses {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(addresses[(i+n)%len(addresses)]),
+				})
+			}
+			w.WriteMsg(m)
+		})
+		server := newTestServer(t, config)
+
+		var orders []string
+		for i := 0; i < 3; i++ {
+			m := ask(server, "rotating.test", dns.TypeA)
+			if m == nil || len(m.Answer) != len(addresses) {
+				t.Fatalf("stable = %t: got %v, want the full RRset", stable, m)
+			}
+			var order []string
+			for _, rr := range m.Answer {
+				order = append(order, rr.(*dns.A).A.String())
+			}
+			orders = append(orders, strings.Join(order, ","))
+		}
+
+		identical := orders[0] == orders[1] && orders[1] == orders[2]
+		if stable && (!identical || orders[0] != "192.0.2.1,192.0.2.2,192.0.2.3") {
+			t.Errorf("enabled: got orders %v, want identical sorted answers", orders)
+		}
+		if !stable && identical {
+			t.Errorf("disabled: got orders %v, want the upstream's rotation kept", orders)
+		}
+	}
+}
+
+func TestRoutingDecisionsLogged(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig("log_routing = "+strconv.FormatBool(enabled))+`
+[routes]
+"*.corp.test" = "secondary"
+
+[upstreams.secondary]
+address = "127.0.0.1"
+port = 53
+`)
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		})
+		startNamedTestUpstream(t, config, "secondary", func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "192.0.2.2", 60))
+		})
+		server := newTestServer(t, config)
+		logs := captureLog(t)
+
+		ask(server, "host.corp.test", dns.TypeA)
+		ask(server, "other.test", dns.TypeA)
+
+		for _, want := range []string{
+			"Routing host.corp.test A to upstream secondary: domain route *.corp.test -> secondary",
+			"Routing other.test A to upstream primary: no matching route, first upstream",
+		} {
+			if logged := strings.Contains(logs.String(), want); logged != enabled {
+				t.Errorf("log_routing = %t: %q logged = %t in:\n%s", enabled, want, logged, logs.String())
+			}
+		}
+	}
+}
+
+func TestIPv4MappedClientMatchesIPv4Rules(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "internal.test", Type: "A", Value: "10.0.0.10", TTL: 60,
+		AllowClients: []string{"10.9.0.0/16"}})
+	server := newTestServer(t, loadTestConfig(t, testConfig+`
+[rate_limit]
+queries_per_second = 1
+burst = 1
+response = "refuse"
+`))
+
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("::ffff:10.9.1.1"), Port: 5353},
+		&net.TCPAddr{IP: net.ParseIP("::ffff:10.9.1.1"), Port: 5353},
+		remoteHTTPAddr(&http.Request{RemoteAddr: "[::ffff:10.9.1.1]:443"}),
+	} {
+		if ip := getClientIP(addr); len(ip) != net.IPv4len || !ip.Equal(net.IPv4(10, 9, 1, 1)) {
+			t.Errorf("%v: got client %v, want the IPv4 address 10.9.1.1", addr, ip)
+		}
+	}
+
+	tests := []struct {
+		client string
+		rcode  int
+	}{
+		{"::ffff:10.9.1.1", dns.RcodeSuccess},
+		{"::ffff:10.8.1.1", dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		w := newTestWriter(tt.client, true)
+		server.handleRequest(w, query("internal.test", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != tt.rcode {
+			t.Errorf("client %s got %v, want rcode %s", tt.client, w.msg, dns.RcodeToString[tt.rcode])
+		}
+	}
+
+	// The mapped and plain forms of an address share a rate limit
+	w := newTestWriter("10.9.1.1", false)
+	server.handleRequest(w, query("internal.test", dns.TypeA))
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("got %v, want the plain address limited after its mapped form's query", w.msg)
+	}
+}
+
+// recordValue returns the value of the A record matching name, empty if none
+func recordValue(name string) string {
+	if record := FindMatchingRecord(name, "A", nil, time.Now()); record != nil {
+		return record.Value
+	}
+	return ""
+}
+
+func TestReloadFollowsNewRecordsFile(t *testing.T) {
+	setTestRecords(t)
+	dir := t.TempDir()
+	first := writeTestFile(t, dir, "first.toml", testRecords("old.test", "192.0.2.1"))
+	second := writeTestFile(t, dir, "second.toml", testRecords("new.test", "192.0.2.2"))
+
+	config := loadTestConfig(t, testConfig)
+	config.Server.RecordsFile = first
+	config.Cache.Enabled = true
+	if err := LoadStartupRecords(config.Server); err != nil {
+		t.Fatalf("LoadStartupRecords: %v", err)
+	}
+
+	server := newTestServer(t, config)
+	server.WatchRecords()
+
+	// An upstream answer cached before new.test became a local record
+	cached := query("new.test", dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(cached)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "new.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("198.51.100.1"),
+	})
+	key := cacheKey(cached, false)
+	server.currentCache().Set(key, answer, 0)
+
+	reloaded := loadTestConfig(t, testConfig)
+	reloaded.Server.RecordsFile = second
+	reloaded.Cache.Enabled = true
+	server.Reload(reloaded)
+
+	if got := recordValue("new.test"); got != "192.0.2.2" {
+		t.Errorf("new.test = %q after reload, want 192.0.2.2", got)
+	}
+	if got := recordValue("old.test"); got != "" {
+		t.Errorf("old.test = %q after reload, want no record", got)
+	}
+	if _, ok := server.currentCache().Get(key); ok {
+		t.Error("cached upstream answer for a changed record was not invalidated")
+	}
+
+	// The watcher follows the new records file once it has started
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(second, []byte(testRecords("new.test", "192.0.2.3")), 0o644); err != nil {
+		t.Fatalf("failed to rewrite records: %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return recordValue("new.test") == "192.0.2.3" }) {
+		t.Error("records watcher did not pick up a change to the reloaded records file")
+	}
+}
+
+func TestRecordsSettingsChanged(t *testing.T) {
+	base := ServerConfig{RecordsFile: "records.toml", DuplicatePolicy: DuplicateWarn}
+
+	tests := []struct {
+		name   string
+		modify func(*ServerConfig)
+		want   bool
+	}{
+		{"unchanged", func(*ServerConfig) {}, false},
+		{"unrelated setting", func(c *ServerConfig) { c.LogQueries = true }, false},
+		{"records file", func(c *ServerConfig) { c.RecordsFile = filepath.Join("other", "records.toml") }, true},
+		{"override files", func(c *ServerConfig) { c.RecordsFiles = []string{"extra.toml"} }, true},
+		{"duplicate policy", func(c *ServerConfig) { c.DuplicatePolicy = DuplicateError }, true},
+		{"ttl range", func(c *ServerConfig) { c.MaxRecordTTL = 3600 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := base
+			tt.modify(&config)
+			if got := recordsSettingsChanged(base, config); got != tt.want {
+				t.Errorf("recordsSettingsChanged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
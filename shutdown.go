@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// defaultShutdownTimeout is the number of seconds Stop waits for in-flight queries
+const defaultShutdownTimeout = 10
+
+// activeQueries tracks the queries being answered, so a shutdown that times
+// out can report the ones it abandons
+type activeQueries struct {
+	queries map[uint64]activeQuery
+	next    uint64
+
+	// Guards queries and next
+	mu sync.Mutex
+}
+
+// activeQuery is a query being answered and the client that sent it
+type activeQuery struct {
+	question dns.Question
+	client   string
+}
+
+// newActiveQueries creates an empty set of active queries
+func newActiveQueries() *activeQueries {
+	return &activeQueries{queries: make(map[uint64]activeQuery)}
+}
+
+// begin records a query as being answered and returns its id for end
+func (a *activeQueries) begin(q dns.Question, client string) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.next++
+	a.queries[a.next] = activeQuery{question: q, client: client}
+	return a.next
+}
+
+// end removes an answered query
+func (a *activeQueries) end(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.queries, id)
+}
+
+// list describes the queries still being answered, oldest first
+func (a *activeQueries) list() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := make([]uint64, 0, len(a.queries))
+	for id := range a.queries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	descriptions := make([]string, len(ids))
+	for i, id := range ids {
+		query := a.queries[id]
+		descriptions[i] = fmt.Sprintf("%s %s from %s",
+			normalizeName(query.question.Name), dns.TypeToString[query.question.Qtype], query.client)
+	}
+	return descriptions
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStopTwice(t *testing.T) {
+	server, addr := startTCPTestServer(t, "")
+
+	if err := server.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := server.Stop(time.Second); err != nil {
+		t.Errorf("second Stop: %v", err)
+	}
+
+	client := &dns.Client{Net: "tcp", Timeout: 100 * time.Millisecond}
+	if _, _, err := client.Exchange(query("host.test", dns.TypeA), addr); err == nil {
+		t.Error("server still answers after Stop")
+	}
+}
+
+func TestStopClosesListenersTogether(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "host.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	port := freePort(t)
+	config := loadTestConfig(t, serverTestConfig(`listen = "127.0.0.1"
+port = `+strconv.Itoa(port)))
+	release := make(chan struct{})
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		w.WriteMsg(answerFor(r, "192.0.2.2", 60))
+	})
+	defer close(release)
+	server := newTestServer(t, config)
+	go server.Start()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	udp := &dns.Client{Timeout: 100 * time.Millisecond}
+	if !waitFor(t, 2*time.Second, func() bool {
+		_, _, err := udp.Exchange(query("host.test", dns.TypeA), addr)
+		return err == nil
+	}) {
+		t.Fatal("server did not start")
+	}
+
+	// A TCP query held at the upstream keeps the TCP listener draining
+	go (&dns.Client{Net: "tcp", Timeout: 5 * time.Second}).Exchange(query("slow.test", dns.TypeA), addr)
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Stop(500 * time.Millisecond) }()
+
+	// UDP stops answering while TCP still drains, not after it
+	if !waitFor(t, 300*time.Millisecond, func() bool {
+		_, _, err := udp.Exchange(query("host.test", dns.TypeA), addr)
+		return err != nil
+	}) {
+		t.Error("UDP listener kept answering while the TCP listener drained")
+	}
+	if err := <-stopped; err == nil {
+		t.Error("Stop returned no error although a query was abandoned")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/miekg/dns"
+)
+
+// sqliteCacheTTL is how long the records read from the database for a name are reused
+const sqliteCacheTTL = 5 * time.Second
+
+// sqliteCacheSize is the number of names whose records are kept in memory
+const sqliteCacheSize = 10000
+
+// sqliteSchema creates the records table when the database is new
+// Domains are stored lowercase and without the trailing dot; client lists
+// are comma separated and validity times RFC3339
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	domain        TEXT    NOT NULL,
+	type          TEXT    NOT NULL,
+	value         TEXT    NOT NULL DEFAULT '',
+	ttl           INTEGER NOT NULL DEFAULT 0,
+	catch_all     INTEGER NOT NULL DEFAULT 0,
+	allow_clients TEXT    NOT NULL DEFAULT '',
+	deny_clients  TEXT    NOT NULL DEFAULT '',
+	not_before    TEXT    NOT NULL DEFAULT '',
+	not_after     TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS records_domain ON records (domain);
+`
+
+// sqliteColumns are the records table columns read into a record entry
+const sqliteColumns = "domain, type, value, ttl, catch_all, allow_clients, deny_clients, not_before, not_after"
+
+// sqliteNameQuery selects the records of exactly one name by index
+const sqliteNameQuery = "SELECT " + sqliteColumns +
+	" FROM records WHERE domain = ? AND instr(domain, '*') = 0 AND catch_all = 0"
+
+// sqlitePatternQuery selects the wildcard and catch-all records, which may
+// match any name
+const sqlitePatternQuery = "SELECT " + sqliteColumns +
+	" FROM records WHERE instr(domain, '*') > 0 OR catch_all != 0"
+
+// sqliteCacheEntry holds records read from the database
+type sqliteCacheEntry struct {
+	records []RecordEntry
+	expires time.Time
+}
+
+// SQLiteRecordStore answers from records kept in a SQLite database
+// Records are read on demand and briefly cached, so rows changed in the
+// database are served within sqliteCacheTTL
+type SQLiteRecordStore struct {
+	db *sql.DB
+	// Source of the time records' validity windows and cache expiry are checked at
+	clock Clock
+	// Range record TTLs must lie in, rows outside it are skipped
+	minTTL int
+	maxTTL int
+
+	// Records of each name, and the wildcard and catch-all records shared by all names
+	cache    map[string]sqliteCacheEntry
+	patterns sqliteCacheEntry
+	// Guards cache and patterns
+	mu sync.Mutex
+}
+
+// NewSQLiteRecordStore opens the records database at path, creating the
+// records table if needed
+// Records with TTLs outside minTTL and maxTTL are not served, a zero maxTTL
+// only rejects TTLs RFC 2181 forbids
+func NewSQLiteRecordStore(path string, clock Clock, minTTL, maxTTL int) (*SQLiteRecordStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open records database: %w", err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create records table: %w", err)
+	}
+
+	if maxTTL == 0 {
+		maxTTL = maxRFC2181TTL
+	}
+
+	return &SQLiteRecordStore{
+		db:     db,
+		clock:  clock,
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+		cache:  make(map[string]sqliteCacheEntry),
+	}, nil
+}
+
+// Close closes the records database
+func (s *SQLiteRecordStore) Close() error {
+	return s.db.Close()
+}
+
+// Lookup returns the most specific record for the name and type
+func (s *SQLiteRecordStore) Lookup(name string, qtype uint16, clientIP net.IP) []RecordEntry {
+	recordType := dns.TypeToString[qtype]
+	domain := normalizeName(name)
+	now := s.clock.Now()
+
+	// Prefer the most specific matching record, the first one on a tie
+	var best *RecordEntry
+	candidates := s.candidates(domain)
+	for i := range candidates {
+		record := &candidates[i]
+		if !record.Matches(domain) || record.Type != recordType ||
+			!record.ActiveAt(now) || !record.AllowsClient(clientIP) {
+			continue
+		}
+
+		if best == nil || recordSpecificity(record) > recordSpecificity(best) {
+			best = record
+		}
+	}
+
+	// Catch-all records only apply when nothing more specific matched
+	if best == nil || best.CatchAll {
+		if secondary := Secondaries.FindRecord(domain, recordType); secondary != nil {
+			best = secondary
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return []RecordEntry{*best}
+}
+
+// Hidden reports whether the client is denied every record of the name
+func (s *SQLiteRecordStore) Hidden(name string, clientIP net.IP) bool {
+	domain := normalizeName(name)
+	now := s.clock.Now()
+
+	hidden := false
+	for _, record := range s.candidates(domain) {
+		if !record.Matches(domain) || !record.ActiveAt(now) {
+			continue
+		}
+
+		if record.AllowsClient(clientIP) {
+			return false
+		}
+		hidden = true
+	}
+
+	return hidden
+}
+
+// Exists reports whether a record in the database matches the name
+func (s *SQLiteRecordStore) Exists(name string) bool {
+	domain := normalizeName(name)
+	now := s.clock.Now()
+
+	for _, record := range s.candidates(domain) {
+		if record.Matches(domain) && record.ActiveAt(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tombstone returns a tombstone in the database covering the name that has not expired
+func (s *SQLiteRecordStore) Tombstone(name string) *RecordEntry {
+	domain := normalizeName(name)
+	now := s.clock.Now()
+
+	for _, record := range s.candidates(domain) {
+		if record.Type == TombstoneType && record.Matches(domain) && record.ActiveAt(now) {
+			return &record
+		}
+	}
+
+	return nil
+}
+
+// All returns every record in the database
+func (s *SQLiteRecordStore) All() []RecordEntry {
+	records, err := s.query("SELECT " + sqliteColumns + " FROM records")
+	if err != nil {
+		log.Printf("Error reading records database: %v", err)
+		return []RecordEntry{}
+	}
+	return records
+}
+
+// candidates returns the records that may match a domain: the records of
+// the name itself and the wildcard and catch-all records
+func (s *SQLiteRecordStore) candidates(domain string) []RecordEntry {
+	named := s.nameRecords(domain)
+	patterns := s.patternRecords()
+
+	records := make([]RecordEntry, 0, len(named)+len(patterns))
+	return append(append(records, named...), patterns...)
+}
+
+// nameRecords returns the records stored for exactly the domain, from the
+// cache when they were read recently
+// A failed read is logged and treated as no records
+func (s *SQLiteRecordStore) nameRecords(domain string) []RecordEntry {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	entry, ok := s.cache[domain]
+	s.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.records
+	}
+
+	records, err := s.query(sqliteNameQuery, domain)
+	if err != nil {
+		log.Printf("Error looking up %s in records database: %v", domain, err)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Start over rather than track recency once the cache is full
+	if len(s.cache) >= sqliteCacheSize {
+		s.cache = make(map[string]sqliteCacheEntry)
+	}
+	s.cache[domain] = sqliteCacheEntry{records: records, expires: now.Add(sqliteCacheTTL)}
+
+	return records
+}
+
+// patternRecords returns the wildcard and catch-all records, which are read
+// once for all names and cached like the records of a name
+// A failed read is logged and treated as no records
+func (s *SQLiteRecordStore) patternRecords() []RecordEntry {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	entry := s.patterns
+	s.mu.Unlock()
+	if now.Before(entry.expires) {
+		return entry.records
+	}
+
+	records, err := s.query(sqlitePatternQuery)
+	if err != nil {
+		log.Printf("Error reading wildcard records from records database: %v", err)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patterns = sqliteCacheEntry{records: records, expires: now.Add(sqliteCacheTTL)}
+
+	return records
+}
+
+// query reads record entries from the database
+// Rows with unparsable client networks or validity times, or TTLs outside
+// the allowed range, are skipped
+func (s *SQLiteRecordStore) query(statement string, args ...interface{}) ([]RecordEntry, error) {
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query records: %w", err)
+	}
+	defer rows.Close()
+
+	records := []RecordEntry{}
+	for rows.Next() {
+		var record RecordEntry
+		var allow, deny string
+		if err := rows.Scan(&record.Domain, &record.Type, &record.Value, &record.TTL, &record.CatchAll,
+			&allow, &deny, &record.NotBefore, &record.NotAfter); err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+		record.AllowClients = splitList(allow)
+		record.DenyClients = splitList(deny)
+
+		if err := record.parseClientNets(); err != nil {
+			log.Printf("Warning: Skipping database record %s %s: %v", record.Domain, record.Type, err)
+			continue
+		}
+		if err := record.parseValidity(); err != nil {
+			log.Printf("Warning: Skipping database record %s %s: %v", record.Domain, record.Type, err)
+			continue
+		}
+		if err := ValidateRecordTTL(&record, s.minTTL, s.maxTTL); err != nil {
+			log.Printf("Warning: Skipping database record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read records: %w", err)
+	}
+	return records, nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
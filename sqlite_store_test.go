@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestSQLiteStore opens a store on a fresh database holding the given rows
+// Each row lists domain, type, value and optionally catch_all as "1"
+func newTestSQLiteStore(t *testing.T, clock Clock, rows ...[]string) *SQLiteRecordStore {
+	t.Helper()
+
+	store, err := NewSQLiteRecordStore(filepath.Join(t.TempDir(), "records.db"), clock, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSQLiteRecordStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	for _, row := range rows {
+		insertTestRow(t, store, row...)
+	}
+	return store
+}
+
+// insertTestRow adds a record row to the store's database
+func insertTestRow(t *testing.T, store *SQLiteRecordStore, row ...string) {
+	t.Helper()
+
+	catchAll := len(row) > 3 && row[3] == "1"
+	if _, err := store.db.Exec("INSERT INTO records (domain, type, value, ttl, catch_all) VALUES (?, ?, ?, 60, ?)",
+		row[0], row[1], row[2], catchAll); err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+}
+
+// lookupValue returns the value of the record the store answers for a name, empty if none
+func lookupValue(store RecordStore, name string, qtype uint16) string {
+	records := store.Lookup(name, qtype, nil)
+	if len(records) == 0 {
+		return ""
+	}
+	return records[0].Value
+}
+
+func TestSQLiteStoreMatches(t *testing.T) {
+	store := newTestSQLiteStore(t, realClock{},
+		[]string{"host.example.test", "A", "192.0.2.1"},
+		[]string{"*.example.test", "A", "192.0.2.2"},
+		[]string{"_**.deep.test", "A", "192.0.2.3"},
+		[]string{"other.test", "A", "192.0.2.4", "1"},
+		[]string{"host.example.test", "AAAA", "2001:db8::1"},
+	)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"host.example.test", dns.TypeA, "192.0.2.1"},
+		{"HOST.example.test.", dns.TypeA, "192.0.2.1"},
+		{"host.example.test", dns.TypeAAAA, "2001:db8::1"},
+		{"www.example.test", dns.TypeA, "192.0.2.2"},
+		{"a.b.deep.test", dns.TypeA, "192.0.2.3"},
+		{"deep.below.other.test", dns.TypeA, "192.0.2.4"},
+		{"www.example.test", dns.TypeAAAA, ""},
+		{"missing.test", dns.TypeA, ""},
+	}
+
+	for _, tt := range tests {
+		if got := lookupValue(store, tt.name, tt.qtype); got != tt.want {
+			t.Errorf("Lookup(%s, %s) = %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	if !store.Exists("www.example.test") || store.Exists("missing.test") {
+		t.Error("Exists does not follow the wildcard records")
+	}
+	if got := len(store.All()); got != 5 {
+		t.Errorf("All returned %d records, want 5", got)
+	}
+}
+
+func TestSQLiteStoreClientRestrictions(t *testing.T) {
+	store := newTestSQLiteStore(t, realClock{})
+	if _, err := store.db.Exec("INSERT INTO records (domain, type, value, ttl, allow_clients) VALUES (?, ?, ?, 60, ?)",
+		"internal.test", "A", "10.0.0.1", "10.0.0.0/8, 192.168.0.0/16"); err != nil {
+		t.Fatalf("failed to insert record: %v", err)
+	}
+
+	if records := store.Lookup("internal.test", dns.TypeA, net.ParseIP("10.1.2.3")); len(records) != 1 {
+		t.Errorf("allowed client got %d records, want 1", len(records))
+	}
+	outside := net.ParseIP("203.0.113.1")
+	if records := store.Lookup("internal.test", dns.TypeA, outside); len(records) != 0 {
+		t.Errorf("denied client got %v", records)
+	}
+	if !store.Hidden("internal.test", outside) {
+		t.Error("expected the name to be hidden from the denied client")
+	}
+}
+
+func TestSQLiteStoreCachesLookups(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := newTestSQLiteStore(t, clock, []string{"host.test", "A", "192.0.2.1"})
+
+	if got := lookupValue(store, "host.test", dns.TypeA); got != "192.0.2.1" {
+		t.Fatalf("got %q, want 192.0.2.1", got)
+	}
+
+	if _, err := store.db.Exec("UPDATE records SET value = '192.0.2.2'"); err != nil {
+		t.Fatalf("failed to update record: %v", err)
+	}
+	if got := lookupValue(store, "host.test", dns.TypeA); got != "192.0.2.1" {
+		t.Errorf("got %q before the cache expired, want the cached 192.0.2.1", got)
+	}
+
+	clock.Advance(sqliteCacheTTL)
+	if got := lookupValue(store, "host.test", dns.TypeA); got != "192.0.2.2" {
+		t.Errorf("got %q after the cache expired, want 192.0.2.2", got)
+	}
+}
+
+func TestSQLiteStoreSharesPatternRecords(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := newTestSQLiteStore(t, clock,
+		[]string{"host.example.test", "A", "192.0.2.1"},
+		[]string{"*.example.test", "A", "192.0.2.2"},
+		[]string{"other.test", "A", "192.0.2.3", "1"},
+	)
+
+	if got := lookupValue(store, "a.example.test", dns.TypeA); got != "192.0.2.2" {
+		t.Fatalf("got %q, want the wildcard 192.0.2.2", got)
+	}
+
+	// Names only cache their own rows, the wildcard rows are read once for all names
+	if _, err := store.db.Exec("UPDATE records SET value = '192.0.2.9' WHERE domain = '*.example.test'"); err != nil {
+		t.Fatalf("failed to update record: %v", err)
+	}
+	if got := lookupValue(store, "b.example.test", dns.TypeA); got != "192.0.2.2" {
+		t.Errorf("got %q for a new name, want the shared cached 192.0.2.2", got)
+	}
+	if got := lookupValue(store, "host.example.test", dns.TypeA); got != "192.0.2.1" {
+		t.Errorf("got %q, want the exact record over the wildcard", got)
+	}
+	for name, entry := range store.cache {
+		for _, record := range entry.records {
+			if record.Domain != name {
+				t.Errorf("cache entry for %s holds %s", name, record.Domain)
+			}
+		}
+	}
+
+	clock.Advance(sqliteCacheTTL)
+	if got := lookupValue(store, "b.example.test", dns.TypeA); got != "192.0.2.9" {
+		t.Errorf("got %q after the cache expired, want 192.0.2.9", got)
+	}
+	if got := lookupValue(store, "x.y.other.test", dns.TypeA); got != "192.0.2.3" {
+		t.Errorf("got %q, want the catch-all 192.0.2.3", got)
+	}
+}
+
+func TestSQLiteStoreSkipsRecordsOutsideTTLRange(t *testing.T) {
+	store, err := NewSQLiteRecordStore(filepath.Join(t.TempDir(), "records.db"), realClock{}, 30, 3600)
+	if err != nil {
+		t.Fatalf("NewSQLiteRecordStore: %v", err)
+	}
+	defer store.Close()
+
+	for _, row := range []struct {
+		domain string
+		ttl    int
+	}{{"short.test", 10}, {"long.test", 86400}, {"ok.test", 300}} {
+		if _, err := store.db.Exec("INSERT INTO records (domain, type, value, ttl) VALUES (?, 'A', '192.0.2.1', ?)", row.domain, row.ttl); err != nil {
+			t.Fatalf("failed to insert record: %v", err)
+		}
+	}
+
+	for name, want := range map[string]string{"short.test": "", "long.test": "", "ok.test": "192.0.2.1"} {
+		if got := lookupValue(store, name, dns.TypeA); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if records := store.All(); len(records) != 1 {
+		t.Errorf("got %d records, want only the one within the TTL range", len(records))
+	}
+}
+
+func TestServerAnswersFromSQLiteStore(t *testing.T) {
+	setTestRecords(t)
+	store := newTestSQLiteStore(t, realClock{}, []string{"*.db.test", "A", "192.0.2.1"})
+	config := loadTestConfig(t, testConfig)
+	config.Server.RecordsDB = "records.db"
+	server := newTestServer(t, config, WithRecordStore(store))
+
+	w := newTestWriter("10.0.0.1", false)
+	server.handleRequest(w, query("www.db.test", dns.TypeA))
+
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("got %v, want one answer", w.msg)
+	}
+	if a, ok := w.msg.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("got %v, want 192.0.2.1", w.msg.Answer[0])
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Behaviors for forwarded queries during the startup grace period
+const (
+	StartupGraceWait     = "wait"
+	StartupGraceServFail = "servfail"
+)
+
+// upstreamProbeInterval is how often upstreams are probed during startup grace
+const upstreamProbeInterval = time.Second
+
+// Behaviors for queries arriving before records are loaded
+const (
+	RecordsGateWait     = "wait"
+	RecordsGateServFail = "servfail"
+	RecordsGateForward  = "forward"
+)
+
+// defaultRecordsGateTimeout is the number of seconds the records gate applies at most
+const defaultRecordsGateTimeout = 5
+
+// beginStartupGrace starts probing upstreams and holds forwarded queries
+// until one answers or the configured grace period ends
+func (s *DNSServer) beginStartupGrace() {
+	grace := time.Duration(s.currentConfig().Server.StartupGrace) * time.Second
+	if grace <= 0 {
+		s.markUpstreamsReady()
+		return
+	}
+
+	s.graceUntil = time.Now().Add(grace)
+	go s.probeUpstreams()
+}
+
+// probeUpstreams queries upstreams until one answers or the grace period ends
+func (s *DNSServer) probeUpstreams() {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+
+	for time.Now().Before(s.graceUntil) {
+		for _, name := range sortedUpstreamNames(s.currentConfig().Upstreams) {
+			if _, err := s.exchangeWithUpstream(name, probe); err == nil {
+				log.Printf("Upstream %s is ready", name)
+				s.markUpstreamsReady()
+				return
+			}
+		}
+
+		time.Sleep(upstreamProbeInterval)
+	}
+
+	log.Printf("Startup grace period ended before any upstream answered")
+	s.markUpstreamsReady()
+}
+
+// markUpstreamsReady ends the startup grace period
+func (s *DNSServer) markUpstreamsReady() {
+	s.readyOnce.Do(func() {
+		close(s.upstreamsReady)
+	})
+}
+
+// awaitUpstreams applies the startup grace behavior to a forwarded query
+// Returns false if a response was already sent and the query must not be forwarded
+func (s *DNSServer) awaitUpstreams(w dns.ResponseWriter, r *dns.Msg) bool {
+	select {
+	case <-s.upstreamsReady:
+		return true
+	default:
+	}
+
+	remaining := time.Until(s.graceUntil)
+	if remaining <= 0 {
+		return true
+	}
+
+	if s.currentConfig().Server.StartupGraceMode == StartupGraceServFail {
+		s.sendServerFailure(w, r, fmt.Errorf("upstreams not ready during startup grace"))
+		return false
+	}
+
+	// Wait for readiness, bounded by the end of the grace period
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case <-s.upstreamsReady:
+	case <-timer.C:
+	}
+
+	return true
+}
+
+// beginRecordsLoad loads the records in the background when async_records_load
+// is set, gating local answers until they are loaded
+func (s *DNSServer) beginRecordsLoad() {
+	config := s.currentConfig().Server
+	if !config.AsyncRecordsLoad || config.RecordsDB != "" {
+		s.markRecordsLoaded()
+		return
+	}
+
+	s.recordsUntil = time.Now().Add(time.Duration(config.RecordsGateTimeout) * time.Second)
+	go func() {
+		if _, err := LoadRecords(config); err != nil {
+			log.Printf("Warning: Failed to load records file: %v", err)
+		}
+		s.markRecordsLoaded()
+	}()
+}
+
+// markRecordsLoaded opens the records gate
+func (s *DNSServer) markRecordsLoaded() {
+	s.recordsOnce.Do(func() {
+		close(s.recordsReady)
+	})
+}
+
+// awaitRecords applies the records gate to a query
+// Returns false if a response was already sent and the query must not be answered
+func (s *DNSServer) awaitRecords(w dns.ResponseWriter, r *dns.Msg) bool {
+	select {
+	case <-s.recordsReady:
+		return true
+	default:
+	}
+
+	remaining := time.Until(s.recordsUntil)
+	if remaining <= 0 {
+		return true
+	}
+
+	switch s.currentConfig().Server.RecordsGate {
+	case RecordsGateForward:
+		return true
+	case RecordsGateServFail:
+		s.sendServerFailure(w, r, fmt.Errorf("records not loaded yet"))
+		return false
+	}
+
+	// Wait for the records, bounded by the gate timeout
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case <-s.recordsReady:
+	case <-timer.C:
+	}
+
+	return true
+}
+
+// warmCache resolves the configured warm-up names through the pipeline so
+// their answers are cached before clients ask for them
+// Failures are logged and do not affect serving
+func (s *DNSServer) warmCache() {
+	config := s.currentConfig().Cache
+	if !config.Enabled || len(config.Warmup) == 0 {
+		return
+	}
+
+	warmed := 0
+	for _, name := range config.Warmup {
+		ok := true
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			result := s.Resolve(dns.Fqdn(name), qtype, net.ParseIP(defaultResolveClient))
+			if result.Dropped || result.Rcode == dns.RcodeToString[dns.RcodeServerFailure] {
+				log.Printf("Warning: Failed to warm cache for %s %s", name, dns.TypeToString[qtype])
+				ok = false
+			}
+		}
+		if ok {
+			warmed++
+		}
+	}
+
+	log.Printf("Warmed cache with %d of %d names", warmed, len(config.Warmup))
+}
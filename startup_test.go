@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStartupGraceServFailMode(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig(`startup_grace_mode = "servfail"`))
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+	server.graceUntil = time.Now().Add(10 * time.Second)
+
+	if m := ask(server, "grace.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("got %v during the grace period, want SERVFAIL", m)
+	}
+
+	server.graceUntil = time.Now()
+	if m := ask(server, "grace.test", dns.TypeA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("got %v after the grace period, want the upstream answer", m)
+	}
+}
+
+func TestRecordsGateModes(t *testing.T) {
+	tests := []struct {
+		gate string
+		want string
+	}{
+		{RecordsGateServFail, "SERVFAIL"},
+		{RecordsGateForward, "198.51.100.1"},
+		{RecordsGateWait, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig(`records_gate = "`+tt.gate+`"`))
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+		})
+		server := newTestServer(t, config)
+		server.recordsUntil = time.Now().Add(5 * time.Second)
+		loadRecords := func() {
+			setTestRecords(t, RecordEntry{Domain: "early.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+			server.markRecordsLoaded()
+		}
+
+		answered := make(chan *dns.Msg, 1)
+		go func() { answered <- ask(server, "early.test", dns.TypeA) }()
+
+		var m *dns.Msg
+		select {
+		case m = <-answered:
+			if tt.gate == RecordsGateWait {
+				t.Fatalf("%s: query answered before the records loaded: %v", tt.gate, m)
+			}
+			loadRecords()
+		case <-time.After(50 * time.Millisecond):
+			if tt.gate != RecordsGateWait {
+				t.Fatalf("%s: query held before the records loaded", tt.gate)
+			}
+			loadRecords()
+			m = <-answered
+		}
+
+		got := ""
+		switch {
+		case m == nil:
+		case m.Rcode != dns.RcodeSuccess:
+			got = dns.RcodeToString[m.Rcode]
+		case len(m.Answer) == 1:
+			got = m.Answer[0].(*dns.A).A.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v for a query before the records loaded, want %s", tt.gate, m, tt.want)
+		}
+
+		// Once loaded, every gate answers from the records
+		if m := ask(server, "early.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Errorf("%s: got %v after the records loaded, want the local answer", tt.gate, m)
+		}
+	}
+}
+
+func TestWarmupNamesAreCached(t *testing.T) {
+	config := loadTestConfig(t, testConfig+`
+[cache]
+enabled = true
+warmup = ["hot.test"]
+`)
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		w.WriteMsg(answerFor(r, "192.0.2.1", 300))
+	})
+	server := newTestServer(t, config)
+
+	server.warmCache()
+	warmed := hits.Load()
+	if warmed == 0 {
+		t.Fatal("warm-up did not resolve the configured name")
+	}
+
+	resp := ask(server, "hot.test", dns.TypeA)
+	if resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("got %v, want the warmed answer", resp)
+	}
+	if got := hits.Load(); got != warmed {
+		t.Errorf("upstream hit %d more times, want the answer served from the warmed cache", got-warmed)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// RecordStore looks up the local records queries are answered from
+type RecordStore interface {
+	// Lookup returns the records answering a name and type for a client,
+	// the best match first
+	Lookup(name string, qtype uint16, clientIP net.IP) []RecordEntry
+	// Hidden reports whether a name has records but the client may resolve none of them
+	Hidden(name string, clientIP net.IP) bool
+	// Exists reports whether any record of any type matches a name
+	Exists(name string) bool
+	// Tombstone returns the tombstone forcing NXDOMAIN for a name, nil if there is none
+	Tombstone(name string) *RecordEntry
+	// All returns a copy of every record the store was configured with
+	All() []RecordEntry
+}
+
+// memoryRecordStore serves the records loaded from the records files
+// and transferred from primaries
+type memoryRecordStore struct {
+	// Source of the time records' validity windows are checked at
+	clock Clock
+}
+
+// Lookup returns the most specific record for the name and type
+func (m memoryRecordStore) Lookup(name string, qtype uint16, clientIP net.IP) []RecordEntry {
+	if record := FindMatchingRecord(name, dns.TypeToString[qtype], clientIP, m.clock.Now()); record != nil {
+		return []RecordEntry{*record}
+	}
+	return nil
+}
+
+// Hidden reports whether the client is denied every record of the name
+func (m memoryRecordStore) Hidden(name string, clientIP net.IP) bool {
+	return IsHiddenFromClient(name, clientIP, m.clock.Now())
+}
+
+// Exists reports whether a loaded record matches the name
+func (m memoryRecordStore) Exists(name string) bool {
+	return HasRecordsForDomain(name, m.clock.Now())
+}
+
+// Tombstone returns a loaded tombstone covering the name that has not expired
+func (m memoryRecordStore) Tombstone(name string) *RecordEntry {
+	return FindTombstone(name, m.clock.Now())
+}
+
+// All returns a copy of the records loaded from the records files
+func (memoryRecordStore) All() []RecordEntry {
+	Records.mu.RLock()
+	defer Records.mu.RUnlock()
+	return append([]RecordEntry{}, Records.Records...)
+}
+
+// findRecord returns the best record of a type for a domain from the server's store
+// Returns nil if no record matches
+func (s *DNSServer) findRecord(domain string, recordType string, clientIP net.IP) *RecordEntry {
+	records := s.records.Lookup(domain, dns.StringToType[recordType], clientIP)
+	if len(records) == 0 {
+		return nil
+	}
+	return &records[0]
+}
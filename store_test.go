@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeRecordStore answers from a fixed set of records keyed by "name type"
+type fakeRecordStore struct {
+	records map[string]RecordEntry
+	lookups []string
+}
+
+func (f *fakeRecordStore) Lookup(name string, qtype uint16, clientIP net.IP) []RecordEntry {
+	key := normalizeName(name) + " " + dns.TypeToString[qtype]
+	f.lookups = append(f.lookups, key)
+	if record, ok := f.records[key]; ok {
+		return []RecordEntry{record}
+	}
+	return nil
+}
+
+func (f *fakeRecordStore) Hidden(name string, clientIP net.IP) bool { return false }
+
+func (f *fakeRecordStore) Exists(name string) bool {
+	for _, record := range f.records {
+		if record.Domain == normalizeName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeRecordStore) Tombstone(name string) *RecordEntry { return nil }
+
+func (f *fakeRecordStore) All() []RecordEntry {
+	all := []RecordEntry{}
+	for _, record := range f.records {
+		all = append(all, record)
+	}
+	return all
+}
+
+func TestServerAnswersFromInjectedStore(t *testing.T) {
+	// The global records must not be consulted
+	setTestRecords(t, RecordEntry{Domain: "host.test", Type: "A", Value: "192.0.2.99", TTL: 60})
+	store := &fakeRecordStore{records: map[string]RecordEntry{
+		"host.test A": {Domain: "host.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+	}}
+	server := newTestServer(t, loadTestConfig(t, testConfig), WithRecordStore(store))
+
+	w := newTestWriter("10.0.0.1", false)
+	server.handleRequest(w, query("host.test", dns.TypeA))
+
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("got %v, want one answer", w.msg)
+	}
+	if a, ok := w.msg.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("got %v, want 192.0.2.1 from the store", w.msg.Answer[0])
+	}
+	if len(store.lookups) == 0 || store.lookups[0] != "host.test A" {
+		t.Errorf("got lookups %v, want host.test A", store.lookups)
+	}
+}
+
+func TestExportReadsInjectedStore(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "global.test", Type: "A", Value: "192.0.2.99", TTL: 60})
+	store := &fakeRecordStore{records: map[string]RecordEntry{
+		"store.test A": {Domain: "store.test", Type: "A", Value: "192.0.2.1", TTL: 60},
+	}}
+	server := newTestServer(t, loadTestConfig(t, testConfig), WithRecordStore(store))
+
+	rec := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/records/export?format=zone", nil))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "store.test") || strings.Contains(body, "global.test") {
+		t.Errorf("export did not come from the store:\n%s", body)
+	}
+	if summary := server.startupSummary(); !strings.Contains(summary, "records=1") {
+		t.Errorf("got summary %q, want records=1", summary)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// synthesizeTypes are the record types a synthesized answer may have
+var synthesizeTypes = map[string]bool{
+	"A": true, "AAAA": true, "CNAME": true, "TXT": true, "MX": true, "NS": true, "PTR": true,
+}
+
+// validateSynthesizeRules checks that every rule has a pattern, value and supported type
+func validateSynthesizeRules(rules []SynthesizeRule) error {
+	for _, rule := range rules {
+		if rule.Pattern == "" || rule.Value == "" {
+			return fmt.Errorf("synthesize requires pattern and value")
+		}
+
+		if !synthesizeTypes[rule.Type] {
+			return fmt.Errorf("synthesize %s: unsupported type %q", rule.Pattern, rule.Type)
+		}
+	}
+
+	return nil
+}
+
+// isNegativeAnswer reports whether a response is NXDOMAIN or NODATA
+func isNegativeAnswer(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// synthesizeAnswer builds the configured default answer for a negative upstream response
+// Returns false if the response is positive or no rule matches the query
+func (s *DNSServer) synthesizeAnswer(r *dns.Msg, response *dns.Msg) (*dns.Msg, bool) {
+	if !isNegativeAnswer(response) {
+		return nil, false
+	}
+
+	q := r.Question[0]
+	domain := getDomainFromQuestion(q)
+	recordType := dns.TypeToString[q.Qtype]
+
+	for _, rule := range s.currentConfig().Synthesize {
+		if rule.Type != recordType || !MatchDomain(rule.Pattern, domain) {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		header := dns.RR_Header{
+			Name:  q.Name,
+			Class: dns.ClassINET,
+			Ttl:   uint32(rule.TTL),
+		}
+		addValueToMsg(m, header, domain, rule.Type, rule.Value)
+		return m, true
+	}
+
+	return nil, false
+}
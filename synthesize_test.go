@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizedAnswerForNegativeUpstream(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig+`
+[[synthesize]]
+pattern = "*.search.test"
+type = "A"
+value = "192.168.1.10"
+ttl = 60
+`)
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "known.search.test.":
+			w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+		case "empty.search.test.":
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+		default:
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(m)
+		}
+	})
+	server := newTestServer(t, config)
+
+	tests := []struct {
+		name  string
+		rcode int
+		want  string
+	}{
+		{"missing.search.test", dns.RcodeSuccess, "192.168.1.10"},
+		{"empty.search.test", dns.RcodeSuccess, "192.168.1.10"},
+		{"known.search.test", dns.RcodeSuccess, "192.0.2.1"},
+		{"missing.other.test", dns.RcodeNameError, ""},
+	}
+	for _, tt := range tests {
+		m := ask(server, tt.name, dns.TypeA)
+		if m == nil || m.Rcode != tt.rcode {
+			t.Errorf("%s: got %v, want %s", tt.name, m, dns.RcodeToString[tt.rcode])
+			continue
+		}
+		if tt.want == "" {
+			if len(m.Answer) != 0 {
+				t.Errorf("%s: got %v, want no answer", tt.name, m.Answer)
+			}
+			continue
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, m.Answer, tt.want)
+		}
+	}
+
+	// Rules only apply to their own record type
+	if m := ask(server, "missing.search.test", dns.TypeAAAA); m == nil || m.Rcode != dns.RcodeNameError {
+		t.Errorf("got %v, want the AAAA query left as NXDOMAIN", m)
+	}
+}
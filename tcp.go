@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultTCPReadTimeout is the number of seconds to wait for a TCP query
+const defaultTCPReadTimeout = 2
+
+// Limits on TCP connections when not configured, matching the dns package defaults
+const (
+	defaultTCPMaxQueriesPerConn = 128
+	defaultTCPIdleTimeout       = 8
+)
+
+// sizeLimitReader rejects TCP messages whose length prefix exceeds maxSize
+// before allocating a buffer for them, and ends connections that have sent
+// maxQueries queries; UDP reads use the wrapped reader
+// A reader is created for each TCP connection, so reloaded limits apply to new connections
+type sizeLimitReader struct {
+	dns.Reader
+	maxSize int
+	// Queries read from the connection before it is closed, 0 for no limit
+	maxQueries int
+	queries    int
+}
+
+// ReadTCP reads a length prefixed message, failing for oversized messages
+// and once the connection has reached its query limit
+// An error closes the connection
+func (r *sizeLimitReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if r.maxQueries > 0 && r.queries >= r.maxQueries {
+		return nil, fmt.Errorf("connection from %s reached the %d query limit", conn.RemoteAddr(), r.maxQueries)
+	}
+	r.queries++
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if int(length) > r.maxSize {
+		return nil, fmt.Errorf("message of %d bytes from %s exceeds the %d byte limit", length, conn.RemoteAddr(), r.maxSize)
+	}
+
+	m := make([]byte, length)
+	if _, err := io.ReadFull(conn, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTCPTestServer starts a server answering host.test from local records
+// with extra [server] settings, and returns its address
+func startTCPTestServer(t *testing.T, settings string) (*DNSServer, string) {
+	t.Helper()
+
+	setTestRecords(t, RecordEntry{Domain: "host.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	port := freePort(t)
+	config := loadTestConfig(t, serverTestConfig(`listen = "127.0.0.1"
+port = `+strconv.Itoa(port)+`
+`+settings))
+	server := newTestServer(t, config)
+	go server.Start()
+	t.Cleanup(func() { server.Stop(time.Second) })
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	client := &dns.Client{Net: "tcp", Timeout: 100 * time.Millisecond}
+	if !waitFor(t, 2*time.Second, func() bool {
+		_, _, err := client.Exchange(query("host.test", dns.TypeA), addr)
+		return err == nil
+	}) {
+		t.Fatal("server did not start")
+	}
+	return server, addr
+}
+
+func TestSizeLimitReaderRejectsBeforeReadingBody(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Only the length prefix is sent, so reading the body would block until the timeout
+	go client.Write([]byte{0xff, 0xff})
+
+	reader := &sizeLimitReader{maxSize: 512}
+	start := time.Now()
+	if m, err := reader.ReadTCP(server, 5*time.Second); err == nil {
+		t.Fatalf("oversized message accepted: %d bytes", len(m))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("rejection took %v, want it before the body is read", elapsed)
+	}
+}
+
+func TestOversizedTCPMessageRejected(t *testing.T) {
+	_, addr := startTCPTestServer(t, "max_message_size = 512")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Announce a message larger than the limit and send only part of it
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(append([]byte{0x04, 0x00}, make([]byte, 16)...)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if n, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Errorf("got %d bytes, want the connection closed", n)
+	}
+
+	// Queries within the limit are still answered
+	tcp := &dns.Client{Net: "tcp", Timeout: time.Second}
+	if m, _, err := tcp.Exchange(query("host.test", dns.TypeA), addr); err != nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, %v; want a normal answer", m, err)
+	}
+}
+
+// queriesAnswered sends queries over one TCP connection until it is closed,
+// up to limit, and returns how many were answered
+func queriesAnswered(t *testing.T, addr string, limit int) int {
+	t.Helper()
+
+	client := &dns.Client{Net: "tcp", Timeout: time.Second}
+	conn, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < limit; i++ {
+		if m, _, err := client.ExchangeWithConn(query("host.test", dns.TypeA), conn); err != nil || len(m.Answer) != 1 {
+			return i
+		}
+	}
+	return limit
+}
+
+func TestTCPConnectionClosedAfterMaxQueries(t *testing.T) {
+	server, addr := startTCPTestServer(t, "tcp_max_queries_per_conn = 2")
+
+	if got := queriesAnswered(t, addr, 5); got != 2 {
+		t.Errorf("%d queries answered on one connection, want 2", got)
+	}
+
+	// Reloaded limits apply to new connections
+	config := *server.currentConfig()
+	config.Server.TCPMaxQueriesPerConn = 3
+	server.Reload(&config)
+	if got := queriesAnswered(t, addr, 5); got != 3 {
+		t.Errorf("%d queries answered after the reload, want 3", got)
+	}
+}
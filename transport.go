@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Transports a query can arrive over
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportDoH = "doh"
+)
+
+// requestContext carries per-query details used while answering a request
+type requestContext struct {
+	clientIP  net.IP
+	transport string
+	logQuery  bool
+	// Query tagged by a debug client, pinned and traced
+	debug bool
+	// Decisions recorded for the resolve endpoint, nil for real queries
+	trace *resolveTrace
+}
+
+// validTransport reports whether a transport name is known
+func validTransport(transport string) bool {
+	switch transport {
+	case TransportUDP, TransportTCP, TransportDoH:
+		return true
+	}
+	return false
+}
+
+// getTransport returns the transport a request arrived over
+func getTransport(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return TransportDoH
+	}
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return TransportTCP
+	}
+
+	return TransportUDP
+}
+
+// transportPolicy returns the configured policy for a transport
+func (s *DNSServer) transportPolicy(transport string) TransportPolicy {
+	return s.currentConfig().TransportPolicies[transport]
+}
+
+// stripECS returns a copy of a request without EDNS Client Subnet options
+func stripECS(r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return r
+	}
+
+	stripped := r.Copy()
+	opt = stripped.IsEdns0()
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+
+	return stripped
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// minJitteredTTL is the lowest TTL that jitter may reduce an answer to
+const minJitteredTTL = 1
+
+// applyTTLJitter subtracts a random amount, bounded by the configured jitter,
+// from the TTL of every answer so client cache expirations spread out
+// With floor_client_ttl the jitter never takes a TTL below min_cache_ttl
+func (s *DNSServer) applyTTLJitter(m *dns.Msg) {
+	config := s.currentConfig()
+	jitter := config.Server.TTLJitter
+	if jitter <= 0 || len(m.Answer) == 0 {
+		return
+	}
+
+	var floor uint32
+	if config.Cache.Enabled && config.Cache.FloorClientTTL {
+		floor = uint32(config.Cache.MinCacheTTL)
+	}
+
+	// Use a single offset per message so TTLs within an RRset stay equal
+	offset := uint32(rand.Intn(jitter + 1))
+
+	for _, rr := range m.Answer {
+		header := rr.Header()
+		header.Ttl = jitterAboveFloor(header.Ttl, offset, floor)
+	}
+}
+
+// localRecordTTL returns the TTL to emit for a local record
+// Records with a fixed TTL are exempt from jitter
+func (s *DNSServer) localRecordTTL(record *RecordEntry) uint32 {
+	ttl := uint32(record.TTL)
+
+	jitter := s.currentConfig().Server.TTLJitter
+	if record.FixedTTL || jitter <= 0 {
+		return ttl
+	}
+
+	return subtractJitter(ttl, uint32(rand.Intn(jitter+1)))
+}
+
+// subtractJitter subtracts an offset from a TTL without going below minJitteredTTL
+func subtractJitter(ttl, offset uint32) uint32 {
+	if ttl <= minJitteredTTL {
+		return ttl
+	}
+
+	if offset >= ttl || ttl-offset < minJitteredTTL {
+		return minJitteredTTL
+	}
+
+	return ttl - offset
+}
+
+// jitterAboveFloor subtracts jitter from a TTL without taking it below floor
+// A TTL already at or below the floor is left as it is
+func jitterAboveFloor(ttl, offset, floor uint32) uint32 {
+	if ttl <= floor {
+		return ttl
+	}
+	return max(subtractJitter(ttl, offset), floor)
+}
+
+// floorTTLs raises the TTL of every answer to at least floor
+func floorTTLs(m *dns.Msg, floor uint32) {
+	for _, rr := range m.Answer {
+		header := rr.Header()
+		header.Ttl = max(header.Ttl, floor)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLJitterStaysWithinBand(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "jitter.test", Type: "A", Value: "192.0.2.1", TTL: 300})
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig("ttl_jitter = 30")))
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 200; i++ {
+		m := ask(server, "jitter.test", dns.TypeA)
+		if m == nil || len(m.Answer) != 1 {
+			t.Fatalf("got %v, want one answer", m)
+		}
+		ttl := m.Answer[0].Header().Ttl
+		if ttl < 270 || ttl > 300 {
+			t.Fatalf("TTL %d outside the jitter band 270-300", ttl)
+		}
+		seen[ttl] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("TTL never varied, got only %v", seen)
+	}
+}
+
+func TestFixedTTLIsExact(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "fixed.test", Type: "A", Value: "192.0.2.1", TTL: 300, FixedTTL: true})
+	server := newTestServer(t, loadTestConfig(t, serverTestConfig("ttl_jitter = 30")))
+
+	for i := 0; i < 50; i++ {
+		m := ask(server, "fixed.test", dns.TypeA)
+		if m == nil || len(m.Answer) != 1 {
+			t.Fatalf("got %v, want one answer", m)
+		}
+		if ttl := m.Answer[0].Header().Ttl; ttl != 300 {
+			t.Fatalf("got TTL %d, want the fixed 300", ttl)
+		}
+	}
+}
+
+func TestFixedTTLExemptFromRecordTTLRange(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("min_record_ttl = 60"))
+	config.Server.RecordsFile = writeTestFile(t, t.TempDir(), "records.toml",
+		"[[records]]\ndomain = \"fixed.test\"\ntype = \"A\"\nvalue = \"192.0.2.1\"\nttl = 10\nfixed_ttl = true\n")
+	if _, err := LoadRecords(config.Server); err != nil {
+		t.Fatalf("LoadRecords: %v", err)
+	}
+
+	m := ask(newTestServer(t, config), "fixed.test", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 10 {
+		t.Errorf("got %v, want the fixed TTL of 10 below min_record_ttl", m)
+	}
+}
+
+func TestNegativeTTLJitterRejected(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "config.toml", serverTestConfig("ttl_jitter = -5"))
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "ttl_jitter must not be negative") {
+		t.Errorf("got %v, want a negative ttl_jitter rejected", err)
+	}
+}
+
+func TestSubtractJitterKeepsMinimum(t *testing.T) {
+	tests := []struct {
+		ttl, offset, want uint32
+	}{
+		{300, 30, 270},
+		{10, 30, minJitteredTTL},
+		{1, 1, 1},
+		{0, 5, 0},
+	}
+
+	for _, tt := range tests {
+		if got := subtractJitter(tt.ttl, tt.offset); got != tt.want {
+			t.Errorf("subtractJitter(%d, %d) = %d, want %d", tt.ttl, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestTTLDiffersOverTCP(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "mixed.test", Type: "A", Value: "192.0.2.1", TTL: 300,
+		Transport: map[string]TransportOverride{TransportTCP: {TTL: 30}}})
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	for _, tt := range []struct {
+		tcp bool
+		ttl uint32
+	}{
+		{false, 300},
+		{true, 30},
+	} {
+		w := newTestWriter("10.0.0.1", tt.tcp)
+		server.handleRequest(w, query("mixed.test", dns.TypeA))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("tcp = %t: got %v, want one answer", tt.tcp, w.msg)
+		}
+		answer := w.msg.Answer[0].(*dns.A)
+		if answer.Hdr.Ttl != tt.ttl || answer.A.String() != "192.0.2.1" {
+			t.Errorf("tcp = %t: got %v, want 192.0.2.1 with ttl %d", tt.tcp, answer, tt.ttl)
+		}
+	}
+}
+
+func TestTTLJitterKeepsFlooredTTL(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("ttl_jitter = 20")+"\n[cache]\nenabled = true\nmin_cache_ttl = 30\nfloor_client_ttl = true\n")
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(answerFor(r, "192.0.2.1", 40))
+	})
+	server := newTestServer(t, config)
+
+	for i := 0; i < 50; i++ {
+		m := ask(server, "floored.test", dns.TypeA)
+		if m == nil || len(m.Answer) != 1 {
+			t.Fatalf("got %v, want one answer", m)
+		}
+		if ttl := m.Answer[0].Header().Ttl; ttl < 30 || ttl > 40 {
+			t.Fatalf("TTL %d outside 30-40, jitter took it below min_cache_ttl", ttl)
+		}
+	}
+}
+
+func TestJitterAboveFloor(t *testing.T) {
+	tests := []struct {
+		ttl, offset, floor, want uint32
+	}{
+		{300, 30, 0, 270},
+		{300, 30, 280, 280},
+		{30, 20, 30, 30},
+		// Counted down below the floor, left alone rather than raised
+		{10, 5, 30, 10},
+	}
+
+	for _, tt := range tests {
+		if got := jitterAboveFloor(tt.ttl, tt.offset, tt.floor); got != tt.want {
+			t.Errorf("jitterAboveFloor(%d, %d, %d) = %d, want %d", tt.ttl, tt.offset, tt.floor, got, tt.want)
+		}
+	}
+}
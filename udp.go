@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Handling of ANY queries over UDP, an amplification vector
+const (
+	AnyOverUDPAllow   = "allow"
+	AnyOverUDPMinimal = "minimal"
+	AnyOverUDPTC      = "tc"
+	AnyOverUDPRefuse  = "refuse"
+)
+
+// anyMinimalTTL is the TTL of the HINFO record answering minimal ANY responses
+const anyMinimalTTL = 3600
+
+// handleAnyOverUDP answers ANY queries over UDP as any_over_udp configures:
+// with a single HINFO record as RFC 8482 describes, with TC set so the client
+// retries over TCP, or with REFUSED. ANY queries over TCP are answered fully
+// Returns true if a response was sent
+func (s *DNSServer) handleAnyOverUDP(w dns.ResponseWriter, r *dns.Msg, transport string) bool {
+	if r.Question[0].Qtype != dns.TypeANY || transport != TransportUDP {
+		return false
+	}
+
+	m := new(dns.Msg)
+	switch s.currentConfig().Server.AnyOverUDP {
+	case AnyOverUDPMinimal:
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.HINFO{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyMinimalTTL},
+			Cpu: "RFC8482",
+		})
+	case AnyOverUDPTC:
+		m.SetReply(r)
+		m.Truncated = true
+	case AnyOverUDPRefuse:
+		m.SetRcode(r, dns.RcodeRefused)
+	default:
+		return false
+	}
+
+	w.WriteMsg(m)
+	return true
+}
+
+// truncatingWriter fits responses into the buffer a UDP client advertised,
+// setting the TC bit so the client retries over TCP. Upstream answers may
+// arrive over TCP, DoT or DoH and be larger than a UDP client can receive
+type truncatingWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+// WriteMsg truncates the response to the client's buffer size before sending it
+func (w *truncatingWriter) WriteMsg(m *dns.Msg) error {
+	m.Truncate(w.size)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// udpBufferSize returns the largest response a UDP client accepts: its EDNS
+// buffer size, or 512 bytes without EDNS
+func udpBufferSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
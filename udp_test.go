@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// anyAnswerFor answers an ANY query with an A and a TXT record
+func anyAnswerFor(r *dns.Msg) *dns.Msg {
+	m := answerFor(r, "192.0.2.1", 60)
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"v=test"},
+	})
+	return m
+}
+
+func TestAnyOverUDP(t *testing.T) {
+	tests := []struct {
+		policy string
+		check  func(m *dns.Msg) bool
+		want   string
+	}{
+		{AnyOverUDPMinimal, func(m *dns.Msg) bool {
+			hinfo, ok := m.Answer[0].(*dns.HINFO)
+			return len(m.Answer) == 1 && ok && hinfo.Cpu == "RFC8482"
+		}, "a single RFC 8482 HINFO record"},
+		{AnyOverUDPTC, func(m *dns.Msg) bool { return m.Truncated && len(m.Answer) == 0 }, "an empty answer with TC set"},
+		{AnyOverUDPRefuse, func(m *dns.Msg) bool { return m.Rcode == dns.RcodeRefused }, "REFUSED"},
+		{AnyOverUDPAllow, func(m *dns.Msg) bool { return len(m.Answer) == 2 && !m.Truncated }, "the full answer"},
+	}
+
+	for _, tt := range tests {
+		setTestRecords(t)
+		config := loadTestConfig(t, serverTestConfig(`any_over_udp = "`+tt.policy+`"`))
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(anyAnswerFor(r))
+		})
+		server := newTestServer(t, config)
+
+		if m := ask(server, "any.test", dns.TypeANY); m == nil || !tt.check(m) {
+			t.Errorf("%s: got %v over UDP, want %s", tt.policy, m, tt.want)
+		}
+
+		w := newTestWriter("10.0.0.1", true)
+		server.handleRequest(w, query("any.test", dns.TypeANY))
+		if w.msg == nil || len(w.msg.Answer) != 2 || w.msg.Truncated {
+			t.Errorf("%s: got %v over TCP, want the full answer", tt.policy, w.msg)
+		}
+	}
+}
+
+func TestAnyOverUDPRateLimited(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig(`any_over_udp = "tc"`)+"\n[rate_limit]\nqueries_per_second = 1\nburst = 1\n")
+	server := newTestServer(t, config)
+
+	if m := ask(server, "any.test", dns.TypeANY); m == nil || !m.Truncated {
+		t.Fatalf("got %v, want TC set for the first ANY query", m)
+	}
+	if m := ask(server, "any.test", dns.TypeANY); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("got %v, want the second ANY query rate limited", m)
+	}
+}
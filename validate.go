@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNS size limits for TXT record values
+const (
+	// maxTXTStringLength is the longest single character-string in a TXT record
+	maxTXTStringLength = 255
+	// maxTXTValueLength leaves room for the header, question and owner name
+	// within the 65535 byte message limit
+	maxTXTValueLength = 64000
+)
+
+// Handling of query names that break DNS label rules
+const (
+	InvalidQNameFormErr = "formerr"
+	InvalidQNameForward = "forward"
+)
+
+// maxRFC2181TTL is the largest TTL allowed by RFC 2181
+const maxRFC2181TTL = 1<<31 - 1
+
+// recordTarget returns the host name a CNAME, NS, PTR or MX record points to
+func recordTarget(record *RecordEntry) (string, bool) {
+	switch record.Type {
+	case "CNAME", "NS", "PTR":
+		return record.Value, true
+	case "MX":
+		_, target := parseMXRecord(record.Value)
+		return target, true
+	}
+
+	return "", false
+}
+
+// qualifyRecordTarget appends the origin to a bare target host name
+func qualifyRecordTarget(record *RecordEntry, origin string) {
+	target, ok := recordTarget(record)
+	if !ok || origin == "" || strings.Contains(strings.TrimSuffix(target, "."), ".") {
+		return
+	}
+
+	qualified := strings.TrimSuffix(target, ".") + "." + strings.Trim(origin, ".")
+	if record.Type == "MX" {
+		priority, _ := parseMXRecord(record.Value)
+		record.Value = fmt.Sprintf("%d %s", priority, qualified)
+		return
+	}
+	record.Value = qualified
+}
+
+// ValidateRecordTargets returns warnings for CNAME, NS, PTR and MX targets
+// that are not valid domain names or are bare host names, which are most
+// likely meant to be relative to an origin
+func ValidateRecordTargets(records []RecordEntry) []string {
+	warnings := []string{}
+
+	for i := range records {
+		target, ok := recordTarget(&records[i])
+		if !ok || records[i].NoData {
+			continue
+		}
+
+		name := fmt.Sprintf("%s %s", records[i].Domain, records[i].Type)
+		if _, valid := dns.IsDomainName(target); !valid || target == "" {
+			warnings = append(warnings, fmt.Sprintf("%s: target %q is not a valid domain name", name, target))
+			continue
+		}
+
+		if !strings.Contains(strings.TrimSuffix(target, "."), ".") {
+			warnings = append(warnings, fmt.Sprintf("%s: target %q has no dots, set origin to make it relative", name, target))
+		}
+	}
+
+	return warnings
+}
+
+// ValidateRecordSizes returns warnings for record values too large to fit in a DNS message
+func ValidateRecordSizes(records []RecordEntry) []string {
+	warnings := []string{}
+
+	for _, record := range records {
+		if record.Type != "TXT" {
+			continue
+		}
+
+		for _, value := range record.AllValues() {
+			if len(value) > maxTXTValueLength {
+				warnings = append(warnings, fmt.Sprintf("%s TXT: value is %d bytes, it will be truncated to %d bytes",
+					record.Domain, len(value), maxTXTValueLength))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// recordTTLRange returns the configured record TTL range
+// Without a configured maximum only TTLs RFC 2181 forbids are rejected
+func recordTTLRange(config ServerConfig) (int, int) {
+	if config.MaxRecordTTL == 0 {
+		return config.MinRecordTTL, maxRFC2181TTL
+	}
+	return config.MinRecordTTL, config.MaxRecordTTL
+}
+
+// ValidateRecordTTL checks that a record's TTLs, including its transport
+// overrides, lie within minTTL and maxTTL
+// Fixed TTL records are always served as configured, so they are only held
+// to the limits of RFC 2181
+func ValidateRecordTTL(record *RecordEntry, minTTL, maxTTL int) error {
+	if record.FixedTTL {
+		minTTL, maxTTL = 0, maxRFC2181TTL
+	}
+
+	ttls := []int{record.TTL}
+	for _, override := range record.Transport {
+		if override.TTL != 0 {
+			ttls = append(ttls, override.TTL)
+		}
+	}
+
+	for _, ttl := range ttls {
+		if ttl < minTTL || ttl > maxTTL {
+			return fmt.Errorf("%s %s: ttl %d is outside the allowed range %d to %d",
+				record.Domain, record.Type, ttl, minTTL, maxTTL)
+		}
+	}
+
+	return nil
+}
+
+// validQueryName reports whether a query name keeps to DNS length limits and
+// contains only printable ASCII characters
+func validQueryName(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+
+		// Decode \DDD and \X escapes of the presentation format
+		if c == '\\' && i+1 < len(name) {
+			if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+				c = (name[i+1]-'0')*100 + (name[i+2]-'0')*10 + (name[i+3] - '0')
+				i += 3
+			} else {
+				c = name[i+1]
+				i++
+			}
+		}
+
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDigit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitTXTValue splits a TXT value into character-strings of at most 255 bytes
+func splitTXTValue(value string) []string {
+	if len(value) <= maxTXTStringLength {
+		return []string{value}
+	}
+
+	chunks := make([]string, 0, len(value)/maxTXTStringLength+1)
+	for len(value) > maxTXTStringLength {
+		chunks = append(chunks, value[:maxTXTStringLength])
+		value = value[maxTXTStringLength:]
+	}
+	if value != "" {
+		chunks = append(chunks, value)
+	}
+
+	return chunks
+}
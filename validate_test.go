@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateRecordTargets(t *testing.T) {
+	records := []RecordEntry{
+		{Domain: "alias.test", Type: "CNAME", Value: "target.example.com"},
+		{Domain: "bare.test", Type: "CNAME", Value: "webserver"},
+		{Domain: "mail.test", Type: "MX", Value: "10 mailhost"},
+		{Domain: "ns.test", Type: "NS", Value: "ns1.example.com."},
+		{Domain: "bad.test", Type: "PTR", Value: "bad..example.com"},
+		{Domain: "host.test", Type: "A", Value: "192.0.2.1"},
+	}
+
+	warnings := ValidateRecordTargets(records)
+	if len(warnings) != 3 {
+		t.Fatalf("got warnings %q, want 3", warnings)
+	}
+	for i, want := range []string{`bare.test CNAME: target "webserver" has no dots`, `mail.test MX: target "mailhost" has no dots`, `bad.test PTR: target "bad..example.com" is not a valid domain name`} {
+		if !strings.HasPrefix(warnings[i], want) {
+			t.Errorf("warning %d is %q, want %q", i, warnings[i], want)
+		}
+	}
+}
+
+func TestQualifyRecordTarget(t *testing.T) {
+	tests := []struct {
+		record RecordEntry
+		want   string
+	}{
+		{RecordEntry{Type: "CNAME", Value: "webserver"}, "webserver.example.com"},
+		{RecordEntry{Type: "MX", Value: "10 mailhost"}, "10 mailhost.example.com"},
+		{RecordEntry{Type: "CNAME", Value: "www.other.org"}, "www.other.org"},
+		{RecordEntry{Type: "A", Value: "192.0.2.1"}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		record := tt.record
+		qualifyRecordTarget(&record, "example.com.")
+		if record.Value != tt.want {
+			t.Errorf("%s %q qualified to %q, want %q", tt.record.Type, tt.record.Value, record.Value, tt.want)
+		}
+	}
+}
+
+func TestOversizedTXTValues(t *testing.T) {
+	long := strings.Repeat("a", 1000)
+	huge := strings.Repeat("b", maxTXTValueLength+5000)
+	setTestRecords(t,
+		RecordEntry{Domain: "long.test", Type: "TXT", Value: long, TTL: 60},
+		RecordEntry{Domain: "huge.test", Type: "TXT", Value: huge, TTL: 60},
+	)
+	server := newTestServer(t, loadTestConfig(t, testConfig))
+
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{"long.test", 1000},
+		{"huge.test", maxTXTValueLength},
+	}
+	for _, tt := range tests {
+		w := newTestWriter("10.0.0.1", true)
+		server.handleRequest(w, query(tt.name, dns.TypeTXT))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("%s got %v, want one TXT answer", tt.name, w.msg)
+		}
+
+		total := 0
+		for _, chunk := range w.msg.Answer[0].(*dns.TXT).Txt {
+			if len(chunk) > maxTXTStringLength {
+				t.Errorf("%s has a %d byte character-string", tt.name, len(chunk))
+			}
+			total += len(chunk)
+		}
+		if total != tt.length {
+			t.Errorf("%s served %d bytes, want %d", tt.name, total, tt.length)
+		}
+		if _, err := w.msg.Pack(); err != nil {
+			t.Errorf("%s response does not pack: %v", tt.name, err)
+		}
+	}
+
+	warnings := ValidateRecordSizes(Records.Records)
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "huge.test TXT") {
+		t.Errorf("got warnings %q, want one for huge.test", warnings)
+	}
+}
+
+func TestInvalidQueryNames(t *testing.T) {
+	names := map[string]string{
+		"overlong label":    strings.Repeat("a", 64) + ".test.",
+		"name over 255":     strings.Repeat("abcdefghi.", 26),
+		"illegal character": "bad\x01name.test.",
+	}
+
+	// Queries passed on by the qname stage are answered by the next one
+	registerTestStage(t, "test_answer", func(s *DNSServer) Middleware {
+		return func(next QueryHandler) QueryHandler {
+			return func(w dns.ResponseWriter, r *dns.Msg, rc *requestContext) {
+				w.WriteMsg(answerFor(r, "192.0.2.1", 60))
+			}
+		}
+	})
+
+	for _, policy := range []string{InvalidQNameFormErr, InvalidQNameForward} {
+		setTestRecords(t)
+		server := newTestServer(t, loadTestConfig(t, serverTestConfig(`invalid_qname = "`+policy+`"
+pipeline = ["qname", "test_answer"]`)))
+
+		for kind, name := range names {
+			w := newTestWriter("10.0.0.1", true)
+			server.handleRequest(w, query(name, dns.TypeA))
+
+			switch {
+			case w.msg == nil:
+				t.Errorf("%s, %s: no response", policy, kind)
+			case policy == InvalidQNameFormErr && w.msg.Rcode != dns.RcodeFormatError:
+				t.Errorf("%s, %s: got %v, want FORMERR", policy, kind, w.msg)
+			case policy == InvalidQNameForward && len(w.msg.Answer) != 1:
+				t.Errorf("%s, %s: got %v, want the query passed on", policy, kind, w.msg)
+			}
+		}
+	}
+
+	if !validQueryName("www.example.com.") {
+		t.Error("a valid name was rejected")
+	}
+}
+
+func TestInvalidQueryNamesRateLimitedAndLogged(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig("log_queries = true")+
+		"\n[rate_limit]\nqueries_per_second = 1\nburst = 1\nresponse = \"servfail\"\n")
+	logs := captureLog(t)
+	server := newTestServer(t, config)
+
+	name := strings.Repeat("a", 64) + ".test."
+	for i, want := range []int{dns.RcodeFormatError, dns.RcodeServerFailure} {
+		if m := ask(server, name, dns.TypeA); m == nil || m.Rcode != want {
+			t.Errorf("query %d: got %v, want %s", i+1, m, dns.RcodeToString[want])
+		}
+	}
+	if !strings.Contains(logs.String(), "Query: "+strings.Repeat("a", 64)) {
+		t.Errorf("expected the query to be logged, got %q", logs.String())
+	}
+	if got := server.metrics.Queries.Load(); got != 2 {
+		t.Errorf("counted %d queries, want 2", got)
+	}
+}
+
+func TestValidateRecordTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  RecordEntry
+		wantErr bool
+	}{
+		{"within range", RecordEntry{Domain: "a.test", Type: "A", TTL: 300}, false},
+		{"below minimum", RecordEntry{Domain: "a.test", Type: "A", TTL: 10}, true},
+		{"above maximum", RecordEntry{Domain: "a.test", Type: "A", TTL: 86401}, true},
+		{"transport ttl below minimum", RecordEntry{Domain: "a.test", Type: "A", TTL: 300,
+			Transport: map[string]TransportOverride{TransportDoH: {TTL: 5}}}, true},
+		{"transport ttl above maximum", RecordEntry{Domain: "a.test", Type: "A", TTL: 300,
+			Transport: map[string]TransportOverride{TransportUDP: {TTL: 100000}}}, true},
+		{"transport override without ttl", RecordEntry{Domain: "a.test", Type: "A", TTL: 300,
+			Transport: map[string]TransportOverride{TransportTCP: {Value: "192.0.2.2"}}}, false},
+		{"fixed ttl below minimum", RecordEntry{Domain: "a.test", Type: "A", TTL: 10, FixedTTL: true}, false},
+		{"fixed ttl above maximum", RecordEntry{Domain: "a.test", Type: "A", TTL: 100000, FixedTTL: true}, false},
+		{"fixed ttl above RFC 2181", RecordEntry{Domain: "a.test", Type: "A", TTL: maxRFC2181TTL + 1, FixedTTL: true}, true},
+	}
+
+	for _, tt := range tests {
+		err := ValidateRecordTTL(&tt.record, 30, 86400)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Without a configured maximum only RFC 2181 limits apply
+	record := RecordEntry{Domain: "a.test", Type: "A", TTL: maxRFC2181TTL}
+	if err := ValidateRecordTTL(&record, 0, maxRFC2181TTL); err != nil {
+		t.Errorf("got %v for the RFC 2181 maximum, want it accepted", err)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Defaults for SOA records synthesized for owned zones without a configured SOA
+const (
+	defaultSOASerial  = 1
+	defaultSOARefresh = 3600
+	defaultSOARetry   = 600
+	defaultSOAExpire  = 604800
+	defaultSOAMinimum = 300
+)
+
+// Schemes for incrementing the SOA serial of owned zones when records change
+// Date serials have the form YYYYMMDDnn
+const (
+	AutoSerialCounter = "counter"
+	AutoSerialDate    = "date"
+)
+
+// Handling of queries sent without RD (recursion desired)
+const (
+	IterativeRecurse  = "recurse"
+	IterativeRefuse   = "refuse"
+	IterativeReferral = "referral"
+)
+
+// Upward referral sent for iterative queries outside owned zones
+const (
+	rootReferralServer = "a.root-servers.net."
+	rootReferralTTL    = 518400
+)
+
+// zoneSerials holds the auto-incremented SOA serials of owned zones, keyed by zone
+type zoneSerials struct {
+	serials map[string]uint32
+	// Source of the date for date serials
+	clock Clock
+
+	// Guards serials
+	mu sync.Mutex
+}
+
+// newZoneSerials creates an empty set of zone serials dated by the given clock
+func newZoneSerials(clock Clock) *zoneSerials {
+	return &zoneSerials{serials: make(map[string]uint32), clock: clock}
+}
+
+// findOwnedZone returns the most specific owned zone containing the domain
+func (s *DNSServer) findOwnedZone(domain string) *ZoneConfig {
+	domain = normalizeName(domain)
+
+	var best *ZoneConfig
+	zones := s.currentConfig().Zones
+	for i := range zones {
+		name := normalizeName(zones[i].Name)
+		if domain != name && !strings.HasSuffix(domain, "."+name) {
+			continue
+		}
+
+		if best == nil || len(name) > len(strings.TrimSuffix(best.Name, ".")) {
+			best = &zones[i]
+		}
+	}
+
+	return best
+}
+
+// zoneSOA returns the SOA record of an owned zone, synthesizing a minimal one
+// from defaults for any fields that are not configured
+func zoneSOA(zone *ZoneConfig) *dns.SOA {
+	origin := dns.Fqdn(strings.ToLower(zone.Name))
+
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   origin,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+		},
+		Ns:      "ns." + origin,
+		Mbox:    "hostmaster." + origin,
+		Serial:  defaultSOASerial,
+		Refresh: defaultSOARefresh,
+		Retry:   defaultSOARetry,
+		Expire:  defaultSOAExpire,
+		Minttl:  defaultSOAMinimum,
+	}
+
+	if zone.SOA.MName != "" {
+		soa.Ns = dns.Fqdn(zone.SOA.MName)
+	}
+	if zone.SOA.RName != "" {
+		soa.Mbox = dns.Fqdn(zone.SOA.RName)
+	}
+	if zone.SOA.Serial != 0 {
+		soa.Serial = zone.SOA.Serial
+	}
+	if zone.SOA.Refresh != 0 {
+		soa.Refresh = zone.SOA.Refresh
+	}
+	if zone.SOA.Retry != 0 {
+		soa.Retry = zone.SOA.Retry
+	}
+	if zone.SOA.Expire != 0 {
+		soa.Expire = zone.SOA.Expire
+	}
+	if zone.SOA.Minimum != 0 {
+		soa.Minttl = zone.SOA.Minimum
+	}
+
+	// Negative answers are cached for the lower of the SOA TTL and minimum
+	soa.Hdr.Ttl = soa.Minttl
+	if zone.SOA.TTL != 0 && zone.SOA.TTL < soa.Minttl {
+		soa.Hdr.Ttl = zone.SOA.TTL
+	}
+
+	return soa
+}
+
+// ownedZoneSOA returns the SOA record served for an owned zone, with its
+// auto-incremented serial when auto_serial is set
+func (s *DNSServer) ownedZoneSOA(zone *ZoneConfig) *dns.SOA {
+	soa := zoneSOA(zone)
+	if zone.SOA.AutoSerial != "" {
+		soa.Serial = s.serials.current(zone)
+	}
+	return soa
+}
+
+// handleOwnedZone answers authoritatively for names in an owned zone that have
+// no matching local record, so they are never forwarded upstream
+// Returns true if the domain belongs to an owned zone and a response was sent
+func (s *DNSServer) handleOwnedZone(w dns.ResponseWriter, r *dns.Msg, q dns.Question) bool {
+	domain := getDomainFromQuestion(q)
+
+	zone := s.findOwnedZone(domain)
+	if zone == nil {
+		return false
+	}
+
+	soa := s.ownedZoneSOA(zone)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	switch {
+	case q.Qtype == dns.TypeSOA && dns.Fqdn(strings.ToLower(domain)) == soa.Hdr.Name:
+		// Answer SOA queries at the zone apex
+		m.Answer = append(m.Answer, soa)
+	case s.records.Exists(domain):
+		// NODATA: the name exists but has no records of the requested type
+		m.Ns = append(m.Ns, soa)
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soa)
+	}
+
+	w.WriteMsg(m)
+	return true
+}
+
+// handleIterativeQuery applies the iterative_queries policy to a query without RD
+// Under "referral", names in owned zones or with local records are answered as
+// usual and other names get a minimal referral to the root instead of being recursed
+// Returns true if a response was sent
+func (s *DNSServer) handleIterativeQuery(w dns.ResponseWriter, r *dns.Msg) bool {
+	if r.RecursionDesired {
+		return false
+	}
+
+	m := new(dns.Msg)
+	switch s.currentConfig().Server.IterativeQueries {
+	case IterativeRefuse:
+		m.SetRcode(r, dns.RcodeRefused)
+	case IterativeReferral:
+		// Whether the name has local records is only known once they are loaded
+		if !s.awaitRecords(w, r) {
+			return true
+		}
+
+		domain := getDomainFromQuestion(r.Question[0])
+		if s.findOwnedZone(domain) != nil || s.records.Exists(domain) {
+			return false
+		}
+
+		m.SetReply(r)
+		m.Ns = append(m.Ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: rootReferralTTL},
+			Ns:  rootReferralServer,
+		})
+	default:
+		return false
+	}
+
+	w.WriteMsg(m)
+	return true
+}
+
+// handleMissingAAAA answers NODATA for an AAAA query without a local answer
+// when IPv6 is disabled, or on a name that has a local A record when
+// local_nodata_for_missing_aaaa is set
+// Returns true if a response was sent
+func (s *DNSServer) handleMissingAAAA(w dns.ResponseWriter, r *dns.Msg, q dns.Question, clientIP net.IP) bool {
+	if q.Qtype != dns.TypeAAAA {
+		return false
+	}
+
+	config := s.currentConfig().Server
+	switch {
+	case config.DisableIPv6:
+	case config.LocalNoDataForMissingAAAA && s.findRecord(getDomainFromQuestion(q), "A", clientIP) != nil:
+	default:
+		return false
+	}
+
+	// Names in owned zones were already answered with the zone's SOA
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	w.WriteMsg(m)
+	return true
+}
+
+// current returns the serial of a zone, never lower than its configured
+// serial or, for date serials, the start of today
+func (z *zoneSerials) current(zone *ZoneConfig) uint32 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.currentLocked(zone)
+}
+
+// currentLocked returns the serial of a zone
+// Must be called with z.mu held
+func (z *zoneSerials) currentLocked(zone *ZoneConfig) uint32 {
+	name := normalizeName(zone.Name)
+
+	serial := max(z.serials[name], zone.SOA.Serial, defaultSOASerial)
+	if zone.SOA.AutoSerial == AutoSerialDate {
+		serial = max(serial, dateSerial(z.clock.Now()))
+	}
+
+	z.serials[name] = serial
+	return serial
+}
+
+// bump increments the serial of a zone and returns the new serial
+func (z *zoneSerials) bump(zone *ZoneConfig) uint32 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	serial := z.currentLocked(zone) + 1
+	z.serials[normalizeName(zone.Name)] = serial
+	return serial
+}
+
+// dateSerial returns the first YYYYMMDDnn serial of a day
+func dateSerial(now time.Time) uint32 {
+	day, _ := strconv.ParseUint(now.UTC().Format("20060102"), 10, 32)
+	return uint32(day) * 100
+}
+
+// bumpZoneSerials increments the serial of every auto-serial owned zone
+// containing one of the changed records, so secondaries notice the change
+func (s *DNSServer) bumpZoneSerials(changed []RecordEntry) {
+	zones := s.currentConfig().Zones
+	for i := range zones {
+		zone := &zones[i]
+		if zone.SOA.AutoSerial == "" {
+			continue
+		}
+
+		name := normalizeName(zone.Name)
+		for _, record := range changed {
+			domain := normalizeName(record.Domain)
+			if domain == name || strings.HasSuffix(domain, "."+name) {
+				log.Printf("Records in zone %s changed, SOA serial is now %d", zone.Name, s.serials.bump(zone))
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ownedZonesConfig owns a zone with a configured SOA and one with a synthesized SOA
+const ownedZonesConfig = testConfig + `
+[[zones]]
+name = "corp.test"
+
+[zones.soa]
+mname = "ns1.corp.test"
+rname = "admin.corp.test"
+serial = 2024010101
+minimum = 120
+
+[[zones]]
+name = "lab.test"
+`
+
+// authoritySOA returns the SOA in the authority section of a response, nil if there is none
+func authoritySOA(m *dns.Msg) *dns.SOA {
+	if m == nil || len(m.Ns) != 1 {
+		return nil
+	}
+	soa, _ := m.Ns[0].(*dns.SOA)
+	return soa
+}
+
+func TestOwnedZoneNegativeAnswersCarrySOA(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "www.corp.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	server := newTestServer(t, loadTestConfig(t, ownedZonesConfig))
+
+	m := ask(server, "missing.corp.test", dns.TypeA)
+	soa := authoritySOA(m)
+	if m == nil || m.Rcode != dns.RcodeNameError || !m.Authoritative || soa == nil {
+		t.Fatalf("got %v, want an authoritative NXDOMAIN with the SOA", m)
+	}
+	if soa.Ns != "ns1.corp.test." || soa.Serial != 2024010101 || soa.Hdr.Ttl != 120 {
+		t.Errorf("got SOA %v, want the configured one", soa)
+	}
+
+	m = ask(server, "missing.lab.test", dns.TypeA)
+	soa = authoritySOA(m)
+	if m == nil || m.Rcode != dns.RcodeNameError || soa == nil {
+		t.Fatalf("got %v, want an NXDOMAIN with a synthesized SOA", m)
+	}
+	if soa.Hdr.Name != "lab.test." || soa.Ns != "ns.lab.test." || soa.Serial != defaultSOASerial || soa.Minttl != defaultSOAMinimum {
+		t.Errorf("got SOA %v, want one synthesized from defaults", soa)
+	}
+
+	// A name with records of another type is NODATA rather than NXDOMAIN
+	m = ask(server, "www.corp.test", dns.TypeMX)
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || authoritySOA(m) == nil {
+		t.Errorf("got %v, want NODATA with the SOA", m)
+	}
+
+	m = ask(server, "corp.test", dns.TypeSOA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("got %v, want the SOA at the apex", m)
+	}
+}
+
+func TestLocalNoDataForMissingAAAA(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		setTestRecords(t, RecordEntry{Domain: "v4only.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+		config := loadTestConfig(t, serverTestConfig("local_nodata_for_missing_aaaa = "+strconv.FormatBool(enabled)))
+		var hits atomic.Int32
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			hits.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP("2001:db8::99"),
+			})
+			w.WriteMsg(m)
+		})
+		server := newTestServer(t, config)
+
+		m := ask(server, "v4only.test", dns.TypeAAAA)
+		if enabled {
+			if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || hits.Load() != 0 {
+				t.Errorf("enabled: got %v after %d upstream queries, want local NODATA", m, hits.Load())
+			}
+		} else if m == nil || len(m.Answer) != 1 || hits.Load() != 1 {
+			t.Errorf("disabled: got %v, want the upstream's AAAA", m)
+		}
+
+		// Names without a local A record are still forwarded
+		if m := ask(server, "remote.test", dns.TypeAAAA); m == nil || len(m.Answer) != 1 {
+			t.Errorf("enabled = %t: got %v for a remote name, want the upstream's AAAA", enabled, m)
+		}
+	}
+}
+
+func TestDisableIPv6AnswersAAAAWithNoData(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "local.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	config := loadTestConfig(t, serverTestConfig("disable_ipv6 = true"))
+	var aaaaForwarded atomic.Bool
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			aaaaForwarded.Store(true)
+		}
+		w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+	})
+	server := newTestServer(t, config)
+
+	for _, name := range []string{"local.test", "remote.test"} {
+		if m := ask(server, name, dns.TypeAAAA); m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%s AAAA: got %v, want NODATA", name, m)
+		}
+	}
+	if aaaaForwarded.Load() {
+		t.Error("an AAAA query was forwarded with IPv6 disabled")
+	}
+
+	if m := ask(server, "local.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("local A: got %v, want the local answer", m)
+	}
+	if m := ask(server, "remote.test", dns.TypeA); m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("remote A: got %v, want the upstream answer", m)
+	}
+}
+
+func TestDisableIPv6RejectsIPv6Listen(t *testing.T) {
+	_, err := LoadConfig(writeTestFile(t, t.TempDir(), "config.toml", serverTestConfig("disable_ipv6 = true\nlisten = \"::\"")))
+	if err == nil || !strings.Contains(err.Error(), "disable_ipv6 is set") {
+		t.Errorf("got %v, want the IPv6 listen address rejected", err)
+	}
+}
+
+// zoneSerial returns the serial of the SOA carried by an NXDOMAIN in the zone
+func zoneSerial(t *testing.T, server *DNSServer, missing string) uint32 {
+	t.Helper()
+
+	soa := authoritySOA(ask(server, missing, dns.TypeA))
+	if soa == nil {
+		t.Fatalf("no SOA in the answer for %s", missing)
+	}
+	return soa.Serial
+}
+
+func TestAutoSerialBumpedOnRecordEdits(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, recordsAdminConfig+`
+[[zones]]
+name = "corp.test"
+
+[zones.soa]
+serial = 5
+auto_serial = "counter"
+`)
+	dir := t.TempDir()
+	config.Server.RecordsFile = writeTestFile(t, dir, "records.toml", testRecords("www.corp.test", "192.0.2.1"))
+	if _, err := LoadRecords(config.Server); err != nil {
+		t.Fatalf("LoadRecords: %v", err)
+	}
+	server := newTestServer(t, config)
+
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 5 {
+		t.Fatalf("got initial serial %d, want 5", serial)
+	}
+
+	// Editing a record in the zone bumps the serial
+	writeTestFile(t, dir, "records.toml", testRecords("www.corp.test", "192.0.2.2"))
+	server.ReloadRecords()
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 6 {
+		t.Errorf("got serial %d after a file edit, want 6", serial)
+	}
+
+	// Records outside the zone leave it alone
+	writeTestFile(t, dir, "records.toml", testRecords("www.corp.test", "192.0.2.2")+testRecords("other.test", "192.0.2.3"))
+	server.ReloadRecords()
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 6 {
+		t.Errorf("got serial %d after an edit outside the zone, want 6", serial)
+	}
+}
+
+func TestDateAutoSerial(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "www.corp.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	clock := NewFakeClock(time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC))
+	server := newTestServer(t, loadTestConfig(t, testConfig+`
+[[zones]]
+name = "corp.test"
+
+[zones.soa]
+auto_serial = "date"
+`), WithClock(clock))
+
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 2024031500 {
+		t.Fatalf("got serial %d, want 2024031500", serial)
+	}
+	server.RecordsChanged([]RecordEntry{{Domain: "www.corp.test", Type: "A", Value: "192.0.2.2"}})
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 2024031501 {
+		t.Errorf("got serial %d after an edit, want 2024031501", serial)
+	}
+
+	// A new day starts a new serial sequence
+	clock.Advance(24 * time.Hour)
+	if serial := zoneSerial(t, server, "missing.corp.test"); serial != 2024031600 {
+		t.Errorf("got serial %d the next day, want 2024031600", serial)
+	}
+}
+
+func TestDeclaredNoData(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, testConfig)
+	var hits atomic.Int32
+	startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		servFail(w, r)
+	})
+	server := newTestServer(t, config)
+	writeTestFile(t, filepath.Dir(config.Server.RecordsFile), filepath.Base(config.Server.RecordsFile),
+		testRecords("private.test", "192.0.2.1")+`
+[[records]]
+domain = "private.test"
+type = "AAAA"
+nodata = true
+`)
+	server.ReloadRecords()
+
+	m := ask(server, "private.test", dns.TypeAAAA)
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || !m.Authoritative {
+		t.Errorf("got %v, want an authoritative empty NOERROR", m)
+	}
+	if m := ask(server, "private.test", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("got %v, want the A record", m)
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream queried %d times, want the NODATA answered locally", got)
+	}
+}
+
+// iterativeQuery builds a query with RD cleared
+func iterativeQuery(name string, qtype uint16) *dns.Msg {
+	m := query(name, qtype)
+	m.RecursionDesired = false
+	return m
+}
+
+func TestIterativeQueries(t *testing.T) {
+	setTestRecords(t, RecordEntry{Domain: "www.corp.test", Type: "A", Value: "192.0.2.1", TTL: 60})
+	askIterative := func(server *DNSServer, name string) *dns.Msg {
+		w := newTestWriter("10.0.0.1", false)
+		server.handleRequest(w, iterativeQuery(name, dns.TypeA))
+		return w.msg
+	}
+	newServer := func(policy string) (*DNSServer, *atomic.Int32) {
+		config := loadTestConfig(t, strings.Replace(ownedZonesConfig, "[server]\n", "[server]\niterative_queries = \""+policy+"\"\n", 1))
+		var forwarded atomic.Int32
+		startTestUpstream(t, config, func(w dns.ResponseWriter, r *dns.Msg) {
+			forwarded.Add(1)
+			w.WriteMsg(answerFor(r, "198.51.100.1", 60))
+		})
+		return newTestServer(t, config), &forwarded
+	}
+
+	server, forwarded := newServer(IterativeRecurse)
+	if m := askIterative(server, "other.test"); m == nil || len(m.Answer) != 1 || forwarded.Load() != 1 {
+		t.Errorf("recurse: got %v, want the query forwarded", m)
+	}
+
+	server, forwarded = newServer(IterativeRefuse)
+	if m := askIterative(server, "other.test"); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("refuse: got %v, want REFUSED", m)
+	}
+	if m := ask(server, "other.test", dns.TypeA); m == nil || len(m.Answer) != 1 || forwarded.Load() != 1 {
+		t.Errorf("refuse: got %v for a query with RD, want it forwarded", m)
+	}
+
+	server, forwarded = newServer(IterativeReferral)
+	if m := askIterative(server, "www.corp.test"); m == nil || len(m.Answer) != 1 {
+		t.Errorf("referral: got %v, want the local record", m)
+	}
+	if m := askIterative(server, "missing.corp.test"); m == nil || m.Rcode != dns.RcodeNameError || authoritySOA(m) == nil {
+		t.Errorf("referral: got %v, want NXDOMAIN for a name in an owned zone", m)
+	}
+	m := askIterative(server, "other.test")
+	if m == nil || len(m.Answer) != 0 || len(m.Ns) != 1 || m.Ns[0].Header().Name != "." {
+		t.Errorf("referral: got %v, want a referral to the root", m)
+	}
+	if forwarded.Load() != 0 {
+		t.Errorf("referral: %d queries forwarded, want none", forwarded.Load())
+	}
+}
+
+func TestIterativeQueriesRateLimited(t *testing.T) {
+	setTestRecords(t)
+	config := loadTestConfig(t, serverTestConfig(`iterative_queries = "refuse"`)+
+		"\n[rate_limit]\nqueries_per_second = 1\nburst = 1\nresponse = \"servfail\"\n")
+	server := newTestServer(t, config)
+
+	for i, want := range []int{dns.RcodeRefused, dns.RcodeServerFailure} {
+		w := newTestWriter("10.0.0.1", false)
+		server.handleRequest(w, iterativeQuery("other.test", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != want {
+			t.Errorf("query %d: got %v, want %s", i+1, w.msg, dns.RcodeToString[want])
+		}
+	}
+}